@@ -0,0 +1,252 @@
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/viper"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/bpineau/katafygio/pkg/client"
+	"github.com/bpineau/katafygio/pkg/controller"
+	"github.com/bpineau/katafygio/pkg/observer"
+)
+
+// clusterConf describes a cluster to backup, from the config file "clusters" section
+type clusterConf struct {
+	Name          string                  `mapstructure:"name"`
+	Context       string                  `mapstructure:"context"`
+	KubeConfig    string                  `mapstructure:"kube-config"`
+	APIServer     string                  `mapstructure:"api-server"`
+	Filter        string                  `mapstructure:"filter"`
+	IncludeKind   []string                `mapstructure:"include-kind"`
+	MetadataOnly  []string                `mapstructure:"metadata-only"`
+	ExcludeKind   []string                `mapstructure:"exclude-kind"`
+	ExcludeObject []string                `mapstructure:"exclude-object"`
+	ExcludeLabel  []string                `mapstructure:"exclude-label"`
+	ExcludeAnnot  []string                `mapstructure:"exclude-annotation"`
+	IncludeNs     []string                `mapstructure:"include-namespace"`
+	ExcludeNs     []string                `mapstructure:"exclude-namespace"`
+	Selectors     map[string]selectorConf `mapstructure:"selectors"`
+
+	// GitBranch commits the cluster's objects to its own branch (rather
+	// than --git-branch), from its own working copy
+	GitBranch string `mapstructure:"git-branch"`
+
+	client       client.Interface
+	selectors    map[string]controller.Selector
+	exclusions   *controller.Exclusions
+	namespaces   *controller.NamespaceFilter
+	kinds        []*observer.KindPattern
+	metadata     []*observer.KindPattern
+	transformers []controller.Transformer
+}
+
+// selectorConf restricts the objects of a kind, from the config file "selectors" sections
+type selectorConf struct {
+	Label string `mapstructure:"label"`
+	Field string `mapstructure:"field"`
+}
+
+// branchesDir is the local-dir subdirectory holding the working copies
+// of the clusters' own git branches
+const branchesDir = ".branches"
+
+var (
+	// cluster names are used as directory names
+	clusterName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+	// branch names are used as directory names too (once path escaped)
+	branchName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._/-]*$`)
+)
+
+// loadClusters returns the clusters listed in the config file, with their
+// clients. Without such a list, we backup the single cluster selected by the
+// command line flags, at the root of the dump directory.
+func loadClusters() ([]*clusterConf, error) {
+	var clusters []*clusterConf
+	if err := viper.UnmarshalKey("clusters", &clusters); err != nil {
+		return nil, fmt.Errorf("invalid clusters configuration: %v", err)
+	}
+
+	var selectors map[string]selectorConf
+	if err := viper.UnmarshalKey("selectors", &selectors); err != nil {
+		return nil, fmt.Errorf("invalid selectors configuration: %v", err)
+	}
+
+	if len(clusters) == 0 {
+		c := &clusterConf{
+			APIServer:     apiServer,
+			KubeConfig:    kubeConf,
+			Filter:        filter,
+			IncludeKind:   inclkind,
+			MetadataOnly:  metaOnly,
+			ExcludeKind:   exclkind,
+			ExcludeObject: exclobj,
+			ExcludeLabel:  exclLabel,
+			ExcludeAnnot:  exclAnnot,
+			IncludeNs:     includeNs,
+			ExcludeNs:     excludeNs,
+			Selectors:     selectors,
+			client:        restcfg,
+		}
+		if err := c.setup(); err != nil {
+			return nil, err
+		}
+		return []*clusterConf{c}, nil
+	}
+
+	seen := make(map[string]bool)
+	for _, c := range clusters {
+		if !clusterName.MatchString(c.Name) {
+			return nil, fmt.Errorf("invalid cluster name %q", c.Name)
+		}
+		if seen[c.Name] {
+			return nil, fmt.Errorf("cluster %s is configured twice", c.Name)
+		}
+		seen[c.Name] = true
+
+		if c.GitBranch == gitBranch {
+			c.GitBranch = ""
+		}
+		if c.GitBranch != "" && (!branchName.MatchString(c.GitBranch) || strings.Contains(c.GitBranch, "..")) {
+			return nil, fmt.Errorf("cluster %s: invalid git branch %q", c.Name, c.GitBranch)
+		}
+
+		// global settings apply to all clusters
+		if c.KubeConfig == "" {
+			c.KubeConfig = kubeConf
+		}
+		if c.Filter == "" {
+			c.Filter = filter
+		}
+		c.IncludeKind = append(append([]string{}, inclkind...), c.IncludeKind...)
+		c.MetadataOnly = append(append([]string{}, metaOnly...), c.MetadataOnly...)
+		c.ExcludeKind = append(append([]string{}, exclkind...), c.ExcludeKind...)
+		c.ExcludeObject = append(append([]string{}, exclobj...), c.ExcludeObject...)
+		c.ExcludeLabel = append(append([]string{}, exclLabel...), c.ExcludeLabel...)
+		c.ExcludeAnnot = append(append([]string{}, exclAnnot...), c.ExcludeAnnot...)
+		c.IncludeNs = append(append([]string{}, includeNs...), c.IncludeNs...)
+		c.ExcludeNs = append(append([]string{}, excludeNs...), c.ExcludeNs...)
+		merged := make(map[string]selectorConf)
+		for kind, sel := range selectors {
+			merged[strings.ToLower(kind)] = sel
+		}
+		for kind, sel := range c.Selectors {
+			merged[strings.ToLower(kind)] = sel
+		}
+		c.Selectors = merged
+
+		if err := c.setup(); err != nil {
+			return nil, err
+		}
+	}
+
+	return clusters, nil
+}
+
+// dumpDir returns the directory the cluster's objects are saved in (under
+// a subdirectory named after the cluster): local-dir, or the working copy of
+// the cluster's own git branch.
+func (c *clusterConf) dumpDir() string {
+	if c.GitBranch == "" {
+		return localDir
+	}
+	return filepath.Join(localDir, branchesDir, url.PathEscape(c.GitBranch))
+}
+
+// findCluster returns the named cluster's configuration
+func findCluster(clusters []*clusterConf, name string) (*clusterConf, error) {
+	for _, c := range clusters {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("cluster %s not found in the configuration", name)
+}
+
+// clusterFiles returns the files saved in a cluster's directory, with
+// paths relative to that directory.
+func clusterFiles(files map[string][]byte, name string) map[string][]byte {
+	prefix := name + "/"
+	selected := make(map[string][]byte)
+	for path, data := range files {
+		if p := filepath.ToSlash(path); strings.HasPrefix(p, prefix) {
+			selected[strings.TrimPrefix(p, prefix)] = data
+		}
+	}
+	return selected
+}
+
+func (c *clusterConf) setup() (err error) {
+	c.selectors = make(map[string]controller.Selector)
+	for kind, conf := range c.Selectors {
+		sel := controller.Selector{Label: conf.Label, Field: conf.Field}
+		if err = sel.Validate(); err != nil {
+			return fmt.Errorf("invalid %s selectors: %v", kind, err)
+		}
+		c.selectors[strings.ToLower(kind)] = sel
+	}
+
+	c.exclusions, err = controller.NewExclusions(c.ExcludeObject, c.ExcludeLabel, c.ExcludeAnnot)
+	if err != nil {
+		return err
+	}
+
+	c.namespaces, err = controller.NewNamespaceFilter(c.IncludeNs, c.ExcludeNs)
+	if err != nil {
+		return err
+	}
+
+	c.kinds, err = observer.ParseKindPatterns(c.IncludeKind)
+	if err != nil {
+		return err
+	}
+
+	c.metadata, err = observer.ParseKindPatterns(c.MetadataOnly)
+	if err != nil {
+		return err
+	}
+
+	if c.client != nil {
+		return nil
+	}
+
+	c.client, err = client.New(c.APIServer, c.KubeConfig, c.Context)
+	if err != nil {
+		if c.Name != "" {
+			return fmt.Errorf("failed to create a client for cluster %s: %v", c.Name, err)
+		}
+		return fmt.Errorf("failed to create a client: %v", err)
+	}
+
+	return nil
+}
+
+// watchNamespaces maintains the cluster's namespaces cache used for exclusions
+func (c *clusterConf) watchNamespaces(stopCh <-chan struct{}) error {
+	dyn, err := dynamic.NewForConfig(c.client.GetRestConfig())
+	if err != nil {
+		return fmt.Errorf("failed to create a client: %v", err)
+	}
+
+	namespaces := dyn.Resource(schema.GroupVersionResource{Version: "v1", Resource: "namespaces"})
+	c.exclusions.WatchNamespaces(&cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return namespaces.List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return namespaces.Watch(options)
+		},
+	}, stopCh)
+
+	return nil
+}
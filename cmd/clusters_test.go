@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestLoadClusters(t *testing.T) {
+	defer viper.Set("clusters", nil)
+	defer viper.Set("selectors", nil)
+
+	restcfg = new(mockClient)
+	clusters, err := loadClusters()
+	if err != nil || len(clusters) != 1 || clusters[0].Name != "" || clusters[0].client != restcfg {
+		t.Errorf("without clusters list, we should backup a single unnamed cluster: %v", err)
+	}
+
+	exclkind = []string{"event"}
+	defer func() { exclkind = nil }()
+
+	// as decoded from a yaml config file
+	viper.Set("selectors", map[string]interface{}{
+		"secret": map[interface{}]interface{}{"field": "type!=kubernetes.io/service-account-token"},
+		"event":  map[interface{}]interface{}{"field": "reason=BackOff"},
+	})
+	viper.Set("clusters", []interface{}{
+		map[interface{}]interface{}{"name": "prod", "api-server": "http://192.0.2.1", "git-branch": "team/prod",
+			"selectors": map[interface{}]interface{}{"Event": map[interface{}]interface{}{"label": "tier=front"}}},
+		map[interface{}]interface{}{"name": "staging", "api-server": "http://192.0.2.2",
+			"filter": "app=foo", "exclude-kind": []interface{}{"pod"}, "exclude-namespace": []interface{}{"kube-*"},
+			"exclude-label": []interface{}{"backup=false"}},
+	})
+
+	clusters, err = loadClusters()
+	if err != nil || len(clusters) != 2 {
+		t.Fatalf("failed to load clusters: %v", err)
+	}
+
+	prod, _ := findCluster(clusters, "prod")
+	if prod.selectors["event"].Label != "tier=front" || prod.selectors["event"].Field != "" ||
+		prod.selectors["secret"].Field != "type!=kubernetes.io/service-account-token" {
+		t.Errorf("clusters selectors should override the global ones, per kind: %+v", prod.selectors)
+	}
+
+	staging, err := findCluster(clusters, "staging")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if staging.Filter != "app=foo" || len(staging.ExcludeKind) != 2 || staging.client == nil {
+		t.Errorf("clusters should have their own settings, added to global ones: %+v", staging)
+	}
+
+	if staging.namespaces.Match("kube-system") || !staging.namespaces.Match("default") {
+		t.Error("clusters should have their own namespaces filter")
+	}
+
+	marked := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	marked.SetLabels(map[string]string{"backup": "false"})
+	if !staging.exclusions.Marked(marked) || prod.exclusions.Marked(marked) {
+		t.Error("clusters should have their own exclusion labels")
+	}
+
+	if staging.client.GetRestConfig().Host != "http://192.0.2.2" {
+		t.Errorf("clusters should have their own client: %s", staging.client.GetRestConfig().Host)
+	}
+
+	if prod.dumpDir() != filepath.Join(localDir, ".branches", "team%2Fprod") || staging.dumpDir() != localDir {
+		t.Errorf("clusters with their own git branch should have their own working copy: %s, %s",
+			prod.dumpDir(), staging.dumpDir())
+	}
+
+	if _, err = findCluster(clusters, "dev"); err == nil {
+		t.Error("findCluster should fail on unknown clusters")
+	}
+
+	for _, invalid := range []interface{}{
+		[]interface{}{map[interface{}]interface{}{"name": "../prod"}},
+		[]interface{}{map[interface{}]interface{}{"name": "prod"}, map[interface{}]interface{}{"name": "prod"}},
+		[]interface{}{map[interface{}]interface{}{"name": "prod", "include-namespace": []interface{}{"team-["}}},
+		[]interface{}{map[interface{}]interface{}{"name": "prod", "include-kind": []interface{}{"a/b/c/d"}}},
+		[]interface{}{map[interface{}]interface{}{"name": "prod", "metadata-only": []interface{}{"apps/[v1"}}},
+		[]interface{}{map[interface{}]interface{}{"name": "prod", "git-branch": "../prod"}},
+		[]interface{}{map[interface{}]interface{}{"name": "prod", "git-branch": "-prod"}},
+		[]interface{}{map[interface{}]interface{}{"name": "prod", "exclude-label": []interface{}{"app in (foo"}}},
+		[]interface{}{map[interface{}]interface{}{"name": "prod", "exclude-annotation": []interface{}{"foo"}}},
+		[]interface{}{map[interface{}]interface{}{"name": "prod", "selectors": map[interface{}]interface{}{
+			"pod": map[interface{}]interface{}{"field": "phase"}}}},
+	} {
+		viper.Set("clusters", invalid)
+		if _, err = loadClusters(); err == nil {
+			t.Errorf("loadClusters should fail on %v", invalid)
+		}
+	}
+}
+
+func TestClusterFiles(t *testing.T) {
+	files := map[string][]byte{
+		"prod/ns1/pod-foo.yaml":    {1},
+		"prod/namespace-ns1.yaml":  {2},
+		"production/pod-bar.yaml":  {3},
+		"staging/ns1/pod-foo.yaml": {4},
+	}
+
+	selected := clusterFiles(files, "prod")
+	if len(selected) != 2 || selected["ns1/pod-foo.yaml"][0] != 1 || selected["namespace-ns1.yaml"][0] != 2 {
+		t.Errorf("clusterFiles should only return the cluster's files: %v", selected)
+	}
+}
@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/bpineau/katafygio/pkg/diff"
+	"github.com/bpineau/katafygio/pkg/log"
+	"github.com/bpineau/katafygio/pkg/store/git"
+)
+
+var (
+	diffFrom   string
+	diffTo     string
+	diffFormat string
+
+	diffCmd = &cobra.Command{
+		Use:   "diff",
+		Short: "Show changes between two backup revisions",
+		Long: "List objects added, removed and modified between two revisions of the\n" +
+			"git repository in --local-dir. Revisions are git commits, tags, or times.",
+		PreRun: bindConf,
+		RunE:   runDiff,
+	}
+)
+
+func init() {
+	diffCmd.Flags().StringVarP(&diffFrom, "from", "F", "", "Oldest revision or time. Eg. '2026-10-01T14:00Z'")
+	diffCmd.Flags().StringVarP(&diffTo, "to", "T", "HEAD", "Newest revision or time. Eg. '2026-10-01T14:30Z'")
+	diffCmd.Flags().StringVarP(&diffFormat, "format", "f", "text", "Output format: 'text' or 'json'")
+}
+
+func runDiff(cmd *cobra.Command, args []string) (err error) {
+	if diffFrom == "" {
+		return fmt.Errorf("the --from revision is mandatory")
+	}
+
+	if diffFormat != "text" && diffFormat != "json" {
+		return fmt.Errorf("unsupported output format: %s", diffFormat)
+	}
+
+	logger, err := log.New(logLevel, logServer, logOutput)
+	if err != nil {
+		return fmt.Errorf("failed to create a logger: %v", err)
+	}
+
+	repo := git.New(logger, false, localDir, "", gitTimeout)
+	repo.CLI = gitCLI
+	report := &diff.Report{}
+
+	report.From, err = repo.ResolveRevision(diffFrom)
+	if err != nil {
+		return err
+	}
+
+	report.To, err = repo.ResolveRevision(diffTo)
+	if err != nil {
+		return err
+	}
+
+	oldest, err := repo.ReadTree(report.From)
+	if err != nil {
+		return err
+	}
+
+	newest, err := repo.ReadTree(report.To)
+	if err != nil {
+		return err
+	}
+
+	report.Objects = diff.Compare(oldest, newest)
+
+	if diffFormat == "json" {
+		return report.WriteJSON(cmd.OutOrStdout())
+	}
+
+	return report.WriteText(cmd.OutOrStdout())
+}
@@ -5,19 +5,29 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sort"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/spf13/afero"
 	"github.com/spf13/cobra"
 
 	"github.com/bpineau/katafygio/pkg/client"
 	"github.com/bpineau/katafygio/pkg/controller"
+	"github.com/bpineau/katafygio/pkg/drift"
 	"github.com/bpineau/katafygio/pkg/event"
 	"github.com/bpineau/katafygio/pkg/health"
 	"github.com/bpineau/katafygio/pkg/log"
+	"github.com/bpineau/katafygio/pkg/normalize"
 	"github.com/bpineau/katafygio/pkg/observer"
 	"github.com/bpineau/katafygio/pkg/recorder"
+	"github.com/bpineau/katafygio/pkg/redact"
+	"github.com/bpineau/katafygio/pkg/sops"
+	"github.com/bpineau/katafygio/pkg/store"
 	"github.com/bpineau/katafygio/pkg/store/git"
+	"github.com/bpineau/katafygio/pkg/store/local"
+	"github.com/bpineau/katafygio/pkg/store/s3"
 )
 
 const appName = "katafygio"
@@ -46,11 +56,9 @@ func runE(cmd *cobra.Command, args []string) (err error) {
 	}
 	logger.Info(appName, " starting")
 
-	if restcfg == nil {
-		restcfg, err = client.New(apiServer, kubeConf)
-		if err != nil {
-			return fmt.Errorf("failed to create a client: %v", err)
-		}
+	clusters, err := loadClusters()
+	if err != nil {
+		return err
 	}
 
 	err = appFs.MkdirAll(filepath.Clean(localDir), 0700)
@@ -58,20 +66,141 @@ func runE(cmd *cobra.Command, args []string) (err error) {
 		return fmt.Errorf("Can't create directory %s: %v", localDir, err)
 	}
 
+	// each cluster gets its own transformers, as some keep a per object state
+	// (eg. the encryption cache), and objects names aren't unique across clusters
+	for _, cluster := range clusters {
+		if cluster.transformers, err = newTransformers(); err != nil {
+			return err
+		}
+	}
+
 	http := health.New(logger, healthP).Start()
 
-	var repo *git.Store
-	if !noGit {
-		repo, err = git.New(logger, dryRun, localDir, gitURL, gitTimeout).Start()
+	if noGit {
+		storage = "local"
 	}
-	if err != nil {
-		return fmt.Errorf("failed to start git repo handler: %v", err)
+
+	if driftMode && storage != "git" {
+		return fmt.Errorf("drift mode requires a git repository")
+	}
+
+	// clusters with their own git branch are saved from their own working
+	// copy, by their own recorder
+	var dirs []string
+	branches := make(map[string]string)
+	for _, cluster := range clusters {
+		dir := cluster.dumpDir()
+		if _, ok := branches[dir]; !ok {
+			dirs = append(dirs, dir)
+			branches[dir] = cluster.GitBranch
+		}
+		if cluster.GitBranch != "" && storage != "git" {
+			return fmt.Errorf("cluster %s: git branches require the git storage", cluster.Name)
+		}
+		if cluster.GitBranch != "" && driftMode {
+			return fmt.Errorf("cluster %s: drift mode doesn't support per-cluster git branches", cluster.Name)
+		}
+	}
+
+	// local-dir comes first: it can't be cloned to once it holds the branches
+	sort.SliceStable(dirs, func(i, j int) bool { return branches[dirs[i]] == "" && branches[dirs[j]] != "" })
+
+	var backends []store.Interface
+	var recos []interface{ Stop() }
+	var detector *drift.Detector
+	queues := make(map[string]*event.Coalescing)
+
+	for _, dir := range dirs {
+		evts := event.NewCoalescing(eventBuf)
+		queues[dir] = evts
+
+		if driftMode {
+			// the repository is only read: don't start the commit loop
+			repo := git.New(logger, false, localDir, gitURL, gitTimeout)
+			if err = setGitConf(repo); err != nil {
+				return err
+			}
+			if err = repo.CloneOrInit(); err != nil {
+				return fmt.Errorf("failed to start git repo handler: %v", err)
+			}
+			detector = drift.New(logger, evts, repo, gitURL != "", driftRep, driftIntv).Start()
+			recos = append(recos, detector)
+			continue
+		}
+
+		var backend store.Interface
+		gitCheck, recoCheck := "git", "recorder"
+		if branch := branches[dir]; branch != "" {
+			gitCheck, recoCheck = "git/"+branch, "recorder/"+branch
+		}
+
+		switch storage {
+		case "git":
+			repo := git.New(logger, dryRun, dir, gitURL, gitTimeout)
+			if err = setGitConf(repo); err != nil {
+				return err
+			}
+			if branch := branches[dir]; branch != "" {
+				repo.Branch = branch
+			} else {
+				repo.Ignore = []string{branchesDir}
+			}
+			repo.Managers = gitMngrs
+			repo.PerObject = gitPerObj
+			repo.MaxCommits = gitMaxCmts
+			http.AddReadinessCheck(gitCheck, func() error { return repo.Healthy(healthAge) })
+			backend = repo
+		case "local":
+			backend = local.New(logger, dryRun, dir)
+		case "s3":
+			backend, err = s3.New(logger, dryRun, s3URL, s3Region, s3Access, s3Secret, gitTimeout)
+		default:
+			err = fmt.Errorf("unsupported storage backend: %s", storage)
+		}
+		if err != nil {
+			return err
+		}
+
+		if err = backend.Start(); err != nil {
+			return fmt.Errorf("failed to start %s storage: %v", storage, err)
+		}
+		backends = append(backends, backend)
+
+		rec := recorder.New(logger, evts, backend, resyncInt*2, workers, dryRun).Start()
+		http.AddLivenessCheck(recoCheck, rec.Alive)
+		recos = append(recos, rec)
 	}
 
-	evts := event.New()
-	fact := controller.NewFactory(logger, filter, resyncInt, exclobj)
-	reco := recorder.New(logger, evts, localDir, resyncInt*2, dryRun).Start()
-	obsv := observer.New(logger, restcfg, evts, fact, exclkind).Start()
+	stopCh := make(chan struct{})
+	observers := make([]*observer.Observer, 0, len(clusters))
+	for _, cluster := range clusters {
+		if err = cluster.watchNamespaces(stopCh); err != nil {
+			return err
+		}
+
+		evts := queues[cluster.dumpDir()]
+		notifier, check := event.Notifier(evts), "controllers"
+		if cluster.Name != "" {
+			notifier, check = event.ForCluster(evts, cluster.Name), "controllers/"+cluster.Name
+		}
+
+		fact := controller.NewFactory(logger, controller.FactoryOptions{
+			Filter:       cluster.Filter,
+			Selectors:    cluster.selectors,
+			Resync:       time.Duration(resyncInt) * time.Second,
+			PageSize:     int64(pageSize),
+			Exclusions:   cluster.exclusions,
+			Namespaces:   cluster.namespaces,
+			SkipOwned:    skipOwned,
+			Transformers: cluster.transformers,
+		})
+		obsv := observer.New(logger, cluster.client, notifier, fact, cluster.kinds, cluster.ExcludeKind, cluster.metadata, cluster.namespaces).Start()
+		http.AddReadinessCheck(check, obsv.Synced)
+		if detector != nil {
+			detector.AddSyncCheck(obsv.Synced)
+		}
+		observers = append(observers, obsv)
+	}
 
 	logger.Info(appName, " started")
 	sigterm := make(chan os.Signal, 1)
@@ -82,17 +211,88 @@ func runE(cmd *cobra.Command, args []string) (err error) {
 	}
 
 	logger.Info(appName, " stopping")
-	obsv.Stop()
-	reco.Stop()
+	for _, obsv := range observers {
+		obsv.Stop()
+	}
+	close(stopCh)
+	for _, reco := range recos {
+		reco.Stop()
+	}
 	http.Stop()
-	if !noGit {
-		repo.Stop()
+	for _, backend := range backends {
+		backend.Stop()
 	}
 	logger.Info(appName, " stopped")
 
 	return nil
 }
 
+// newTransformers returns the objects transformers selected by the flags
+func newTransformers() ([]controller.Transformer, error) {
+	stripper, err := controller.NewStripper(stripField, keepField)
+	if err != nil {
+		return nil, err
+	}
+
+	transformers := []controller.Transformer{stripper}
+	if normObjs {
+		transformers = append(transformers, normalize.New())
+	}
+
+	if len(redactions) > 0 {
+		rules := make([]*redact.Rule, 0, len(redactions))
+		for _, r := range redactions {
+			rule, err := redact.ParseRule(r)
+			if err != nil {
+				return nil, err
+			}
+			rules = append(rules, rule)
+		}
+		transformers = append(transformers, redact.New(rules, []byte(redactKey)))
+	}
+
+	// encryption comes last: other transformers can't see through ciphertexts
+	if pgpRecip != "" {
+		keys, err := sops.ReadKeyRing(pgpRecip)
+		if err != nil {
+			return nil, err
+		}
+		enc, err := sops.NewEncrypter(keys, encKinds, encRegex)
+		if err != nil {
+			return nil, err
+		}
+		transformers = append(transformers, enc)
+	}
+
+	return transformers, nil
+}
+
+// setGitConf configures the git store branch and credentials from the git flags
+func setGitConf(repo *git.Store) error {
+	repo.Branch = gitBranch
+	repo.CLI = gitCLI
+	repo.Auth.SSHKey = gitSSHKey
+	repo.Auth.KnownHosts = gitKnownH
+	repo.Auth.CredentialHelper = gitCredHlp
+	if gitUser != "" {
+		repo.Auth.Username = gitUser
+	}
+
+	if gitToken != "" {
+		repo.Auth.Token = gitToken
+	}
+
+	if gitTokenF != "" {
+		token, err := afero.ReadFile(appFs, gitTokenF)
+		if err != nil {
+			return fmt.Errorf("failed to read git token: %v", err)
+		}
+		repo.Auth.Token = strings.TrimSpace(string(token))
+	}
+
+	return nil
+}
+
 // Execute adds all child commands to the root command and sets their flags.
 func Execute() error {
 	return RootCmd.Execute()
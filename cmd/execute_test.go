@@ -2,10 +2,17 @@ package cmd
 
 import (
 	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
 	"testing"
 
 	"github.com/spf13/afero"
+	"github.com/spf13/viper"
 	"k8s.io/client-go/rest"
+
+	"github.com/bpineau/katafygio/pkg/sops"
 )
 
 type mockClient struct{}
@@ -45,6 +52,22 @@ func TestRootCmd(t *testing.T) {
 	}
 }
 
+func TestNewTransformers(t *testing.T) {
+	pgpRecip = "../pkg/sops/testdata/key.asc"
+	defer func() { pgpRecip = "" }()
+
+	first, err := newTransformers()
+	if err != nil {
+		t.Fatalf("failed to create transformers: %v", err)
+	}
+
+	second, _ := newTransformers()
+	enc, ok := first[len(first)-1].(*sops.Encrypter)
+	if !ok || enc == second[len(second)-1] {
+		t.Error("each cluster should get its own encrypter, with its own cache")
+	}
+}
+
 func TestVersionCmd(t *testing.T) {
 	RootCmd.SetOutput(new(bytes.Buffer))
 	RootCmd.SetArgs([]string{"version"})
@@ -52,3 +75,96 @@ func TestVersionCmd(t *testing.T) {
 		t.Errorf("version subcommand shouldn't fail: %+v", err)
 	}
 }
+
+func TestRestoreCmd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "katafygio-tests")
+	if err != nil {
+		t.Fatal("failed to create a temp dir for tests")
+	}
+	defer os.RemoveAll(dir)
+
+	restcfg = new(mockClient)
+	RootCmd.SetOutput(new(bytes.Buffer))
+	RootCmd.SetArgs([]string{
+		"restore",
+		"--config",
+		"/dev/null",
+		"--local-dir",
+		dir,
+		"--log-output",
+		"test",
+		"--namespace",
+		"foo",
+	})
+
+	if err := RootCmd.Execute(); err != nil {
+		t.Errorf("restore subcommand shouldn't fail on an empty backup: %+v", err)
+	}
+
+	RootCmd.SetArgs([]string{"restore", "--config", "/dev/null", "--local-dir", dir + "/nonexistent"})
+	if err := RootCmd.Execute(); err == nil {
+		t.Error("restore subcommand should fail on a missing backup directory")
+	}
+}
+
+func TestDiffCmd(t *testing.T) {
+	RootCmd.SetOutput(new(bytes.Buffer))
+	RootCmd.SetArgs([]string{"diff", "--config", "/dev/null", "--log-output", "test"})
+	if err := RootCmd.Execute(); err == nil {
+		t.Error("diff subcommand should fail without a --from revision")
+	}
+
+	RootCmd.SetArgs([]string{"diff", "--config", "/dev/null", "--from", "HEAD~1", "--format", "xml"})
+	if err := RootCmd.Execute(); err == nil {
+		t.Error("diff subcommand should fail with an unknown output format")
+	}
+}
+
+func TestClusterBranches(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+
+	dir, err := ioutil.TempDir("", "katafygio-tests")
+	if err != nil {
+		t.Fatal("failed to create a temp dir for tests")
+	}
+	defer os.RemoveAll(dir)
+
+	viper.Set("clusters", []interface{}{
+		map[interface{}]interface{}{"name": "prod", "api-server": "http://192.0.2.1", "git-branch": "prod"},
+		map[interface{}]interface{}{"name": "staging", "api-server": "http://192.0.2.2"},
+	})
+	defer viper.Set("clusters", nil)
+
+	args := []string{
+		"--config", "/dev/null",
+		"--local-dir", dir,
+		"--dump-only",
+		"--dry-run=false",
+		"--log-output", "test",
+		"--healthcheck-port", "0",
+		"--resync-interval", "1",
+	}
+
+	RootCmd.SetOutput(new(bytes.Buffer))
+	RootCmd.SetArgs(append(args, "--no-git"))
+	if err = Execute(); err == nil || !strings.Contains(err.Error(), "git storage") {
+		t.Errorf("git branches should require the git storage: %v", err)
+	}
+
+	RootCmd.SetArgs(append(args, "--no-git=false", "--storage", "git"))
+	if err = Execute(); err != nil {
+		t.Fatalf("failed to backup clusters on several branches: %v", err)
+	}
+
+	head, err := ioutil.ReadFile(dir + "/.branches/prod/.git/HEAD")
+	if err != nil || strings.TrimSpace(string(head)) != "ref: refs/heads/prod" {
+		t.Errorf("the prod cluster should have its own working copy, on its branch: %s (%v)", head, err)
+	}
+
+	exclude, err := ioutil.ReadFile(dir + "/.git/info/exclude")
+	if err != nil || !strings.Contains(string(exclude), ".branches") {
+		t.Errorf("the branches working copies shouldn't be committed to the main one: %s (%v)", exclude, err)
+	}
+}
@@ -6,6 +6,8 @@ import (
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+
+	"github.com/bpineau/katafygio/pkg/sops"
 )
 
 var (
@@ -20,12 +22,50 @@ var (
 	filter     string
 	localDir   string
 	gitURL     string
+	gitBranch  string
 	gitTimeout time.Duration
+	gitMngrs   bool
+	gitPerObj  bool
+	gitMaxCmts int
+	gitSSHKey  string
+	gitKnownH  string
+	gitUser    string
+	gitToken   string
+	gitTokenF  string
+	gitCredHlp string
+	gitCLI     bool
 	healthP    int
+	healthAge  time.Duration
 	resyncInt  int
+	pageSize   int
+	eventBuf   int
+	workers    int
 	exclkind   []string
+	inclkind   []string
+	metaOnly   []string
 	exclobj    []string
+	exclLabel  []string
+	exclAnnot  []string
+	includeNs  []string
+	excludeNs  []string
 	noGit      bool
+	storage    string
+	s3URL      string
+	s3Region   string
+	s3Access   string
+	s3Secret   string
+	driftMode  bool
+	driftRep   string
+	driftIntv  time.Duration
+	pgpRecip   string
+	encKinds   []string
+	encRegex   string
+	redactions []string
+	redactKey  string
+	stripField []string
+	keepField  []string
+	normObjs   bool
+	skipOwned  bool
 )
 
 func bindPFlag(key string, cmd string) {
@@ -37,6 +77,8 @@ func bindPFlag(key string, cmd string) {
 func init() {
 	cobra.OnInitialize(loadConfigFile)
 	RootCmd.AddCommand(versionCmd)
+	RootCmd.AddCommand(restoreCmd)
+	RootCmd.AddCommand(diffCmd)
 
 	defaultCfg := "/etc/katafygio/" + appName + ".yaml"
 	RootCmd.PersistentFlags().StringVarP(&cfgFile, "config", "c", defaultCfg, "Configuration file")
@@ -71,26 +113,152 @@ func init() {
 	RootCmd.PersistentFlags().StringVarP(&gitURL, "git-url", "g", "", "Git repository URL")
 	bindPFlag("git-url", "git-url")
 
-	RootCmd.PersistentFlags().DurationVarP(&gitTimeout, "git-timeout", "t", 300*time.Second, "Git operations timeout")
+	RootCmd.PersistentFlags().StringVar(&gitBranch, "git-branch", "", "Git branch to commit and push to, created when missing (default: the remote's default branch)")
+	bindPFlag("git-branch", "git-branch")
+
+	RootCmd.PersistentFlags().DurationVarP(&gitTimeout, "git-timeout", "t", 300*time.Second, "Git (or S3) operations timeout")
 	bindPFlag("git-timeout", "git-timeout")
 
+	RootCmd.PersistentFlags().BoolVar(&gitMngrs, "git-managers", false, "Record the objects last managers (from metadata.managedFields) as commit trailers")
+	bindPFlag("git-managers", "git-managers")
+
+	RootCmd.PersistentFlags().BoolVar(&gitPerObj, "git-per-object", false, "Commit each object change on its own, dated with the change time")
+	bindPFlag("git-per-object", "git-per-object")
+
+	RootCmd.PersistentFlags().IntVar(&gitMaxCmts, "git-max-commits", 100, "With --git-per-object, commit at once the changes beyond that number per 10s interval (0 for no limit)")
+	bindPFlag("git-max-commits", "git-max-commits")
+
+	RootCmd.PersistentFlags().StringVar(&gitSSHKey, "git-ssh-key", "", "SSH private key file used to access the git repository")
+	bindPFlag("git-ssh-key", "git-ssh-key")
+
+	RootCmd.PersistentFlags().StringVar(&gitKnownH, "git-known-hosts", "", "SSH known_hosts file used to verify the git server (strictly checked when set)")
+	bindPFlag("git-known-hosts", "git-known-hosts")
+
+	RootCmd.PersistentFlags().StringVar(&gitUser, "git-username", "", "Username sent along the git https token (default \"x-access-token\")")
+	bindPFlag("git-username", "git-username")
+
+	RootCmd.PersistentFlags().StringVar(&gitToken, "git-token", "", "Token (or password) used to access an https git repository")
+	bindPFlag("git-token", "git-token")
+	if err := viper.BindEnv("git-token", "KATAFYGIO_GIT_TOKEN"); err != nil {
+		log.Fatal("Failed to bind cli argument:", err)
+	}
+
+	RootCmd.PersistentFlags().StringVar(&gitTokenF, "git-token-file", "", "File holding the token used to access an https git repository")
+	bindPFlag("git-token-file", "git-token-file")
+
+	RootCmd.PersistentFlags().StringVar(&gitCredHlp, "git-credential-helper", "", "Git credential helper. Eg. 'store --file=/etc/katafygio/git-credentials'")
+	bindPFlag("git-credential-helper", "git-credential-helper")
+
+	RootCmd.PersistentFlags().BoolVar(&gitCLI, "git-cli", false, "Run the git command rather than the built-in git implementation")
+	bindPFlag("git-cli", "git-cli")
+
 	RootCmd.PersistentFlags().StringSliceVarP(&exclkind, "exclude-kind", "x", nil, "Ressource kind to exclude. Eg. 'deployment'")
 	bindPFlag("exclude-kind", "exclude-kind")
 
-	RootCmd.PersistentFlags().StringSliceVarP(&exclobj, "exclude-object", "y", nil, "Object to exclude. Eg. 'configmap:kube-system/kube-dns'")
+	RootCmd.PersistentFlags().StringSliceVar(&inclkind, "include-kind", nil, "Only backup resources matching this '[group/[version/]]kind' glob. Eg. 'apps/*'")
+	bindPFlag("include-kind", "include-kind")
+
+	RootCmd.PersistentFlags().BoolVar(&skipOwned, "skip-owned", false, "Skip objects controlled by an object of a backed up kind (eg. pods generated by replicasets)")
+	bindPFlag("skip-owned", "skip-owned")
+
+	RootCmd.PersistentFlags().StringSliceVar(&metaOnly, "metadata-only", nil, "Only save the metadata (labels, annotations and owners) of resources matching this '[group/[version/]]kind' glob. Eg. 'event'")
+	bindPFlag("metadata-only", "metadata-only")
+
+	RootCmd.PersistentFlags().StringSliceVarP(&exclobj, "exclude-object", "y", nil, "Objects to exclude, as 'kind:[namespace/]name' globs or ~regexes. Eg. 'configmap:*/*-leader-elector'")
 	bindPFlag("exclude-object", "exclude-object")
 
+	RootCmd.PersistentFlags().StringSliceVar(&exclLabel, "exclude-label", nil, "Exclude objects (or namespaces' objects) matching this label selector. Eg. 'backup=false'")
+	bindPFlag("exclude-label", "exclude-label")
+
+	RootCmd.PersistentFlags().StringSliceVar(&exclAnnot, "exclude-annotation", nil, "Exclude objects (or namespaces' objects) having this 'key=value' annotation. Eg. 'example.com/backup=skip'")
+	bindPFlag("exclude-annotation", "exclude-annotation")
+
+	RootCmd.PersistentFlags().StringSliceVar(&includeNs, "include-namespace", nil, "Only backup objects from namespaces matching this glob. Eg. 'team-a-*'")
+	bindPFlag("include-namespace", "include-namespace")
+
+	RootCmd.PersistentFlags().StringSliceVar(&excludeNs, "exclude-namespace", nil, "Don't backup objects from namespaces matching this glob. Eg. 'kube-system'")
+	bindPFlag("exclude-namespace", "exclude-namespace")
+
 	RootCmd.PersistentFlags().StringVarP(&filter, "filter", "l", "", "Label filter. Select only objects matching the label.")
 	bindPFlag("filter", "filter")
 
-	RootCmd.PersistentFlags().IntVarP(&healthP, "healthcheck-port", "p", 0, "Port for answering healthchecks on /health url")
+	RootCmd.PersistentFlags().IntVarP(&healthP, "healthcheck-port", "p", 0, "Port for answering healthchecks on /health, /healthz and /readyz urls, and metrics on /metrics")
 	bindPFlag("healthcheck-port", "healthcheck-port")
 
+	RootCmd.PersistentFlags().DurationVar(&healthAge, "health-max-age", 30*time.Minute, "Readiness fails when the git repository wasn't committed and pushed for that long")
+	bindPFlag("health-max-age", "health-max-age")
+
 	RootCmd.PersistentFlags().IntVarP(&resyncInt, "resync-interval", "i", 900, "Full resync interval in seconds (0 to disable)")
 	bindPFlag("resync-interval", "resync-interval")
 
+	RootCmd.PersistentFlags().IntVar(&pageSize, "list-page-size", 0, "Paginate lists by chunks of that many objects (0 to list from the apiserver cache in one go)")
+	bindPFlag("list-page-size", "list-page-size")
+
+	RootCmd.PersistentFlags().IntVar(&eventBuf, "event-buffer", 10000, "Maximum number of distinct objects changes waiting to be recorded")
+	bindPFlag("event-buffer", "event-buffer")
+
+	RootCmd.PersistentFlags().IntVar(&workers, "recorder-workers", 4, "Number of concurrent store operations")
+	bindPFlag("recorder-workers", "recorder-workers")
+
 	RootCmd.PersistentFlags().BoolVarP(&noGit, "no-git", "n", false, "Don't version with git")
 	bindPFlag("no-git", "no-git")
+
+	RootCmd.PersistentFlags().StringVarP(&storage, "storage", "b", "git", "Storage backend: 'git', 'local' (same as --no-git), or 's3'")
+	bindPFlag("storage", "storage")
+
+	RootCmd.PersistentFlags().StringVar(&s3URL, "s3-url", "", "S3 bucket url, with an optional prefix. Eg. 'https://minio:9000/bucket/prefix'")
+	bindPFlag("s3-url", "s3-url")
+
+	RootCmd.PersistentFlags().StringVar(&s3Region, "s3-region", "us-east-1", "S3 bucket region")
+	bindPFlag("s3-region", "s3-region")
+
+	RootCmd.PersistentFlags().StringVar(&s3Access, "s3-access-key", "", "S3 access key id")
+	bindPFlag("s3-access-key", "s3-access-key")
+	if err := viper.BindEnv("s3-access-key", "AWS_ACCESS_KEY_ID"); err != nil {
+		log.Fatal("Failed to bind cli argument:", err)
+	}
+
+	RootCmd.PersistentFlags().StringVar(&s3Secret, "s3-secret-key", "", "S3 secret access key")
+	bindPFlag("s3-secret-key", "s3-secret-key")
+	if err := viper.BindEnv("s3-secret-key", "AWS_SECRET_ACCESS_KEY"); err != nil {
+		log.Fatal("Failed to bind cli argument:", err)
+	}
+
+	RootCmd.PersistentFlags().BoolVarP(&driftMode, "drift-mode", "D", false, "Drift mode: only report differences between the cluster and the git repository")
+	bindPFlag("drift-mode", "drift-mode")
+
+	RootCmd.PersistentFlags().StringVar(&driftRep, "drift-report", "", "Drift mode: file where to write the JSON drift report")
+	bindPFlag("drift-report", "drift-report")
+
+	RootCmd.PersistentFlags().DurationVar(&driftIntv, "drift-interval", 300*time.Second, "Drift mode: interval between drift checks")
+	bindPFlag("drift-interval", "drift-interval")
+
+	RootCmd.PersistentFlags().StringVar(&pgpRecip, "pgp-recipients", "", "Armored OpenPGP public keys file: encrypt objects for those recipients (sops format)")
+	bindPFlag("pgp-recipients", "pgp-recipients")
+
+	RootCmd.PersistentFlags().StringSliceVar(&encKinds, "encrypt-kind", []string{"secret"}, "Ressource kind to encrypt when --pgp-recipients is set")
+	bindPFlag("encrypt-kind", "encrypt-kind")
+
+	RootCmd.PersistentFlags().StringVar(&encRegex, "encrypt-regex", sops.DefaultRegex, "Encrypt the fields under keys matching this regex")
+	bindPFlag("encrypt-regex", "encrypt-regex")
+
+	RootCmd.PersistentFlags().StringSliceVar(&stripField, "strip-field", nil, "Field to remove, as [kind:]path. Eg. 'metadata.managedFields'")
+	bindPFlag("strip-field", "strip-field")
+
+	RootCmd.PersistentFlags().StringSliceVar(&keepField, "keep-field", nil, "Field to keep despite stripping rules, as [kind:]path. Eg. 'node:status'")
+	bindPFlag("keep-field", "keep-field")
+
+	RootCmd.PersistentFlags().BoolVar(&normObjs, "normalize", false, "Normalize objects: sort unordered lists, and drop fields set to their default value")
+	bindPFlag("normalize", "normalize")
+
+	RootCmd.PersistentFlags().StringSliceVar(&redactions, "redact", nil, "Redaction rule, as kind:path[:regex]. Eg. 'configmap:data.*:password=(\\S+)'")
+	bindPFlag("redact", "redact")
+
+	RootCmd.PersistentFlags().StringVar(&redactKey, "redact-key", "", "Secret key used to hash redacted values")
+	bindPFlag("redact-key", "redact-key")
+	if err := viper.BindEnv("redact-key", "KATAFYGIO_REDACT_KEY"); err != nil {
+		log.Fatal("Failed to bind cli argument:", err)
+	}
 }
 
 // for whatever the reason, viper don't auto bind values from config file so we have to tell him
@@ -105,10 +273,48 @@ func bindConf(cmd *cobra.Command, args []string) {
 	filter = viper.GetString("filter")
 	localDir = viper.GetString("local-dir")
 	gitURL = viper.GetString("git-url")
+	gitBranch = viper.GetString("git-branch")
 	gitTimeout = viper.GetDuration("git-timeout")
+	gitMngrs = viper.GetBool("git-managers")
+	gitPerObj = viper.GetBool("git-per-object")
+	gitMaxCmts = viper.GetInt("git-max-commits")
+	gitSSHKey = viper.GetString("git-ssh-key")
+	gitKnownH = viper.GetString("git-known-hosts")
+	gitUser = viper.GetString("git-username")
+	gitToken = viper.GetString("git-token")
+	gitTokenF = viper.GetString("git-token-file")
+	gitCredHlp = viper.GetString("git-credential-helper")
+	gitCLI = viper.GetBool("git-cli")
 	healthP = viper.GetInt("healthcheck-port")
+	healthAge = viper.GetDuration("health-max-age")
 	resyncInt = viper.GetInt("resync-interval")
+	pageSize = viper.GetInt("list-page-size")
+	eventBuf = viper.GetInt("event-buffer")
+	workers = viper.GetInt("recorder-workers")
 	exclkind = viper.GetStringSlice("exclude-kind")
+	inclkind = viper.GetStringSlice("include-kind")
+	metaOnly = viper.GetStringSlice("metadata-only")
 	exclobj = viper.GetStringSlice("exclude-object")
+	exclLabel = viper.GetStringSlice("exclude-label")
+	exclAnnot = viper.GetStringSlice("exclude-annotation")
+	includeNs = viper.GetStringSlice("include-namespace")
+	excludeNs = viper.GetStringSlice("exclude-namespace")
 	noGit = viper.GetBool("no-git")
+	storage = viper.GetString("storage")
+	s3URL = viper.GetString("s3-url")
+	s3Region = viper.GetString("s3-region")
+	s3Access = viper.GetString("s3-access-key")
+	s3Secret = viper.GetString("s3-secret-key")
+	driftMode = viper.GetBool("drift-mode")
+	driftRep = viper.GetString("drift-report")
+	driftIntv = viper.GetDuration("drift-interval")
+	pgpRecip = viper.GetString("pgp-recipients")
+	encKinds = viper.GetStringSlice("encrypt-kind")
+	encRegex = viper.GetString("encrypt-regex")
+	stripField = viper.GetStringSlice("strip-field")
+	keepField = viper.GetStringSlice("keep-field")
+	normObjs = viper.GetBool("normalize")
+	skipOwned = viper.GetBool("skip-owned")
+	redactions = viper.GetStringSlice("redact")
+	redactKey = viper.GetString("redact-key")
 }
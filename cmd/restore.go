@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/bpineau/katafygio/pkg/log"
+	"github.com/bpineau/katafygio/pkg/restore"
+	"github.com/bpineau/katafygio/pkg/sops"
+	"github.com/bpineau/katafygio/pkg/store/git"
+)
+
+var (
+	restoreNamespaces []string
+	restoreKinds      []string
+	restoreRevision   string
+	restoreKeyring    string
+	restoreCluster    string
+
+	restoreCmd = &cobra.Command{
+		Use:   "restore",
+		Short: "Restore the backup to the cluster",
+		Long: "Server-side apply the yaml files saved in --local-dir to the cluster.\n" +
+			"Namespaces and CRDs are restored before namespaced objects and custom resources.\n" +
+			"--revision restores the objects as committed at a given git commit, tag, or time.\n" +
+			"--pgp-keyring decrypts encrypted objects; protected keys are unlocked with the\n" +
+			"KATAFYGIO_PGP_PASSPHRASE environment variable.\n" +
+			"--cluster selects the cluster to restore, when several clusters are configured.",
+		PreRun: bindConf,
+		RunE:   runRestore,
+	}
+)
+
+func init() {
+	restoreCmd.Flags().StringSliceVarP(&restoreNamespaces, "namespace", "N", nil, "Only restore objects from this namespace")
+	restoreCmd.Flags().StringSliceVarP(&restoreKinds, "kind", "K", nil, "Only restore objects of this kind. Eg. 'deployment'")
+	restoreCmd.Flags().StringVar(&restoreKeyring, "pgp-keyring", "", "Armored OpenPGP private keys file, to decrypt encrypted objects")
+	restoreCmd.Flags().StringVar(&restoreCluster, "cluster", "", "Restore this cluster's objects, when several clusters are configured")
+	restoreCmd.Flags().StringVarP(&restoreRevision, "revision", "R", "", "Restore from a git revision or time. Eg. 'v1.2', '2026-10-01T12:00Z'")
+}
+
+func runRestore(cmd *cobra.Command, args []string) (err error) {
+	logger, err := log.New(logLevel, logServer, logOutput)
+	if err != nil {
+		return fmt.Errorf("failed to create a logger: %v", err)
+	}
+
+	clusters, err := loadClusters()
+	if err != nil {
+		return err
+	}
+
+	cluster := clusters[0]
+	if restoreCluster != "" {
+		if cluster, err = findCluster(clusters, restoreCluster); err != nil {
+			return err
+		}
+	} else if cluster.Name != "" {
+		return fmt.Errorf("several clusters are configured: select one with --cluster")
+	}
+
+	var files map[string][]byte
+	if restoreRevision == "" {
+		files, err = restore.ReadDir(cluster.dumpDir())
+	} else {
+		repo := git.New(logger, false, cluster.dumpDir(), "", gitTimeout)
+		repo.CLI = gitCLI
+		files, err = repo.ReadTree(restoreRevision)
+	}
+	if err != nil {
+		return err
+	}
+
+	if cluster.Name != "" {
+		files = clusterFiles(files, cluster.Name)
+	}
+
+	var dec restore.Decrypter
+	if restoreKeyring != "" {
+		keys, err := sops.ReadKeyRing(restoreKeyring)
+		if err != nil {
+			return err
+		}
+		if dec, err = sops.NewDecrypter(keys, []byte(os.Getenv("KATAFYGIO_PGP_PASSPHRASE"))); err != nil {
+			return err
+		}
+	}
+
+	results := restore.New(logger, cluster.client, dec, dryRun, restoreNamespaces, restoreKinds).Restore(files)
+
+	failed := 0
+	for _, res := range results {
+		if res.Err != nil {
+			failed++
+			cmd.Printf("%-8s %s: %v\n", res.Action, res, res.Err)
+			continue
+		}
+		cmd.Printf("%-8s %s\n", res.Action, res)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to restore %d out of %d objects", failed, len(results))
+	}
+
+	return nil
+}
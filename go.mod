@@ -8,8 +8,19 @@ require (
 	github.com/spf13/afero v1.2.2
 	github.com/spf13/cobra v0.0.5
 	github.com/spf13/viper v1.4.0
+	golang.org/x/crypto v0.0.0-20190701094942-4def268fd1a4
+	gopkg.in/src-d/go-git.v4 v4.13.1
 	k8s.io/api v0.0.0-20190620084959-7cf5895f2711
 	k8s.io/apimachinery v0.0.0-20190612205821-1799e75a0719
 	k8s.io/client-go v0.0.0-20190620085101-78d2af792bab
 	k8s.io/klog v0.3.1
 )
+
+// keep the golang.org/x versions client-go was built and tested with
+replace (
+	github.com/stretchr/testify => github.com/stretchr/testify v1.2.2
+	golang.org/x/crypto => golang.org/x/crypto v0.0.0-20190308221718-c2843e01d9a2
+	golang.org/x/net => golang.org/x/net v0.0.0-20190522155817-f3200d17e092
+	golang.org/x/sys => golang.org/x/sys v0.0.0-20190422165155-953cdadca894
+	golang.org/x/text => golang.org/x/text v0.3.1-0.20181227161524-e6919f6577db
+)
@@ -8,6 +8,7 @@ import (
 
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 	"k8s.io/client-go/util/homedir"
 
 	// Ensure we have auth plugins (gcp, azure, openstack, ...) linked in
@@ -24,9 +25,10 @@ type RestClient struct {
 	cfg *rest.Config
 }
 
-// New create a new RestClient
-func New(apiserver, kubeconfig string) (*RestClient, error) {
-	cfg, err := newRestConfig(apiserver, kubeconfig)
+// New create a new RestClient. kubecontext is optional, and defaults to the
+// kubeconfig's current context.
+func New(apiserver, kubeconfig, kubecontext string) (*RestClient, error) {
+	cfg, err := newRestConfig(apiserver, kubeconfig, kubecontext)
 	if err != nil {
 		return nil, fmt.Errorf("failed to build a restconfig: %v", err)
 	}
@@ -47,7 +49,7 @@ func (r *RestClient) GetRestConfig() *rest.Config {
 // - Else, use the config file in ~/.kube/config, if any
 // - Else, consider we're running in cluster (in a pod), and use the pod's service
 //   account and cluster's kubernetes.default service.
-func newRestConfig(apiserver string, kubeconfig string) (*rest.Config, error) {
+func newRestConfig(apiserver, kubeconfig, kubecontext string) (*rest.Config, error) {
 	// if not passed as an argument, kubeconfig can be provided as env var
 	if kubeconfig == "" {
 		kubeconfig = os.Getenv("KUBECONFIG")
@@ -61,6 +63,15 @@ func newRestConfig(apiserver string, kubeconfig string) (*rest.Config, error) {
 		kubeconfig = homeCfg
 	}
 
+	if kubecontext != "" {
+		return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+			&clientcmd.ClientConfigLoadingRules{ExplicitPath: kubeconfig},
+			&clientcmd.ConfigOverrides{
+				ClusterInfo:    clientcmdapi.Cluster{Server: apiserver},
+				CurrentContext: kubecontext,
+			}).ClientConfig()
+	}
+
 	// if we were provided or found a kubeconfig,
 	// or if we were provided an api-server url, use that
 	if apiserver != "" || kubeconfig != "" {
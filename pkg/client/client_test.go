@@ -11,7 +11,7 @@ const nonExistentPath = "\\/non / existent / $path$"
 func TestClientSet(t *testing.T) {
 	here, _ := os.Getwd()
 	_ = os.Setenv("HOME", here+"/../../assets")
-	cs, err := New("", "")
+	cs, err := New("", "", "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -19,12 +19,22 @@ func TestClientSet(t *testing.T) {
 		t.Errorf("GetRestConfig() didn't return a *rest.Config: %T", cs)
 	}
 
-	cs, _ = New("http://127.0.0.1", "/dev/null")
+	cs, _ = New("http://127.0.0.1", "/dev/null", "")
 	if fmt.Sprintf("%T", cs.GetRestConfig()) != "*rest.Config" {
 		t.Errorf("New(server) didn't return a *rest.Config: %T", cs)
 	}
 
-	_, err = New("http://127.0.0.1", nonExistentPath)
+	cs, err = New("", "", "test-fake-server")
+	if err != nil || cs.GetRestConfig().Host != "http://127.0.0.1:8080" {
+		t.Errorf("New(context) should use the context's cluster: %v", err)
+	}
+
+	_, err = New("", "", "nonexistent-context")
+	if err == nil {
+		t.Error("New() should fail on non existent contexts")
+	}
+
+	_, err = New("http://127.0.0.1", nonExistentPath, "")
 	if err == nil {
 		t.Fatal("New() should fail on non existent kubeconfig path")
 	}
@@ -32,7 +42,7 @@ func TestClientSet(t *testing.T) {
 	_ = os.Unsetenv("KUBERNETES_SERVICE_HOST")
 	_ = os.Setenv("HOME", nonExistentPath)
 	_ = os.Setenv("KUBECONFIG", nonExistentPath)
-	_, err = New("", "")
+	_, err = New("", "", "")
 	if err == nil {
 		t.Fatal("New() should fail to load InClusterConfig without kube address env")
 	}
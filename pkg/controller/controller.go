@@ -8,9 +8,11 @@ package controller
 import (
 	"fmt"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/bpineau/katafygio/pkg/event"
+	"github.com/bpineau/katafygio/pkg/metrics"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
@@ -27,13 +29,31 @@ import (
 var (
 	maxProcessRetry = 6
 	canaryKey       = "$katafygio canary$"
-	unexported      = []string{"selfLink", "uid", "resourceVersion", "generation"}
+
+	objectsGauge = metrics.NewGauge("katafygio_objects",
+		"Number of objects in the cluster, by kind.", "kind")
+	retriesCounter = metrics.NewCounter("katafygio_controller_retries_total",
+		"Number of objects processing failures that will be retried, by kind.", "kind")
+	giveupsCounter = metrics.NewCounter("katafygio_controller_giveups_total",
+		"Number of objects we gave up processing after too many failures, by kind.", "kind")
 )
 
 // Interface describe a standard kubernetes controller
 type Interface interface {
 	Start()
 	Stop()
+	Synced() bool
+}
+
+// Transformer alters objects before they're dumped (eg. to strip or encrypt some fields)
+type Transformer interface {
+	Transform(obj *unstructured.Unstructured) error
+}
+
+// Forgetter may be implemented by Transformers keeping a state about the
+// objects they saw (eg. a cache), to release it when an object is deleted.
+type Forgetter interface {
+	Forget(kind, key string)
 }
 
 type logger interface {
@@ -43,24 +63,33 @@ type logger interface {
 
 // Factory generate controllers
 type Factory struct {
-	logger     logger
-	filter     string
-	resyncIntv time.Duration
-	excluded   []string
+	logger       logger
+	filter       string
+	selectors    map[string]Selector
+	resyncIntv   time.Duration
+	pageSize     int64
+	exclusions   *Exclusions
+	namespaces   *NamespaceFilter
+	owners       *Owners
+	transformers []Transformer
 }
 
 // Controller is a generic kubernetes controller
 type Controller struct {
-	name       string
-	stopCh     chan struct{}
-	doneCh     chan struct{}
-	syncCh     chan struct{}
-	notifier   event.Notifier
-	queue      workqueue.RateLimitingInterface
-	informer   cache.SharedIndexInformer
-	logger     logger
-	resyncIntv time.Duration
-	excluded   []string
+	name         string
+	stopCh       chan struct{}
+	doneCh       chan struct{}
+	syncCh       chan struct{}
+	synced       int32
+	notifier     event.Notifier
+	queue        workqueue.RateLimitingInterface
+	informer     cache.SharedIndexInformer
+	logger       logger
+	resyncIntv   time.Duration
+	exclusions   *Exclusions
+	namespaces   *NamespaceFilter
+	owners       *Owners
+	transformers []Transformer
 }
 
 // New return a kubernetes controller using the provided client
@@ -68,18 +97,21 @@ func New(client cache.ListerWatcher,
 	notifier event.Notifier,
 	log logger,
 	name string,
-	filter string,
+	selector Selector,
 	resync time.Duration,
-	excluded []string,
+	pageSize int64,
+	exclusions *Exclusions,
+	namespaces *NamespaceFilter,
+	owners *Owners,
+	transformers []Transformer,
 ) *Controller {
 
-	selector := metav1.ListOptions{LabelSelector: filter, ResourceVersion: "0"}
 	lw := &cache.ListWatch{
 		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
-			return client.List(selector)
+			return client.List(listOptions(options, selector, pageSize))
 		},
 		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
-			return client.Watch(selector)
+			return client.Watch(watchOptions(options, selector))
 		},
 	}
 
@@ -94,6 +126,7 @@ func New(client cache.ListerWatcher,
 
 	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
+			objectsGauge.Add(1, name)
 			key, err := cache.MetaNamespaceKeyFunc(obj)
 			if err == nil {
 				queue.Add(key)
@@ -106,6 +139,7 @@ func New(client cache.ListerWatcher,
 			}
 		},
 		DeleteFunc: func(obj interface{}) {
+			objectsGauge.Add(-1, name)
 			key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
 			if err == nil {
 				queue.Add(key)
@@ -114,17 +148,50 @@ func New(client cache.ListerWatcher,
 	})
 
 	return &Controller{
-		stopCh:     make(chan struct{}),
-		doneCh:     make(chan struct{}),
-		syncCh:     make(chan struct{}, 1),
-		notifier:   notifier,
-		name:       name,
-		queue:      queue,
-		informer:   informer,
-		logger:     log,
-		resyncIntv: resync,
-		excluded:   excluded,
+		stopCh:       make(chan struct{}),
+		doneCh:       make(chan struct{}),
+		syncCh:       make(chan struct{}, 1),
+		notifier:     notifier,
+		name:         name,
+		queue:        queue,
+		informer:     informer,
+		logger:       log,
+		resyncIntv:   resync,
+		exclusions:   exclusions,
+		namespaces:   namespaces,
+		owners:       owners,
+		transformers: transformers,
+	}
+}
+
+// listOptions merges our selectors into the informer's list options. With
+// a pageSize, paginated lists are served by the apiserver in chunks of that
+// size (rather than in one go from its watch cache), to lower the memory
+// pressure on both ends when listing huge kinds.
+func listOptions(options metav1.ListOptions, selector Selector, pageSize int64) metav1.ListOptions {
+	options.LabelSelector = joinSelectors(options.LabelSelector, selector.Label)
+	options.FieldSelector = joinSelectors(options.FieldSelector, selector.Field)
+
+	// a zero Limit means the pager fell back to a full list (eg. after an
+	// expired continue token): we must not paginate it
+	if pageSize > 0 && options.Limit > 0 {
+		options.Limit = pageSize
+		if options.ResourceVersion == "0" {
+			options.ResourceVersion = ""
+		}
 	}
+
+	return options
+}
+
+// watchOptions merges our selectors into the informer's watch options, which
+// resume from the last seen resource version. Bookmarks keep that version
+// current on quiet kinds, sparing full relists when watches are restarted.
+func watchOptions(options metav1.ListOptions, selector Selector) metav1.ListOptions {
+	options.LabelSelector = joinSelectors(options.LabelSelector, selector.Label)
+	options.FieldSelector = joinSelectors(options.FieldSelector, selector.Field)
+	options.AllowWatchBookmarks = true
+	return options
 }
 
 // Start launchs the controller in the background
@@ -134,7 +201,7 @@ func (c *Controller) Start() {
 
 	go c.informer.Run(c.stopCh)
 
-	if !cache.WaitForCacheSync(c.stopCh, c.informer.HasSynced) {
+	if !cache.WaitForCacheSync(c.stopCh, c.informer.HasSynced, c.exclusions.HasSynced) {
 		utilruntime.HandleError(fmt.Errorf("Timed out waiting for cache sync"))
 		return
 	}
@@ -153,6 +220,11 @@ func (c *Controller) Stop() {
 	<-c.doneCh
 }
 
+// Synced tells if the controller completed its initial sync
+func (c *Controller) Synced() bool {
+	return atomic.LoadInt32(&c.synced) == 1
+}
+
 func (c *Controller) runWorker() {
 	defer close(c.doneCh)
 	for c.processNextItem() {
@@ -169,6 +241,7 @@ func (c *Controller) processNextItem() bool {
 
 	if strings.Compare(key.(string), canaryKey) == 0 {
 		c.logger.Infof("Initial sync completed for %s controller", c.name)
+		atomic.StoreInt32(&c.synced, 1)
 		c.syncCh <- struct{}{}
 		c.queue.Forget(key)
 		return true
@@ -181,10 +254,12 @@ func (c *Controller) processNextItem() bool {
 		c.queue.Forget(key)
 	} else if c.queue.NumRequeues(key) < maxProcessRetry {
 		c.logger.Errorf("Error processing %s (will retry): %v", key, err)
+		retriesCounter.Inc(c.name)
 		c.queue.AddRateLimited(key)
 	} else {
 		// err != nil and too many retries
 		c.logger.Errorf("Error processing %s (giving up): %v", key, err)
+		giveupsCounter.Inc(c.name)
 		c.queue.Forget(key)
 	}
 
@@ -198,10 +273,8 @@ func (c *Controller) processItem(key string) error {
 		return fmt.Errorf("error fetching %s from store: %v", key, err)
 	}
 
-	for _, obj := range c.excluded {
-		if strings.Compare(strings.ToLower(obj), strings.ToLower(c.name+":"+key)) == 0 {
-			return nil
-		}
+	if c.exclusions.Matches(c.name, key) || !c.selected(key) {
+		return nil
 	}
 
 	if !exists {
@@ -210,14 +283,24 @@ func (c *Controller) processItem(key string) error {
 		return nil
 	}
 
+	if c.exclusions.Marked(rawobj.(*unstructured.Unstructured)) {
+		// the object may have been saved before it was marked
+		c.enqueue(&event.Notification{Action: event.Delete, Key: key, Kind: c.name, Object: nil})
+		return nil
+	}
+
+	if c.owners.Controlled(rawobj.(*unstructured.Unstructured)) {
+		// the object may have been saved before its owner's kind was watched
+		c.enqueue(&event.Notification{Action: event.Delete, Key: key, Kind: c.name, Object: nil})
+		return nil
+	}
+
 	obj := rawobj.(*unstructured.Unstructured).DeepCopy()
 
-	// clear irrelevant attributes
-	uc := obj.UnstructuredContent()
-	delete(uc, "status")
-	md := uc["metadata"].(map[string]interface{})
-	for _, attr := range unexported {
-		delete(md, attr)
+	for _, tr := range c.transformers {
+		if err := tr.Transform(obj); err != nil {
+			return fmt.Errorf("failed to transform %s: %v", key, err)
+		}
 	}
 
 	yml, err := yaml.Marshal(obj)
@@ -229,21 +312,83 @@ func (c *Controller) processItem(key string) error {
 	return nil
 }
 
+// selected tells if an object belongs to a selected namespace. Namespaces
+// objects are selected by their own name.
+func (c *Controller) selected(key string) bool {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return true
+	}
+
+	if namespace == "" && c.name == "namespace" {
+		return c.namespaces.Match(name)
+	}
+
+	return namespace == "" || c.namespaces.Match(namespace)
+}
+
 func (c *Controller) enqueue(notif *event.Notification) {
+	if notif.Action == event.Delete {
+		for _, tr := range c.transformers {
+			if f, ok := tr.(Forgetter); ok {
+				f.Forget(c.name, notif.Key)
+			}
+		}
+	}
+
+	notif.Time = time.Now()
 	c.notifier.Send(notif)
 }
 
+// FactoryOptions configures the controllers created by a Factory
+type FactoryOptions struct {
+	// Filter is a label selector applying to all kinds, combined with
+	// the per-kind Selectors (indexed by lowercase kind name).
+	Filter    string
+	Selectors map[string]Selector
+
+	// Resync is the full resync interval (0 disables resyncs)
+	Resync time.Duration
+
+	// PageSize, when not zero, paginates the initial lists and relists
+	PageSize int64
+
+	Exclusions *Exclusions
+	Namespaces *NamespaceFilter
+
+	// SkipOwned skips the objects owned by (having a controller reference
+	// to) an object of a kind being backed up, eg. Pods generated by
+	// ReplicaSets when ReplicaSets are backed up.
+	SkipOwned bool
+
+	// Transformers are applied, in order, to the objects before they're
+	// notified.
+	Transformers []Transformer
+}
+
 // NewFactory create a controller factory
-func NewFactory(logger logger, filter string, resync int, excluded []string) *Factory {
+func NewFactory(logger logger, opts FactoryOptions) *Factory {
+	var owners *Owners
+	if opts.SkipOwned {
+		owners = NewOwners()
+	}
+
 	return &Factory{
-		logger:     logger,
-		filter:     filter,
-		resyncIntv: time.Duration(resync) * time.Second,
-		excluded:   excluded,
+		logger:       logger,
+		filter:       opts.Filter,
+		selectors:    opts.Selectors,
+		resyncIntv:   opts.Resync,
+		pageSize:     opts.PageSize,
+		exclusions:   opts.Exclusions,
+		namespaces:   opts.Namespaces,
+		owners:       owners,
+		transformers: opts.Transformers,
 	}
 }
 
 // NewController create a controller.Controller
 func (f *Factory) NewController(client cache.ListerWatcher, notifier event.Notifier, name string) Interface {
-	return New(client, notifier, f.logger, name, f.filter, f.resyncIntv, f.excluded)
+	f.owners.Add(name)
+	selector := Selector{Label: f.filter}.And(f.selectors[name])
+	return New(client, notifier, f.logger, name, selector, f.resyncIntv, f.pageSize, f.exclusions, f.namespaces, f.owners, f.transformers)
 }
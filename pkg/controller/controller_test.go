@@ -30,6 +30,19 @@ type mockLog struct{}
 func (m *mockLog) Infof(format string, args ...interface{})  {}
 func (m *mockLog) Errorf(format string, args ...interface{}) {}
 
+type mockTransformer struct {
+	forgotten []string
+}
+
+func (m *mockTransformer) Transform(obj *unstructured.Unstructured) error {
+	obj.SetLabels(map[string]string{"transformed": "yes"})
+	return nil
+}
+
+func (m *mockTransformer) Forget(kind, key string) {
+	m.forgotten = append(m.forgotten, kind+":"+key)
+}
+
 var (
 	obj1 = &unstructured.Unstructured{
 		Object: map[string]interface{}{
@@ -121,7 +134,12 @@ func TestController(t *testing.T) {
 
 	evt := new(mockNotifier)
 	log := new(mockLog)
-	f := NewFactory(log, "label1=something", 60, []string{"pod:ns3/Bar3"})
+	stripper, _ := NewStripper(nil, nil)
+	namespaces, _ := NewNamespaceFilter(nil, []string{"kube-*"})
+	exclusions, _ := NewExclusions([]string{"pod:ns3/Bar3"}, nil, nil)
+	transformer := new(mockTransformer)
+	f := NewFactory(log, FactoryOptions{Filter: "label1=something", Resync: time.Minute,
+		Exclusions: exclusions, Namespaces: namespaces, Transformers: []Transformer{stripper, transformer}})
 	ctrl := f.NewController(client, evt, "pod")
 
 	// this will trigger a deletion event
@@ -143,6 +161,10 @@ func TestController(t *testing.T) {
 	}
 	ctrl.Stop()
 
+	if !ctrl.Synced() {
+		t.Error("controller should be synced once the queue is drained")
+	}
+
 	gotFoo2 := false
 	for _, ev := range evt.evts {
 		// ensure cleanup filters works as expected
@@ -157,6 +179,9 @@ func TestController(t *testing.T) {
 
 		if strings.Compare(ev.Key, "ns2/Bar2") == 0 {
 			gotFoo2 = true
+			if !strings.Contains(string(ev.Object), "transformed: \"yes\"") {
+				t.Errorf("transformers weren't applied: %s", ev.Object)
+			}
 		}
 
 		// ensure objet filter works as expected
@@ -173,4 +198,8 @@ func TestController(t *testing.T) {
 	if !gotFoo2 {
 		t.Errorf("we should have notified obj2")
 	}
+
+	if len(transformer.forgotten) != 1 || transformer.forgotten[0] != "pod:ns1/Bar1" {
+		t.Errorf("transformers should forget deleted objects: %v", transformer.forgotten)
+	}
 }
@@ -0,0 +1,227 @@
+package controller
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+)
+
+// ExcludeMarker is a label or annotation excluding objects from the backup,
+// when set to "true". On namespaces, it excludes all their objects.
+const ExcludeMarker = "katafygio.io/exclude"
+
+// matcher matches a part of an object pattern
+type matcher func(string) bool
+
+// newMatcher returns a matcher for a glob, or for an anchored regex when
+// the part starts with "~". Matches are case insensitive.
+func newMatcher(part string) (matcher, error) {
+	if strings.HasPrefix(part, "~") {
+		re, err := regexp.Compile("(?i)^(?:" + part[1:] + ")$")
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString, nil
+	}
+
+	part = strings.ToLower(part)
+	if _, err := path.Match(part, ""); err != nil {
+		return nil, err
+	}
+
+	return func(s string) bool {
+		ok, _ := path.Match(part, strings.ToLower(s))
+		return ok
+	}, nil
+}
+
+// objectPattern selects objects by kind, namespace and name
+type objectPattern struct {
+	kind       matcher
+	namespace  matcher // nil for cluster scoped objects
+	name       matcher
+	namespaced bool
+}
+
+// parseObjectPattern parses a "kind:namespace/name" (or "kind:name", for
+// cluster scoped objects) pattern, where each part is a glob or a "~regex".
+func parseObjectPattern(pattern string) (*objectPattern, error) {
+	parts := strings.SplitN(pattern, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid object pattern %s: expecting kind:[namespace/]name", pattern)
+	}
+
+	p := new(objectPattern)
+	kind, name := parts[0], parts[1]
+
+	var namespace string
+	if i := strings.Index(name, "/"); i >= 0 {
+		namespace, name, p.namespaced = name[:i], name[i+1:], true
+	}
+
+	var err error
+	if p.kind, err = newMatcher(kind); err != nil {
+		return nil, fmt.Errorf("invalid object pattern %s: %v", pattern, err)
+	}
+	if p.name, err = newMatcher(name); err != nil {
+		return nil, fmt.Errorf("invalid object pattern %s: %v", pattern, err)
+	}
+	if p.namespaced {
+		if p.namespace, err = newMatcher(namespace); err != nil {
+			return nil, fmt.Errorf("invalid object pattern %s: %v", pattern, err)
+		}
+	}
+
+	return p, nil
+}
+
+func (p *objectPattern) match(kind, namespace, name string) bool {
+	if p.namespaced != (namespace != "") || !p.kind(kind) || !p.name(name) {
+		return false
+	}
+	return !p.namespaced || p.namespace(namespace)
+}
+
+// NamespaceLookup returns namespaces objects, by name
+type NamespaceLookup interface {
+	GetByKey(key string) (item interface{}, exists bool, err error)
+}
+
+// annotationRule matches objects having an annotation set to a value
+type annotationRule struct {
+	key   string
+	value string
+}
+
+// Exclusions selects the objects that shouldn't be saved: matching an
+// exclusion pattern, or marked with the ExcludeMarker label or annotation,
+// with labels matching an exclusion selector, or with an exclusion annotation
+// (or belonging to a namespace marked so). A nil Exclusions excludes nothing.
+type Exclusions struct {
+	patterns    []*objectPattern
+	selectors   []labels.Selector
+	annotations []annotationRule
+	namespaces  NamespaceLookup
+	synced      cache.InformerSynced
+}
+
+// NewExclusions returns an Exclusions for "kind:[namespace/]name" patterns
+// (eg. "configmap:kube-system/*-leader-elector", or "secret:*/~.*-token-[a-z0-9]{5}"),
+// labels selectors (eg. "backup=false") and "key=value" annotations.
+func NewExclusions(patterns, selectors, annotations []string) (*Exclusions, error) {
+	e := new(Exclusions)
+
+	for _, pattern := range patterns {
+		p, err := parseObjectPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		e.patterns = append(e.patterns, p)
+	}
+
+	for _, selector := range selectors {
+		if strings.TrimSpace(selector) == "" {
+			return nil, fmt.Errorf("empty exclusion label selector")
+		}
+		sel, err := labels.Parse(selector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exclusion label selector %s: %v", selector, err)
+		}
+		e.selectors = append(e.selectors, sel)
+	}
+
+	for _, annotation := range annotations {
+		parts := strings.SplitN(annotation, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid exclusion annotation %s: expecting key=value", annotation)
+		}
+		e.annotations = append(e.annotations, annotationRule{key: parts[0], value: parts[1]})
+	}
+
+	return e, nil
+}
+
+// WatchNamespaces maintains a cache of the namespaces, to honor the
+// namespaces exclusion markers, until stopCh is closed.
+func (e *Exclusions) WatchNamespaces(lw cache.ListerWatcher, stopCh <-chan struct{}) {
+	informer := cache.NewSharedIndexInformer(lw, &unstructured.Unstructured{}, 10*time.Minute, cache.Indexers{})
+	e.namespaces = informer.GetIndexer()
+	e.synced = informer.HasSynced
+	go informer.Run(stopCh)
+}
+
+// HasSynced tells if the namespaces cache (if any) completed its initial sync
+func (e *Exclusions) HasSynced() bool {
+	return e == nil || e.synced == nil || e.synced()
+}
+
+// Matches tells if an object, given by its kind and store key, matches an
+// exclusion pattern.
+func (e *Exclusions) Matches(kind, key string) bool {
+	if e == nil {
+		return false
+	}
+
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return false
+	}
+
+	for _, p := range e.patterns {
+		if p.match(kind, namespace, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Marked tells if an object, or its namespace, is marked for exclusion
+func (e *Exclusions) Marked(obj *unstructured.Unstructured) bool {
+	if e == nil {
+		return false
+	}
+
+	if e.marked(obj) {
+		return true
+	}
+
+	if obj.GetNamespace() == "" || e.namespaces == nil {
+		return false
+	}
+
+	ns, exists, err := e.namespaces.GetByKey(obj.GetNamespace())
+	if err != nil || !exists {
+		return false
+	}
+
+	nsobj, ok := ns.(*unstructured.Unstructured)
+	return ok && e.marked(nsobj)
+}
+
+func (e *Exclusions) marked(obj *unstructured.Unstructured) bool {
+	objLabels, objAnnotations := obj.GetLabels(), obj.GetAnnotations()
+	if objLabels[ExcludeMarker] == "true" || objAnnotations[ExcludeMarker] == "true" {
+		return true
+	}
+
+	for _, sel := range e.selectors {
+		if sel.Matches(labels.Set(objLabels)) {
+			return true
+		}
+	}
+
+	for _, rule := range e.annotations {
+		if value, ok := objAnnotations[rule.key]; ok && value == rule.value {
+			return true
+		}
+	}
+
+	return false
+}
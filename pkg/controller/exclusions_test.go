@@ -0,0 +1,159 @@
+package controller
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/cache"
+	fakecontroller "k8s.io/client-go/tools/cache/testing"
+
+	"github.com/bpineau/katafygio/pkg/event"
+)
+
+func newObj(kind, namespace, name string, annotations map[string]string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{"apiVersion": "v1", "kind": kind}}
+	obj.SetNamespace(namespace)
+	obj.SetName(name)
+	obj.SetAnnotations(annotations)
+	return obj
+}
+
+func TestExclusionsPatterns(t *testing.T) {
+	for _, invalid := range []string{"configmap", ":foo/bar", "pod:", "pod:[a/b", "secret:*/~(foo"} {
+		if _, err := NewExclusions([]string{invalid}, nil, nil); err == nil {
+			t.Errorf("NewExclusions should fail on %s", invalid)
+		}
+	}
+
+	var none *Exclusions
+	if none.Matches("pod", "ns/foo") || none.Marked(newObj("Pod", "ns", "foo", nil)) {
+		t.Error("nil Exclusions shouldn't exclude anything")
+	}
+
+	e, err := NewExclusions([]string{
+		"configmap:kube-system/kube-dns",
+		"configmap:*/*-leader-elector",
+		"secret:*/~.*-token-[a-z0-9]{5}",
+		"node:worker-*",
+	}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, expected := range map[string]bool{
+		"configmap:kube-system/kube-dns":         true,
+		"configmap:kube-system/Kube-DNS":         true,
+		"configmap:default/kube-dns":             false,
+		"configmap:team-a/app-leader-elector":    true,
+		"secret:default/builder-token-x7k2p":     true,
+		"secret:default/builder-token-x7k2p-old": false,
+		"node:worker-1":                          true,
+		"node:master-1":                          false,
+		"pod:default/worker-1":                   false,
+	} {
+		parts := strings.SplitN(key, ":", 2)
+		if e.Matches(parts[0], parts[1]) != expected {
+			t.Errorf("Matches(%s) should be %v", key, expected)
+		}
+	}
+}
+
+func TestExclusionsMarkers(t *testing.T) {
+	source := fakecontroller.NewFakeControllerSource()
+	source.Add(newObj("Namespace", "", "excluded", map[string]string{ExcludeMarker: "true"}))
+	source.Add(newObj("Namespace", "", "included", nil))
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	e, _ := NewExclusions(nil, nil, nil)
+	e.WatchNamespaces(source, stopCh)
+	cache.WaitForCacheSync(stopCh, e.HasSynced)
+
+	for obj, expected := range map[*unstructured.Unstructured]bool{
+		newObj("Pod", "included", "foo", nil):                                         false,
+		newObj("Pod", "included", "foo", map[string]string{ExcludeMarker: "1"}):       false,
+		newObj("Pod", "included", "foo", map[string]string{ExcludeMarker: "true"}):    true,
+		newObj("Pod", "excluded", "foo", nil):                                         true,
+		newObj("Pod", "unknown", "foo", nil):                                          false,
+		newObj("Namespace", "", "excluded", map[string]string{ExcludeMarker: "true"}): true,
+	} {
+		if e.Marked(obj) != expected {
+			t.Errorf("Marked(%s/%s %v) should be %v", obj.GetNamespace(), obj.GetName(), obj.GetAnnotations(), expected)
+		}
+	}
+
+	labelled := newObj("Pod", "included", "bar", nil)
+	labelled.SetLabels(map[string]string{ExcludeMarker: "true"})
+	if !e.Marked(labelled) {
+		t.Error("objects should be excluded by label too")
+	}
+
+	// marked objects that were already saved should be removed
+	evt := new(mockNotifier)
+	f := NewFactory(new(mockLog), FactoryOptions{Resync: time.Minute, Exclusions: e})
+	ctrl := f.NewController(fakecontroller.NewFakeControllerSource(), evt, "pod").(*Controller)
+	_ = ctrl.informer.GetIndexer().Add(newObj("Pod", "excluded", "foo", nil))
+	if err := ctrl.processItem("excluded/foo"); err != nil {
+		t.Fatal(err)
+	}
+	if len(evt.evts) != 1 || evt.evts[0].Action != event.Delete {
+		t.Errorf("marked objects should be notified as deleted: %+v", evt.evts)
+	}
+}
+
+func TestExclusionsRules(t *testing.T) {
+	for _, invalid := range [][]string{{"app in (foo"}, {" "}} {
+		if _, err := NewExclusions(nil, invalid, nil); err == nil {
+			t.Errorf("NewExclusions should fail on label selector %q", invalid)
+		}
+	}
+	for _, invalid := range []string{"foo", "=bar"} {
+		if _, err := NewExclusions(nil, nil, []string{invalid}); err == nil {
+			t.Errorf("NewExclusions should fail on annotation %q", invalid)
+		}
+	}
+
+	source := fakecontroller.NewFakeControllerSource()
+	sandbox := newObj("Namespace", "", "sandbox", nil)
+	sandbox.SetLabels(map[string]string{"team": "sandbox"})
+	source.Add(sandbox)
+	source.Add(newObj("Namespace", "", "prod", map[string]string{"backup": "true"}))
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	e, err := NewExclusions(nil, []string{"backup=false", "team=sandbox", "tier in (dev, test)"},
+		[]string{"example.com/backup=skip", "example.com/empty="})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.WatchNamespaces(source, stopCh)
+	cache.WaitForCacheSync(stopCh, e.HasSynced)
+
+	for _, tt := range []struct {
+		namespace   string
+		labels      map[string]string
+		annotations map[string]string
+		expected    bool
+	}{
+		{"prod", nil, nil, false},
+		{"prod", map[string]string{"backup": "false"}, nil, true},
+		{"prod", map[string]string{"backup": "true", "tier": "prod"}, nil, false},
+		{"prod", map[string]string{"tier": "dev"}, nil, true},
+		{"prod", nil, map[string]string{"example.com/backup": "skip"}, true},
+		{"prod", nil, map[string]string{"example.com/backup": "skipped"}, false},
+		{"prod", nil, map[string]string{"example.com/empty": ""}, true},
+		{"prod", map[string]string{"example.com/backup": "skip"}, nil, false},
+		{"sandbox", nil, nil, true},
+	} {
+		obj := newObj("Pod", tt.namespace, "foo", tt.annotations)
+		obj.SetLabels(tt.labels)
+		if e.Marked(obj) != tt.expected {
+			t.Errorf("Marked(%s/foo labels=%v annotations=%v) should be %v",
+				tt.namespace, tt.labels, tt.annotations, tt.expected)
+		}
+	}
+}
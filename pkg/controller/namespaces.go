@@ -0,0 +1,89 @@
+package controller
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/fields"
+)
+
+// NamespaceFilter selects objects by namespace, using glob patterns (eg.
+// "team-a-*"). A nil NamespaceFilter selects all namespaces.
+type NamespaceFilter struct {
+	include []string
+	exclude []string
+}
+
+// NewNamespaceFilter returns a NamespaceFilter selecting the namespaces
+// matching an include pattern (or any namespace, if include is empty),
+// and no exclude pattern.
+func NewNamespaceFilter(include, exclude []string) (*NamespaceFilter, error) {
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil, nil
+	}
+
+	for _, pattern := range append(append([]string{}, include...), exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid namespace pattern %s: %v", pattern, err)
+		}
+	}
+
+	return &NamespaceFilter{include: include, exclude: exclude}, nil
+}
+
+// Match tells if a namespace is selected
+func (f *NamespaceFilter) Match(namespace string) bool {
+	if f == nil {
+		return true
+	}
+
+	if len(f.include) > 0 && !matchAny(f.include, namespace) {
+		return false
+	}
+
+	return !matchAny(f.exclude, namespace)
+}
+
+// Single returns the only namespace that can match, if any: we can then
+// restrict the watches to that namespace.
+func (f *NamespaceFilter) Single() (string, bool) {
+	if f == nil || len(f.include) != 1 || isGlob(f.include[0]) {
+		return "", false
+	}
+	return f.include[0], true
+}
+
+// FieldSelector returns a field selector filtering out the excluded
+// namespaces that aren't globs, or an empty string.
+func (f *NamespaceFilter) FieldSelector() string {
+	if f == nil {
+		return ""
+	}
+
+	var selectors []fields.Selector
+	for _, ns := range f.exclude {
+		if !isGlob(ns) {
+			selectors = append(selectors, fields.OneTermNotEqualSelector("metadata.namespace", ns))
+		}
+	}
+
+	if len(selectors) == 0 {
+		return ""
+	}
+
+	return fields.AndSelectors(selectors...).String()
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, `*?[\`)
+}
@@ -0,0 +1,64 @@
+package controller
+
+import (
+	"testing"
+)
+
+func TestNamespaceFilter(t *testing.T) {
+	var none *NamespaceFilter
+	if !none.Match("kube-system") || none.FieldSelector() != "" {
+		t.Error("a nil filter should select all namespaces")
+	}
+
+	if _, err := NewNamespaceFilter([]string{"team-["}, nil); err == nil {
+		t.Error("invalid patterns should be rejected")
+	}
+
+	f, _ := NewNamespaceFilter([]string{"team-a-*", "default"}, []string{"team-a-tmp*", "kube-system"})
+	for ns, expected := range map[string]bool{
+		"team-a-front":  true,
+		"default":       true,
+		"team-a-tmp1":   false,
+		"team-b-front":  false,
+		"kube-system":   false,
+		"kube-public":   false,
+		"team-a-":       true,
+		"xteam-a-front": false,
+	} {
+		if f.Match(ns) != expected {
+			t.Errorf("Match(%s) should be %v", ns, expected)
+		}
+	}
+
+	if _, ok := f.Single(); ok {
+		t.Error("several included namespaces can't be watched as one")
+	}
+
+	if sel := f.FieldSelector(); sel != "metadata.namespace!=kube-system" {
+		t.Errorf("unexpected field selector: %s", sel)
+	}
+
+	f, _ = NewNamespaceFilter([]string{"prod"}, nil)
+	if ns, ok := f.Single(); !ok || ns != "prod" {
+		t.Error("a single literal included namespace should be watched alone")
+	}
+}
+
+func TestNamespaceSelection(t *testing.T) {
+	namespaces, _ := NewNamespaceFilter([]string{"team-*"}, nil)
+
+	pods := &Controller{name: "pod", namespaces: namespaces}
+	if !pods.selected("team-a/foo") || pods.selected("kube-system/foo") {
+		t.Error("namespaced objects should be selected by namespace")
+	}
+
+	nodes := &Controller{name: "node", namespaces: namespaces}
+	if !nodes.selected("node1") {
+		t.Error("cluster scoped objects should always be selected")
+	}
+
+	ns := &Controller{name: "namespace", namespaces: namespaces}
+	if !ns.selected("team-a") || ns.selected("kube-system") {
+		t.Error("namespaces should be selected by name")
+	}
+}
@@ -0,0 +1,52 @@
+package controller
+
+import (
+	"strings"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// Owners tracks the kinds being backed up, to skip the objects generated by
+// (having a controller reference to) an object of one of those kinds: eg.
+// ReplicaSets generated by Deployments, but not hand-created ReplicaSets.
+// A nil Owners skips nothing.
+type Owners struct {
+	mu    sync.RWMutex
+	kinds map[string]bool
+}
+
+// NewOwners returns an empty Owners
+func NewOwners() *Owners {
+	return &Owners{kinds: make(map[string]bool)}
+}
+
+// Add registers a kind being backed up
+func (o *Owners) Add(kind string) {
+	if o == nil {
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.kinds[strings.ToLower(kind)] = true
+}
+
+// Controlled tells if an object is controlled by an object of a kind being
+// backed up.
+func (o *Owners) Controlled(obj *unstructured.Unstructured) bool {
+	if o == nil {
+		return false
+	}
+
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	for _, ref := range obj.GetOwnerReferences() {
+		if ref.Controller != nil && *ref.Controller && o.kinds[strings.ToLower(ref.Kind)] {
+			return true
+		}
+	}
+
+	return false
+}
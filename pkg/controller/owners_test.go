@@ -0,0 +1,62 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bpineau/katafygio/pkg/event"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	fakecontroller "k8s.io/client-go/tools/cache/testing"
+)
+
+func ownedObj(name, ownerKind string, controller bool) *unstructured.Unstructured {
+	obj := newObj("Pod", "ns", name, nil)
+	if ownerKind != "" {
+		obj.SetOwnerReferences([]metav1.OwnerReference{
+			{APIVersion: "apps/v1", Kind: ownerKind, Name: "owner", Controller: &controller},
+		})
+	}
+	return obj
+}
+
+func TestOwners(t *testing.T) {
+	var none *Owners
+	none.Add("replicaset")
+	if none.Controlled(ownedObj("foo", "ReplicaSet", true)) {
+		t.Error("nil Owners shouldn't skip anything")
+	}
+
+	o := NewOwners()
+	o.Add("replicaset")
+
+	for obj, expected := range map[*unstructured.Unstructured]bool{
+		ownedObj("standalone", "", false):               false,
+		ownedObj("generated", "ReplicaSet", true):       true,
+		ownedObj("not-controller", "ReplicaSet", false): false,
+		ownedObj("unwatched", "StatefulSet", true):      false,
+	} {
+		if o.Controlled(obj) != expected {
+			t.Errorf("Controlled(%s) should be %v", obj.GetName(), expected)
+		}
+	}
+
+	// generated objects are skipped, and removed if they were saved before
+	evt := new(mockNotifier)
+	f := NewFactory(new(mockLog), FactoryOptions{Resync: time.Minute, SkipOwned: true})
+	ctrl := f.NewController(fakecontroller.NewFakeControllerSource(), evt, "pod").(*Controller)
+	f.NewController(fakecontroller.NewFakeControllerSource(), evt, "replicaset")
+
+	_ = ctrl.informer.GetIndexer().Add(ownedObj("generated", "ReplicaSet", true))
+	_ = ctrl.informer.GetIndexer().Add(ownedObj("standalone", "", false))
+	for _, key := range []string{"ns/generated", "ns/standalone"} {
+		if err := ctrl.processItem(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(evt.evts) != 2 || evt.evts[0].Action != event.Delete || evt.evts[1].Action != event.Upsert {
+		t.Errorf("generated objects should be skipped, and standalone ones saved: %+v", evt.evts)
+	}
+}
@@ -0,0 +1,47 @@
+package controller
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Selector restricts the objects watched by a controller, with label and
+// field selectors (as accepted by kubectl's --selector and --field-selector).
+type Selector struct {
+	Label string
+	Field string
+}
+
+// Validate checks the selectors syntax
+func (s Selector) Validate() error {
+	if _, err := labels.Parse(s.Label); err != nil {
+		return fmt.Errorf("invalid label selector %s: %v", s.Label, err)
+	}
+	if _, err := fields.ParseSelector(s.Field); err != nil {
+		return fmt.Errorf("invalid field selector %s: %v", s.Field, err)
+	}
+	return nil
+}
+
+// And returns a Selector matching objects selected by both s and other
+func (s Selector) And(other Selector) Selector {
+	return Selector{
+		Label: joinSelectors(s.Label, other.Label),
+		Field: joinSelectors(s.Field, other.Field),
+	}
+}
+
+// joinSelectors returns the intersection of two label or field selectors
+func joinSelectors(a, b string) string {
+	a, b = strings.TrimSpace(a), strings.TrimSpace(b)
+	switch {
+	case a == "":
+		return b
+	case b == "":
+		return a
+	}
+	return a + "," + b
+}
@@ -0,0 +1,101 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+	fakecontroller "k8s.io/client-go/tools/cache/testing"
+)
+
+// mockLW records the options it's listed with
+type mockLW struct {
+	*fakecontroller.FakeControllerSource
+	options metav1.ListOptions
+}
+
+func (m *mockLW) List(options metav1.ListOptions) (runtime.Object, error) {
+	m.options = options
+	return m.FakeControllerSource.List(options)
+}
+
+func (m *mockLW) Watch(options metav1.ListOptions) (watch.Interface, error) {
+	return m.FakeControllerSource.Watch(options)
+}
+
+func TestSelectors(t *testing.T) {
+	for _, invalid := range []Selector{{Label: "foo=bar=baz"}, {Field: "type"}} {
+		if invalid.Validate() == nil {
+			t.Errorf("Validate should fail on %+v", invalid)
+		}
+	}
+
+	if err := (Selector{Label: "app in (foo, bar)", Field: "type!=kubernetes.io/service-account-token"}).Validate(); err != nil {
+		t.Errorf("Validate shouldn't fail on valid selectors: %v", err)
+	}
+
+	selectors := map[string]Selector{
+		"secret": {Field: "type!=kubernetes.io/service-account-token"},
+		"event":  {Label: "tier=front", Field: "reason=BackOff"},
+	}
+	f := NewFactory(new(mockLog), FactoryOptions{Filter: "env=prod", Selectors: selectors, Resync: time.Minute})
+
+	for kind, expected := range map[string]metav1.ListOptions{
+		"secret": {LabelSelector: "env=prod", FieldSelector: "type!=kubernetes.io/service-account-token"},
+		"event":  {LabelSelector: "env=prod,tier=front", FieldSelector: "reason=BackOff"},
+		"pod":    {LabelSelector: "env=prod"},
+	} {
+		lw := &mockLW{FakeControllerSource: fakecontroller.NewFakeControllerSource()}
+		ctrl := f.NewController(lw, new(mockNotifier), kind).(*Controller)
+
+		stopCh := make(chan struct{})
+		go ctrl.informer.Run(stopCh)
+		cache.WaitForCacheSync(stopCh, ctrl.informer.HasSynced)
+		close(stopCh)
+
+		if lw.options.LabelSelector != expected.LabelSelector || lw.options.FieldSelector != expected.FieldSelector {
+			t.Errorf("%s should be listed with %+v, got %+v", kind, expected, lw.options)
+		}
+	}
+}
+
+func TestListWatchOptions(t *testing.T) {
+	selector := Selector{Label: "env=prod", Field: "type=foo"}
+
+	// informer's initial list, through the reflector's pager
+	opts := listOptions(metav1.ListOptions{LabelSelector: "a=b", ResourceVersion: "0", Limit: 500}, selector, 0)
+	if opts.LabelSelector != "a=b,env=prod" || opts.FieldSelector != "type=foo" {
+		t.Errorf("selectors should be merged, got %+v", opts)
+	}
+	if opts.ResourceVersion != "0" || opts.Limit != 500 {
+		t.Errorf("unpaginated lists should be served from cache, got %+v", opts)
+	}
+
+	opts = listOptions(metav1.ListOptions{ResourceVersion: "0", Limit: 500}, selector, 50)
+	if opts.ResourceVersion != "" || opts.Limit != 50 {
+		t.Errorf("paginated lists should be served by chunks of 50 from etcd, got %+v", opts)
+	}
+
+	opts = listOptions(metav1.ListOptions{ResourceVersion: "0", Limit: 500, Continue: "tok"}, selector, 50)
+	if opts.Continue != "tok" || opts.Limit != 50 {
+		t.Errorf("continue token should be kept, got %+v", opts)
+	}
+
+	// full list fallback, after an expired continue token
+	opts = listOptions(metav1.ListOptions{ResourceVersion: "0"}, selector, 50)
+	if opts.ResourceVersion != "0" || opts.Limit != 0 {
+		t.Errorf("full lists shouldn't be paginated, got %+v", opts)
+	}
+
+	timeout := int64(300)
+	opts = watchOptions(metav1.ListOptions{ResourceVersion: "1234", TimeoutSeconds: &timeout}, selector)
+	if opts.ResourceVersion != "1234" || opts.TimeoutSeconds != &timeout {
+		t.Errorf("watches should resume from the informer's resource version, got %+v", opts)
+	}
+	if !opts.AllowWatchBookmarks || opts.LabelSelector != "env=prod" || opts.FieldSelector != "type=foo" {
+		t.Errorf("watches should use bookmarks and our selectors, got %+v", opts)
+	}
+}
@@ -0,0 +1,105 @@
+package controller
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/bpineau/katafygio/pkg/fieldpath"
+)
+
+// DefaultStripped lists the fields always removed from dumped objects,
+// unless explicitly kept: they're either irrelevant for a backup, or
+// changing too often.
+var DefaultStripped = []string{
+	"status",
+	"metadata.selfLink",
+	"metadata.uid",
+	"metadata.resourceVersion",
+	"metadata.generation",
+}
+
+var kindPrefix = regexp.MustCompile(`^([a-zA-Z0-9*-]+):(.*)$`)
+
+type fieldRule struct {
+	kind string
+	path *fieldpath.Path
+}
+
+// parseFieldRule parses a "[kind:]path" rule. Rules without kind apply to all kinds.
+func parseFieldRule(rule string) (*fieldRule, error) {
+	r := &fieldRule{kind: "*"}
+
+	path := rule
+	if m := kindPrefix.FindStringSubmatch(rule); m != nil {
+		r.kind, path = strings.ToLower(m[1]), m[2]
+	}
+
+	p, err := fieldpath.Parse(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid field rule %s: %v", rule, err)
+	}
+	r.path = p
+
+	return r, nil
+}
+
+func (r *fieldRule) applies(kind string) bool {
+	return r.kind == "*" || r.kind == kind
+}
+
+// Stripper removes fields from objects
+type Stripper struct {
+	strip []*fieldRule
+	keep  []*fieldRule
+}
+
+// NewStripper returns a Stripper removing the DefaultStripped and the strip
+// fields, but the kept ones. Rules are "[kind:]path" field paths (eg.
+// "metadata.managedFields", or "persistentvolume:status"), and a kept path
+// must be written exactly as the stripped one.
+func NewStripper(strip, keep []string) (*Stripper, error) {
+	s := new(Stripper)
+
+	for _, rule := range append(append([]string{}, DefaultStripped...), strip...) {
+		r, err := parseFieldRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		s.strip = append(s.strip, r)
+	}
+
+	for _, rule := range keep {
+		r, err := parseFieldRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		s.keep = append(s.keep, r)
+	}
+
+	return s, nil
+}
+
+// Transform removes the stripped fields from the object, in place
+func (s *Stripper) Transform(obj *unstructured.Unstructured) error {
+	kind := strings.ToLower(obj.GetKind())
+
+	for _, rule := range s.strip {
+		if rule.applies(kind) && !s.kept(kind, rule.path.String()) {
+			rule.path.Delete(obj.Object)
+		}
+	}
+
+	return nil
+}
+
+func (s *Stripper) kept(kind, path string) bool {
+	for _, rule := range s.keep {
+		if rule.applies(kind) && rule.path.String() == path {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ghodss/yaml"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func decodeObj(t *testing.T, doc string) *unstructured.Unstructured {
+	obj := new(unstructured.Unstructured)
+	if err := yaml.Unmarshal([]byte(doc), &obj.Object); err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	return obj
+}
+
+func TestStripper(t *testing.T) {
+	s, err := NewStripper(
+		[]string{
+			"metadata.managedFields",
+			`metadata.annotations["kubectl.kubernetes.io/last-applied-configuration"]`,
+			"node:metadata.creationTimestamp",
+		},
+		[]string{"persistentvolume:status", "node:status"},
+	)
+	if err != nil {
+		t.Fatalf("failed to create a stripper: %v", err)
+	}
+
+	for kind, expected := range map[string]string{
+		"Deployment":       "kind: Deployment\nmetadata: {name: a, annotations: {b: c}, creationTimestamp: x}\n",
+		"Node":             "kind: Node\nmetadata: {name: a, annotations: {b: c}}\nstatus: {phase: Ready}\n",
+		"PersistentVolume": "kind: PersistentVolume\nmetadata: {name: a, annotations: {b: c}, creationTimestamp: x}\nstatus: {phase: Ready}\n",
+	} {
+		obj := decodeObj(t, `
+kind: `+kind+`
+metadata:
+  name: a
+  uid: 42
+  resourceVersion: "1"
+  creationTimestamp: x
+  managedFields: [{manager: kubectl}]
+  annotations:
+    b: c
+    kubectl.kubernetes.io/last-applied-configuration: "{}"
+status:
+  phase: Ready
+`)
+		_ = s.Transform(obj)
+
+		if !reflect.DeepEqual(obj, decodeObj(t, expected)) {
+			t.Errorf("wrong %s fields stripping:\nexpected %v\nactual   %v", kind, decodeObj(t, expected).Object, obj.Object)
+		}
+	}
+
+	if _, err = NewStripper([]string{"metadata..name"}, nil); err == nil {
+		t.Error("NewStripper should fail on invalid paths")
+	}
+
+	if _, err = NewStripper(nil, []string{"node:"}); err == nil {
+		t.Error("NewStripper should fail on invalid paths")
+	}
+}
@@ -0,0 +1,340 @@
+// Package diff compares two sets of dumped objects (ie. two backup revisions),
+// and reports the added, removed, and modified objects. Modifications are
+// described semantically, as a list of changed field paths.
+package diff
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+
+	"github.com/bpineau/katafygio/pkg/sops"
+)
+
+// Status tells how an object changed
+type Status string
+
+const (
+	// Added objects only exist in the newest revision
+	Added Status = "added"
+
+	// Removed objects only exist in the oldest revision
+	Removed Status = "removed"
+
+	// Modified objects exist in both revisions, with distinct content
+	Modified Status = "modified"
+)
+
+// FieldChange describes a modified field
+type FieldChange struct {
+	Path string      `json:"path"`
+	From interface{} `json:"from,omitempty"`
+	To   interface{} `json:"to,omitempty"`
+}
+
+// ObjectChange describes an added, removed or modified object
+type ObjectChange struct {
+	Status    Status        `json:"status"`
+	Kind      string        `json:"kind"`
+	Namespace string        `json:"namespace,omitempty"`
+	Name      string        `json:"name"`
+	File      string        `json:"file"`
+	Fields    []FieldChange `json:"fields,omitempty"`
+}
+
+// Report lists the changes between two revisions, sorted by kind,
+// namespace and name.
+type Report struct {
+	From    string          `json:"from"`
+	To      string          `json:"to"`
+	Objects []*ObjectChange `json:"objects"`
+}
+
+// Compare returns the changes between two sets of files, indexed by path
+func Compare(from, to map[string][]byte) []*ObjectChange {
+	changes := make([]*ObjectChange, 0)
+
+	for file, data := range from {
+		newdata, ok := to[file]
+		if !ok {
+			changes = append(changes, newChange(Removed, file, data))
+			continue
+		}
+
+		if string(data) == string(newdata) {
+			continue
+		}
+
+		change := newChange(Modified, file, newdata)
+		change.Fields = compareDocuments(data, newdata)
+		if len(change.Fields) > 0 {
+			changes = append(changes, change)
+		}
+	}
+
+	for file, data := range to {
+		if _, ok := from[file]; !ok {
+			changes = append(changes, newChange(Added, file, data))
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		a, b := changes[i], changes[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.File < b.File
+	})
+
+	return changes
+}
+
+func newChange(status Status, file string, data []byte) *ObjectChange {
+	change := &ObjectChange{Status: status, File: file}
+
+	var obj struct {
+		Kind     string `json:"kind"`
+		Metadata struct {
+			Name      string `json:"name"`
+			Namespace string `json:"namespace"`
+		} `json:"metadata"`
+	}
+
+	if err := yaml.Unmarshal(data, &obj); err != nil || obj.Kind == "" {
+		change.Name = file
+		return change
+	}
+
+	change.Kind = strings.ToLower(obj.Kind)
+	change.Namespace = obj.Metadata.Namespace
+	change.Name = obj.Metadata.Name
+	return change
+}
+
+func compareDocuments(from, to []byte) []FieldChange {
+	var a, b interface{}
+	errA := yaml.Unmarshal(from, &a)
+	errB := yaml.Unmarshal(to, &b)
+	if errA != nil || errB != nil {
+		// not a valid yaml document: fallback to a whole content comparison
+		return []FieldChange{{Path: "", From: string(from), To: string(to)}}
+	}
+
+	return Fields(a, b)
+}
+
+// Fields returns the list of fields that differ between two decoded documents
+func Fields(from, to interface{}) []FieldChange {
+	var changes []FieldChange
+	compare("", from, to, &changes)
+	return changes
+}
+
+func compare(path string, from, to interface{}, changes *[]FieldChange) {
+	switch a := from.(type) {
+	case map[string]interface{}:
+		if b, ok := to.(map[string]interface{}); ok {
+			compareMaps(path, a, b, changes)
+			return
+		}
+	case []interface{}:
+		if b, ok := to.([]interface{}); ok {
+			compareLists(path, a, b, changes)
+			return
+		}
+	}
+
+	// each encryption yields a distinct ciphertext: we can't tell changes apart
+	if sops.IsEncryptedValue(from) && sops.IsEncryptedValue(to) {
+		return
+	}
+
+	if !reflect.DeepEqual(from, to) {
+		*changes = append(*changes, FieldChange{Path: path, From: from, To: to})
+	}
+}
+
+func compareMaps(path string, from, to map[string]interface{}, changes *[]FieldChange) {
+	keys := make(map[string]struct{})
+	for k := range from {
+		keys[k] = struct{}{}
+	}
+	for k := range to {
+		keys[k] = struct{}{}
+	}
+
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	for _, k := range sorted {
+		if path == "" && k == "sops" {
+			// encryption metadata
+			continue
+		}
+		compare(joinKey(path, k), from[k], to[k], changes)
+	}
+}
+
+// compareLists matches list items by name when they are all named (eg.
+// containers, env vars, ports...), so a reordering is reported once, as the
+// list's names order change, rather than as a change of every moved item.
+// The order matters for some lists (eg. initContainers run in sequence, and
+// env vars can reference the previous ones).
+func compareLists(path string, from, to []interface{}, changes *[]FieldChange) {
+	fromNames, toNames := itemsByName(from), itemsByName(to)
+	if fromNames == nil || toNames == nil {
+		for i := 0; i < len(from) || i < len(to); i++ {
+			var a, b interface{}
+			if i < len(from) {
+				a = from[i]
+			}
+			if i < len(to) {
+				b = to[i]
+			}
+			compare(fmt.Sprintf("%s[%d]", path, i), a, b, changes)
+		}
+		return
+	}
+
+	names := make([]string, 0, len(fromNames)+len(toNames))
+	for name := range fromNames {
+		names = append(names, name)
+	}
+	for name := range toNames {
+		if _, ok := fromNames[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	fromOrder, toOrder := commonNames(from, toNames), commonNames(to, fromNames)
+	if !reflect.DeepEqual(fromOrder, toOrder) {
+		*changes = append(*changes, FieldChange{Path: path, From: fromOrder, To: toOrder})
+	}
+
+	for _, name := range names {
+		compare(fmt.Sprintf("%s[name=%s]", path, name), fromNames[name], toNames[name], changes)
+	}
+}
+
+func itemsByName(list []interface{}) map[string]interface{} {
+	if len(list) == 0 {
+		return nil
+	}
+
+	items := make(map[string]interface{})
+	for _, item := range list {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+
+		name, ok := m["name"].(string)
+		if !ok {
+			return nil
+		}
+
+		if _, dup := items[name]; dup {
+			return nil
+		}
+
+		items[name] = item
+	}
+
+	return items
+}
+
+// commonNames returns, in the list order, the names of its items which are
+// also in others
+func commonNames(list []interface{}, others map[string]interface{}) []string {
+	var names []string
+	for _, item := range list {
+		name := item.(map[string]interface{})["name"].(string)
+		if _, ok := others[name]; ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+var plainKey = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+func joinKey(path, key string) string {
+	if !plainKey.MatchString(key) {
+		return fmt.Sprintf("%s[%q]", path, key)
+	}
+
+	if path == "" {
+		return key
+	}
+
+	return path + "." + key
+}
+
+// WriteJSON writes the report as JSON
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// WriteText writes a human readable report, grouped by kind and namespace
+func (r *Report) WriteText(w io.Writer) error {
+	symbols := map[Status]string{Added: "+", Removed: "-", Modified: "~"}
+
+	var group string
+	for _, obj := range r.Objects {
+		title := obj.Kind
+		if obj.Namespace != "" {
+			title += " in " + obj.Namespace
+		}
+
+		if title != group {
+			group = title
+			if _, err := fmt.Fprintf(w, "%s:\n", title); err != nil {
+				return err
+			}
+		}
+
+		if _, err := fmt.Fprintf(w, "  %s %s\n", symbols[obj.Status], obj.Name); err != nil {
+			return err
+		}
+
+		for _, field := range obj.Fields {
+			_, err := fmt.Fprintf(w, "      %s: %s -> %s\n", field.Path, value(field.From), value(field.To))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func value(v interface{}) string {
+	if v == nil {
+		return "<none>"
+	}
+
+	out, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+
+	return string(out)
+}
@@ -0,0 +1,193 @@
+package diff
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var (
+	from = map[string][]byte{
+		"prod/deployment-api.yaml": []byte(`apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: api
+  namespace: prod
+  annotations:
+    example.com/owner: foo
+spec:
+  replicas: 2
+  template:
+    spec:
+      containers:
+      - name: api
+        image: api:1.0
+      - name: sidecar
+        image: proxy:1.0
+`),
+		"dev/configmap-foo.yaml":   []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: foo\n  namespace: dev\n"),
+		"namespace-dev.yaml":       []byte("apiVersion: v1\nkind: Namespace\nmetadata:\n  name: dev\n"),
+		"dev/configmap-order.yaml": []byte("kind: ConfigMap\nmetadata:\n  name: order\n  namespace: dev\ndata: {a: '1', b: '2'}\n"),
+	}
+
+	to = map[string][]byte{
+		"prod/deployment-api.yaml": []byte(`apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: api
+  namespace: prod
+  annotations:
+    example.com/owner: bar
+spec:
+  replicas: 3
+  template:
+    spec:
+      containers:
+      - name: sidecar
+        image: proxy:1.0
+      - name: api
+        image: api:1.1
+`),
+		"namespace-dev.yaml":       []byte("apiVersion: v1\nkind: Namespace\nmetadata:\n  name: dev\n"),
+		"prod/secret-bar.yaml":     []byte("apiVersion: v1\nkind: Secret\nmetadata:\n  name: bar\n  namespace: prod\n"),
+		"dev/configmap-order.yaml": []byte("kind: ConfigMap\nmetadata:\n  name: order\n  namespace: dev\ndata: {b: '2', a: '1'}\n"),
+	}
+)
+
+func TestCompare(t *testing.T) {
+	changes := Compare(from, to)
+
+	if len(changes) != 3 {
+		t.Fatalf("expected 3 changes, got %d: %+v", len(changes), changes)
+	}
+
+	expected := []struct {
+		status Status
+		kind   string
+		ns     string
+		name   string
+	}{
+		{Removed, "configmap", "dev", "foo"},
+		{Modified, "deployment", "prod", "api"},
+		{Added, "secret", "prod", "bar"},
+	}
+
+	for i, exp := range expected {
+		c := changes[i]
+		if c.Status != exp.status || c.Kind != exp.kind || c.Namespace != exp.ns || c.Name != exp.name {
+			t.Errorf("unexpected change at %d: expected %v actual %+v", i, exp, c)
+		}
+	}
+
+	fields := changes[1].Fields
+	expectedFields := []FieldChange{
+		{Path: `metadata.annotations["example.com/owner"]`, From: "foo", To: "bar"},
+		{Path: "spec.replicas", From: float64(2), To: float64(3)},
+		{Path: "spec.template.spec.containers", From: []string{"api", "sidecar"}, To: []string{"sidecar", "api"}},
+		{Path: "spec.template.spec.containers[name=api].image", From: "api:1.0", To: "api:1.1"},
+	}
+	if !reflect.DeepEqual(fields, expectedFields) {
+		t.Errorf("fields diff failed: expected %+v actual %+v", expectedFields, fields)
+	}
+}
+
+func TestFieldsLists(t *testing.T) {
+	fields := Fields(
+		map[string]interface{}{"args": []interface{}{"a", "b"}},
+		map[string]interface{}{"args": []interface{}{"a", "c", "d"}},
+	)
+
+	expected := []FieldChange{
+		{Path: "args[1]", From: "b", To: "c"},
+		{Path: "args[2]", From: nil, To: "d"},
+	}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Errorf("list diff failed: expected %+v actual %+v", expected, fields)
+	}
+}
+
+func TestFieldsNamedLists(t *testing.T) {
+	env := func(names ...string) []interface{} {
+		var list []interface{}
+		for _, name := range names {
+			list = append(list, map[string]interface{}{"name": name, "value": "v"})
+		}
+		return list
+	}
+
+	fields := Fields(
+		map[string]interface{}{"env": env("A", "B", "C")},
+		map[string]interface{}{"env": env("C", "A", "D")},
+	)
+
+	expected := []FieldChange{
+		{Path: "env", From: []string{"A", "C"}, To: []string{"C", "A"}},
+		{Path: "env[name=B]", From: map[string]interface{}{"name": "B", "value": "v"}, To: nil},
+		{Path: "env[name=D]", From: nil, To: map[string]interface{}{"name": "D", "value": "v"}},
+	}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Errorf("named list diff failed: expected %+v actual %+v", expected, fields)
+	}
+
+	// adding or removing items isn't an order change
+	fields = Fields(
+		map[string]interface{}{"env": env("A", "B", "C")},
+		map[string]interface{}{"env": env("A", "C")},
+	)
+	if len(fields) != 1 || fields[0].Path != "env[name=B]" {
+		t.Errorf("removing an item shouldn't be reported as an order change: %+v", fields)
+	}
+}
+
+func TestFieldsEncrypted(t *testing.T) {
+	fields := Fields(
+		map[string]interface{}{
+			"data": map[string]interface{}{"a": "ENC[AES256_GCM,data:Zm9v,iv:YQ==,tag:Yg==,type:str]"},
+			"sops": map[string]interface{}{"lastmodified": "2026-10-01T12:00:00Z"},
+		},
+		map[string]interface{}{
+			"data": map[string]interface{}{"a": "ENC[AES256_GCM,data:YmFy,iv:Yw==,tag:ZA==,type:str]", "b": "new"},
+			"sops": map[string]interface{}{"lastmodified": "2026-10-02T12:00:00Z"},
+		},
+	)
+
+	expected := []FieldChange{{Path: "data.b", From: nil, To: "new"}}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Errorf("encrypted values diff failed: expected %+v actual %+v", expected, fields)
+	}
+}
+
+func TestReportOutputs(t *testing.T) {
+	report := &Report{From: "abc", To: "def", Objects: Compare(from, to)}
+
+	var buf bytes.Buffer
+	if err := report.WriteJSON(&buf); err != nil {
+		t.Errorf("failed to write json: %v", err)
+	}
+
+	var decoded Report
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Errorf("invalid json report: %v", err)
+	}
+	if len(decoded.Objects) != 3 || decoded.From != "abc" {
+		t.Errorf("json report is incomplete: %s", buf.String())
+	}
+
+	buf.Reset()
+	if err := report.WriteText(&buf); err != nil {
+		t.Errorf("failed to write text: %v", err)
+	}
+
+	for _, line := range []string{
+		"configmap in dev:\n  - foo\n",
+		"deployment in prod:\n  ~ api\n",
+		"      spec.replicas: 2 -> 3\n",
+		"secret in prod:\n  + bar\n",
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("text report should contain %q: %s", line, buf.String())
+		}
+	}
+}
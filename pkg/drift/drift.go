@@ -0,0 +1,275 @@
+// Package drift compares the live cluster objects, as notified by controllers,
+// with the objects committed in the backup repository. It reports objects that
+// differ, that only exist in the cluster, or that only exist in the repository,
+// without ever modifying the repository.
+package drift
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/spf13/afero"
+
+	"github.com/bpineau/katafygio/pkg/diff"
+	"github.com/bpineau/katafygio/pkg/event"
+	"github.com/bpineau/katafygio/pkg/metrics"
+	"github.com/bpineau/katafygio/pkg/observer"
+	"github.com/bpineau/katafygio/pkg/recorder"
+)
+
+var (
+	appFs = afero.NewOsFs()
+
+	driftGauge = metrics.NewGauge("katafygio_drift_objects",
+		"Number of objects differing between the cluster and the backup repository.", "state")
+	lastCheckGauge = metrics.NewGauge("katafygio_drift_last_check_timestamp_seconds",
+		"Time of the last successful drift check.")
+)
+
+type logger interface {
+	Infof(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// Repository gives access to the committed objects
+type Repository interface {
+	Pull() error
+	ReadTree(rev string) (map[string][]byte, error)
+}
+
+// Report lists the objects drifting away from the committed state
+type Report struct {
+	Time        time.Time            `json:"time"`
+	Revision    string               `json:"revision"`
+	Modified    []*diff.ObjectChange `json:"modified"`
+	ClusterOnly []*diff.ObjectChange `json:"clusterOnly"`
+	GitOnly     []*diff.ObjectChange `json:"gitOnly"`
+}
+
+// Detector receives events from controllers and periodically compares
+// the live objects with the repository content.
+type Detector struct {
+	logger     logger
+	events     event.Notifier
+	repo       Repository
+	pull       bool
+	reportPath string
+	interval   time.Duration
+	live       map[string][]byte
+	liveLock   sync.RWMutex
+	syncChecks []func() error
+	syncLock   sync.Mutex
+	stopch     chan struct{}
+	donech     chan struct{}
+}
+
+// New creates a drift Detector. When pull is true, the repository is pulled
+// from its remote before each check. The report is only written to disk when
+// reportPath isn't empty.
+func New(log logger, events event.Notifier, repo Repository, pull bool, reportPath string, interval time.Duration) *Detector {
+	return &Detector{
+		logger:     log,
+		events:     events,
+		repo:       repo,
+		pull:       pull,
+		reportPath: reportPath,
+		interval:   interval,
+		live:       make(map[string][]byte),
+		stopch:     make(chan struct{}),
+		donech:     make(chan struct{}),
+	}
+}
+
+// Start continuously receive events, and periodically check for drifts
+func (d *Detector) Start() *Detector {
+	d.logger.Infof("Starting drift detector")
+
+	go func() {
+		evCh := d.events.ReadChan()
+		checkTick := time.NewTicker(d.interval)
+		defer checkTick.Stop()
+		defer close(d.donech)
+
+		for {
+			select {
+			case <-d.stopch:
+				return
+			case ev := <-evCh:
+				d.processNextEvent(&ev)
+			case <-checkTick.C:
+				d.check()
+			}
+		}
+	}()
+
+	return d
+}
+
+// Stop halts the drift detector, after a last check
+func (d *Detector) Stop() {
+	d.logger.Infof("Stopping drift detector")
+	close(d.stopch)
+	<-d.donech
+	d.check()
+}
+
+// AddSyncCheck registers a function telling whether the live objects were
+// fully listed (eg. observer.Synced). Until then, checks are skipped: they
+// would report every committed object as only present in git.
+func (d *Detector) AddSyncCheck(check func() error) {
+	d.syncLock.Lock()
+	defer d.syncLock.Unlock()
+	d.syncChecks = append(d.syncChecks, check)
+}
+
+// synced returns an error while some live objects may be missing
+func (d *Detector) synced() error {
+	d.syncLock.Lock()
+	defer d.syncLock.Unlock()
+
+	for _, check := range d.syncChecks {
+		if err := check(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *Detector) processNextEvent(ev *event.Notification) {
+	path := recorder.ObjectPath(ev)
+
+	d.liveLock.Lock()
+	defer d.liveLock.Unlock()
+
+	switch ev.Action {
+	case event.Upsert:
+		if metadataOnly(ev.Object) {
+			delete(d.live, path)
+		} else {
+			d.live[path] = ev.Object
+		}
+	case event.Delete:
+		delete(d.live, path)
+	}
+}
+
+// Compare returns the drifts between the live objects and a repository revision
+func (d *Detector) Compare(rev string) (*Report, error) {
+	committed, err := d.repo.ReadTree(rev)
+	if err != nil {
+		return nil, err
+	}
+
+	for path, data := range committed {
+		if metadataOnly(data) {
+			delete(committed, path)
+		}
+	}
+
+	d.liveLock.RLock()
+	changes := diff.Compare(committed, d.live)
+	d.liveLock.RUnlock()
+
+	report := &Report{
+		Time:        time.Now(),
+		Revision:    rev,
+		Modified:    make([]*diff.ObjectChange, 0),
+		ClusterOnly: make([]*diff.ObjectChange, 0),
+		GitOnly:     make([]*diff.ObjectChange, 0),
+	}
+
+	for _, change := range changes {
+		switch change.Status {
+		case diff.Modified:
+			report.Modified = append(report.Modified, change)
+		case diff.Added:
+			report.ClusterOnly = append(report.ClusterOnly, change)
+		case diff.Removed:
+			report.GitOnly = append(report.GitOnly, change)
+		}
+	}
+
+	return report, nil
+}
+
+// metadataOnly tells if a dump only holds an object's metadata
+func metadataOnly(data []byte) bool {
+	if !bytes.Contains(data, []byte(observer.MetadataOnlyMarker)) {
+		return false
+	}
+
+	var obj struct {
+		Metadata struct {
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+	}
+
+	return yaml.Unmarshal(data, &obj) == nil && obj.Metadata.Annotations[observer.MetadataOnlyMarker] == "true"
+}
+
+func (d *Detector) check() {
+	if err := d.synced(); err != nil {
+		d.logger.Infof("drift check skipped until the cluster is synced: %v", err)
+		return
+	}
+
+	if d.pull {
+		if err := d.repo.Pull(); err != nil {
+			d.logger.Errorf("drift check: %v", err)
+		}
+	}
+
+	report, err := d.Compare("HEAD")
+	if err != nil {
+		d.logger.Errorf("drift check failed: %v", err)
+		return
+	}
+
+	driftGauge.Set(float64(len(report.Modified)), "modified")
+	driftGauge.Set(float64(len(report.ClusterOnly)), "cluster_only")
+	driftGauge.Set(float64(len(report.GitOnly)), "git_only")
+	lastCheckGauge.Set(float64(report.Time.Unix()))
+
+	total := len(report.Modified) + len(report.ClusterOnly) + len(report.GitOnly)
+	if total > 0 {
+		d.logger.Infof("Drift detected: %d modified, %d only in cluster, %d only in git",
+			len(report.Modified), len(report.ClusterOnly), len(report.GitOnly))
+	}
+
+	if d.reportPath == "" {
+		return
+	}
+
+	if err := d.writeReport(report); err != nil {
+		d.logger.Errorf("failed to write drift report: %v", err)
+	}
+}
+
+func (d *Detector) writeReport(report *Report) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(d.reportPath)
+	tmpf, err := afero.TempFile(appFs, dir, ".temp-katafygio-")
+	if err != nil {
+		return fmt.Errorf("failed to create a temporary file: %v", err)
+	}
+
+	if _, err = tmpf.Write(data); err != nil {
+		return fmt.Errorf("failed to write to %s: %v", tmpf.Name(), err)
+	}
+
+	if err = tmpf.Close(); err != nil {
+		return fmt.Errorf("failed to close a temporary file: %v", err)
+	}
+
+	return appFs.Rename(tmpf.Name(), d.reportPath)
+}
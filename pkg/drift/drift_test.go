@@ -0,0 +1,140 @@
+package drift
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+
+	"github.com/bpineau/katafygio/pkg/event"
+	"github.com/bpineau/katafygio/pkg/metrics"
+)
+
+type mockLog struct{}
+
+func (m *mockLog) Infof(format string, args ...interface{})  {}
+func (m *mockLog) Errorf(format string, args ...interface{}) {}
+
+type mockRepo struct {
+	pulled int
+	files  map[string][]byte
+}
+
+func (m *mockRepo) Pull() error {
+	m.pulled++
+	return nil
+}
+
+func (m *mockRepo) ReadTree(rev string) (map[string][]byte, error) {
+	if m.files == nil {
+		return nil, fmt.Errorf("empty repository")
+	}
+	return m.files, nil
+}
+
+func notif(action event.Action, kind, key, content string) *event.Notification {
+	return &event.Notification{Action: action, Key: key, Kind: kind, Object: []byte(content)}
+}
+
+func TestDrift(t *testing.T) {
+	appFs = afero.NewMemMapFs()
+	_ = appFs.MkdirAll("/tmp", 0700)
+
+	repo := &mockRepo{files: map[string][]byte{
+		"ns1/configmap-same.yaml":    []byte("kind: ConfigMap\nmetadata: {name: same, namespace: ns1}\n"),
+		"ns1/configmap-changed.yaml": []byte("kind: ConfigMap\nmetadata: {name: changed, namespace: ns1}\ndata: {a: b}\n"),
+		"ns1/configmap-gitonly.yaml": []byte("kind: ConfigMap\nmetadata: {name: gitonly, namespace: ns1}\n"),
+		"ns1/event-meta.yaml":        []byte("kind: Event\nmetadata: {name: meta, namespace: ns1, annotations: {katafygio.io/metadata-only: 'true'}}\n"),
+	}}
+
+	evts := event.New()
+	det := New(new(mockLog), evts, repo, true, "/tmp/drift.json", time.Hour).Start()
+
+	evts.Send(notif(event.Upsert, "configmap", "ns1/same", "kind: ConfigMap\nmetadata: {name: same, namespace: ns1}\n"))
+	evts.Send(notif(event.Upsert, "configmap", "ns1/changed", "kind: ConfigMap\nmetadata: {name: changed, namespace: ns1}\ndata: {a: c}\n"))
+	evts.Send(notif(event.Upsert, "configmap", "ns1/live", "kind: ConfigMap\nmetadata: {name: live, namespace: ns1}\n"))
+	evts.Send(notif(event.Upsert, "configmap", "ns1/deleted", "kind: ConfigMap\nmetadata: {name: deleted, namespace: ns1}\n"))
+	evts.Send(notif(event.Delete, "configmap", "ns1/deleted", ""))
+	evts.Send(notif(event.Upsert, "pod", "ns1/meta", "kind: Pod\nmetadata: {name: meta, namespace: ns1, annotations: {katafygio.io/metadata-only: 'true'}}\n"))
+
+	det.Stop() // flush events and run a last check
+
+	if repo.pulled != 1 {
+		t.Errorf("repository should be pulled before checks")
+	}
+
+	data, err := afero.ReadFile(appFs, "/tmp/drift.json")
+	if err != nil {
+		t.Fatalf("drift report wasn't written: %v", err)
+	}
+
+	var report Report
+	if err = json.Unmarshal(data, &report); err != nil {
+		t.Fatalf("invalid drift report: %v", err)
+	}
+
+	if len(report.Modified) != 1 || report.Modified[0].Name != "changed" {
+		t.Errorf("modified object not reported: %s", data)
+	}
+
+	if len(report.ClusterOnly) != 1 || report.ClusterOnly[0].Name != "live" {
+		t.Errorf("cluster only object not reported (metadata-only dumps should be ignored): %s", data)
+	}
+
+	if len(report.GitOnly) != 1 || report.GitOnly[0].Name != "gitonly" {
+		t.Errorf("git only object not reported (metadata-only dumps should be ignored): %s", data)
+	}
+
+	var buf bytes.Buffer
+	_ = metrics.Write(&buf)
+	if !strings.Contains(buf.String(), `katafygio_drift_objects{state="git_only"} 1`) {
+		t.Errorf("drift metrics weren't updated: %s", buf.String())
+	}
+}
+
+func TestDriftFailures(t *testing.T) {
+	appFs = afero.NewReadOnlyFs(afero.NewMemMapFs())
+
+	// shouldn't panic nor block on failures
+	det := New(new(mockLog), event.New(), &mockRepo{}, false, "/tmp/drift.json", time.Hour).Start()
+	det.Stop()
+
+	det = New(new(mockLog), event.New(), &mockRepo{files: map[string][]byte{}}, false, "/tmp/drift.json", time.Hour)
+	det.Start().Stop()
+
+	exist, _ := afero.Exists(appFs, "/tmp/drift.json")
+	if exist {
+		t.Error("drift report shouldn't be written on a read-only filesystem")
+	}
+}
+
+func TestDriftWaitsForSync(t *testing.T) {
+	appFs = afero.NewMemMapFs()
+	_ = appFs.MkdirAll("/tmp", 0700)
+
+	repo := &mockRepo{files: map[string][]byte{
+		"ns1/configmap-foo.yaml": []byte("kind: ConfigMap\nmetadata: {name: foo, namespace: ns1}\n"),
+	}}
+
+	synced := fmt.Errorf("initial sync pending for configmap")
+	det := New(new(mockLog), event.New(), repo, true, "/tmp/drift.json", time.Hour)
+	det.AddSyncCheck(func() error { return synced })
+	det.Start().Stop()
+
+	if exist, _ := afero.Exists(appFs, "/tmp/drift.json"); exist || repo.pulled != 0 {
+		t.Error("drift checks should be skipped until the observers are synced")
+	}
+
+	synced = nil
+	det = New(new(mockLog), event.New(), repo, true, "/tmp/drift.json", time.Hour)
+	det.AddSyncCheck(func() error { return synced })
+	det.Start().Stop()
+
+	if exist, _ := afero.Exists(appFs, "/tmp/drift.json"); !exist {
+		t.Error("drift checks should run once the observers are synced")
+	}
+}
@@ -0,0 +1,115 @@
+package event
+
+import (
+	"sync"
+
+	"github.com/bpineau/katafygio/pkg/metrics"
+)
+
+var (
+	depthGauge = metrics.NewGauge("katafygio_event_queue_depth",
+		"Number of notifications waiting for the recorder.")
+	coalescedCounter = metrics.NewCounter("katafygio_events_coalesced_total",
+		"Number of notifications superseded by a newer one for the same object before being recorded.")
+)
+
+// Coalescing implements a bounded Notifier: Send doesn't wait for the
+// recorder unless the buffer is full, and pending notifications for a
+// same object are merged (the latest wins).
+type Coalescing struct {
+	mu       sync.Mutex
+	notFull  *sync.Cond
+	notEmpty *sync.Cond
+	capacity int
+	pending  map[string]*Notification
+	order    []string
+	inflight int
+	c        chan Notification
+}
+
+// NewCoalescing creates a Coalescing notifier buffering up to capacity
+// distinct objects notifications.
+func NewCoalescing(capacity int) *Coalescing {
+	if capacity < 1 {
+		capacity = 1
+	}
+
+	n := &Coalescing{
+		capacity: capacity,
+		pending:  make(map[string]*Notification),
+		c:        make(chan Notification),
+	}
+	n.notFull = sync.NewCond(&n.mu)
+	n.notEmpty = sync.NewCond(&n.mu)
+
+	go n.pump()
+
+	return n
+}
+
+// Send queues a notification, replacing any pending notification for the
+// same object. Blocks while the buffer is full.
+func (n *Coalescing) Send(notif *Notification) {
+	id := notif.Cluster + ":" + notif.Kind + ":" + notif.Key
+	copied := *notif
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for {
+		if _, ok := n.pending[id]; ok {
+			n.pending[id] = &copied
+			coalescedCounter.Inc()
+			return
+		}
+
+		if len(n.order) < n.capacity {
+			break
+		}
+
+		n.notFull.Wait()
+	}
+
+	n.pending[id] = &copied
+	n.order = append(n.order, id)
+	depthGauge.Set(float64(len(n.order)))
+	n.notEmpty.Signal()
+}
+
+// ReadChan returns a channel to read Notifications from
+func (n *Coalescing) ReadChan() <-chan Notification {
+	return n.c
+}
+
+// Len returns the number of pending notifications, including the one being
+// handed over to the reader.
+func (n *Coalescing) Len() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return len(n.order) + n.inflight
+}
+
+// pump feeds the read channel with the oldest pending notifications
+func (n *Coalescing) pump() {
+	for {
+		n.mu.Lock()
+		for len(n.order) == 0 {
+			n.notEmpty.Wait()
+		}
+
+		id := n.order[0]
+		n.order = n.order[1:]
+		notif := n.pending[id]
+		delete(n.pending, id)
+		n.inflight++
+		depthGauge.Set(float64(len(n.order)))
+		n.notFull.Signal()
+		n.mu.Unlock()
+
+		n.c <- *notif
+
+		n.mu.Lock()
+		n.inflight--
+		n.mu.Unlock()
+	}
+}
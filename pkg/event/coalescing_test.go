@@ -0,0 +1,63 @@
+package event
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCoalescing(t *testing.T) {
+	ev := NewCoalescing(10)
+
+	ev.Send(&Notification{Action: Upsert, Kind: "pod", Key: "ns/a", Object: []byte("a1")})
+	ev.Send(&Notification{Action: Upsert, Kind: "pod", Key: "ns/b", Object: []byte("b1")})
+	ev.Send(&Notification{Action: Upsert, Kind: "service", Key: "ns/b", Object: []byte("b1")})
+	ev.Send(&Notification{Action: Delete, Kind: "pod", Key: "ns/b"})
+	ev.Send(&Notification{Action: Upsert, Kind: "pod", Key: "ns/c", Object: []byte("c1")})
+
+	if ev.Len() != 4 {
+		t.Errorf("notifications for the same object should be merged, got %d pending", ev.Len())
+	}
+
+	expected := []struct {
+		kind, key string
+		action    Action
+	}{
+		{"pod", "ns/a", Upsert},
+		{"pod", "ns/b", Delete},
+		{"service", "ns/b", Upsert},
+		{"pod", "ns/c", Upsert},
+	}
+
+	for _, exp := range expected {
+		got := <-ev.ReadChan()
+		if got.Kind != exp.kind || got.Key != exp.key || got.Action != exp.action {
+			t.Errorf("expected %s %s %v, got %s %s %v", exp.kind, exp.key, exp.action, got.Kind, got.Key, got.Action)
+		}
+	}
+}
+
+func TestCoalescingBackpressure(t *testing.T) {
+	ev := NewCoalescing(1)
+
+	sent := make(chan struct{})
+	go func() {
+		for _, key := range []string{"a", "b", "c"} {
+			ev.Send(&Notification{Kind: "pod", Key: key})
+		}
+		close(sent)
+	}()
+
+	select {
+	case <-sent:
+		t.Error("Send should block when the buffer is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	for _, key := range []string{"a", "b", "c"} {
+		if got := <-ev.ReadChan(); got.Key != key {
+			t.Errorf("expected %s, got %s", key, got.Key)
+		}
+	}
+
+	<-sent
+}
@@ -1,6 +1,8 @@
 // Package event mediates notification between controllers and recorder
 package event
 
+import "time"
+
 // Action represents the kind of object change we're notifying
 type Action int
 
@@ -14,10 +16,12 @@ const (
 
 // Notification conveys an object delete/upsert notification
 type Notification struct {
-	Action Action
-	Key    string
-	Kind   string
-	Object []byte
+	Action  Action
+	Key     string
+	Kind    string
+	Object  []byte
+	Cluster string    // empty when backing up a single cluster
+	Time    time.Time // when the change was observed
 }
 
 // Notifier mediates notifications between controllers and recorder
@@ -47,3 +51,22 @@ func (n *Unbuffered) Send(notif *Notification) {
 func (n *Unbuffered) ReadChan() <-chan Notification {
 	return n.c
 }
+
+// clusterNotifier tags notifications with a cluster name
+type clusterNotifier struct {
+	Notifier
+	cluster string
+}
+
+// ForCluster returns a Notifier tagging the notifications it sends with
+// a cluster name, before forwarding them to n.
+func ForCluster(n Notifier, cluster string) Notifier {
+	return &clusterNotifier{Notifier: n, cluster: cluster}
+}
+
+// Send sends a notification
+func (c *clusterNotifier) Send(notif *Notification) {
+	tagged := *notif
+	tagged.Cluster = c.cluster
+	c.Notifier.Send(&tagged)
+}
@@ -26,3 +26,18 @@ func TestEvent(t *testing.T) {
 		t.Errorf("notification failed: expected %v actual %v", notif, got)
 	}
 }
+
+func TestForCluster(t *testing.T) {
+	ev := New()
+
+	go ForCluster(ev, "prod").Send(&notif)
+
+	got := <-ev.ReadChan()
+	if got.Cluster != "prod" || got.Key != notif.Key {
+		t.Errorf("notification should be tagged with its cluster: %+v", got)
+	}
+
+	if notif.Cluster != "" {
+		t.Error("the original notification shouldn't be altered")
+	}
+}
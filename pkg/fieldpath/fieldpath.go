@@ -0,0 +1,238 @@
+// Package fieldpath parses and applies field paths addressing parts of
+// decoded objects, using the syntax of the diff reports:
+//
+//	metadata.annotations                    map keys, separated by dots
+//	metadata.annotations["example.com/foo"] quoted keys (with dots or slashes)
+//	spec.containers[0].image                list items, by index
+//	spec.containers[name=app].image         list items, by "name" field value
+//	spec.containers[*].env                  any list item
+//	data.*                                  any map key
+package fieldpath
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type segmentType int
+
+const (
+	key segmentType = iota
+	anyKey
+	index
+	anyItem
+	namedItem
+)
+
+type segment struct {
+	typ   segmentType
+	key   string
+	index int
+}
+
+// Path is a parsed field path
+type Path struct {
+	raw      string
+	segments []segment
+}
+
+// Parse parses a field path
+func Parse(path string) (*Path, error) {
+	p := &Path{raw: path}
+
+	for i := 0; i < len(path); {
+		switch path[i] {
+		case '.':
+			if i == 0 || i == len(path)-1 || path[i+1] == '.' || path[i+1] == '[' {
+				return nil, fmt.Errorf("invalid path %s: misplaced dot at %d", path, i)
+			}
+			i++
+
+		case '[':
+			seg, n, err := parseBracket(path[i:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid path %s: %v", path, err)
+			}
+			p.segments = append(p.segments, seg)
+			i += n
+
+		default:
+			end := strings.IndexAny(path[i:], ".[")
+			if end < 0 {
+				end = len(path) - i
+			}
+			name := path[i : i+end]
+			if name == "*" {
+				p.segments = append(p.segments, segment{typ: anyKey})
+			} else {
+				p.segments = append(p.segments, segment{typ: key, key: name})
+			}
+			i += end
+		}
+	}
+
+	if len(p.segments) == 0 {
+		return nil, fmt.Errorf("empty path")
+	}
+
+	return p, nil
+}
+
+// parseBracket parses a bracketed segment, and returns its length
+func parseBracket(s string) (segment, int, error) {
+	if strings.HasPrefix(s, `["`) {
+		for i := 2; i < len(s); i++ {
+			if s[i] == '\\' {
+				i++
+				continue
+			}
+			if s[i] != '"' {
+				continue
+			}
+			if i+1 >= len(s) || s[i+1] != ']' {
+				return segment{}, 0, fmt.Errorf("missing closing bracket")
+			}
+			k, err := strconv.Unquote(s[1 : i+1])
+			if err != nil {
+				return segment{}, 0, fmt.Errorf("invalid quoted key %s", s[1:i+1])
+			}
+			return segment{typ: key, key: k}, i + 2, nil
+		}
+		return segment{}, 0, fmt.Errorf("unterminated quoted key")
+	}
+
+	end := strings.IndexByte(s, ']')
+	if end < 0 {
+		return segment{}, 0, fmt.Errorf("missing closing bracket")
+	}
+	inner := s[1:end]
+
+	switch {
+	case inner == "*":
+		return segment{typ: anyItem}, end + 1, nil
+	case strings.HasPrefix(inner, "name="):
+		return segment{typ: namedItem, key: strings.TrimPrefix(inner, "name=")}, end + 1, nil
+	}
+
+	i, err := strconv.Atoi(inner)
+	if err != nil || i < 0 {
+		return segment{}, 0, fmt.Errorf("invalid list index %s", inner)
+	}
+
+	return segment{typ: index, index: i}, end + 1, nil
+}
+
+// String returns the path as it was parsed
+func (p *Path) String() string {
+	return p.raw
+}
+
+// Update replaces every value matching the path with fn's result
+func (p *Path) Update(obj interface{}, fn func(value interface{}) interface{}) {
+	p.walk(obj, 0, func(parent interface{}, k string, i int) {
+		switch c := parent.(type) {
+		case map[string]interface{}:
+			c[k] = fn(c[k])
+		case []interface{}:
+			c[i] = fn(c[i])
+		}
+	})
+}
+
+// Delete removes every field matching the path (list items are removed
+// from their list), and returns the updated object.
+func (p *Path) Delete(obj interface{}) interface{} {
+	return p.delete(obj, 0, func(interface{}) bool { return true })
+}
+
+// DeleteIf removes the fields matching the path for which fn returns true,
+// and returns the updated object.
+func (p *Path) DeleteIf(obj interface{}, fn func(value interface{}) bool) interface{} {
+	return p.delete(obj, 0, fn)
+}
+
+func (p *Path) delete(node interface{}, depth int, fn func(interface{}) bool) interface{} {
+	seg := p.segments[depth]
+	last := depth == len(p.segments)-1
+
+	switch n := node.(type) {
+	case map[string]interface{}:
+		for k, v := range n {
+			if !seg.matchesKey(k) {
+				continue
+			}
+			if !last {
+				n[k] = p.delete(v, depth+1, fn)
+			} else if fn(v) {
+				delete(n, k)
+			}
+		}
+		return n
+
+	case []interface{}:
+		out := n[:0]
+		for i, item := range n {
+			switch {
+			case !seg.matchesItem(i, item):
+				out = append(out, item)
+			case !last:
+				out = append(out, p.delete(item, depth+1, fn))
+			case !fn(item):
+				out = append(out, item)
+			}
+		}
+		return out
+	}
+
+	return node
+}
+
+// walk calls fn with the container and the key (or index) of each match
+func (p *Path) walk(node interface{}, depth int, fn func(parent interface{}, k string, i int)) {
+	seg := p.segments[depth]
+	last := depth == len(p.segments)-1
+
+	switch n := node.(type) {
+	case map[string]interface{}:
+		for k, v := range n {
+			if !seg.matchesKey(k) {
+				continue
+			}
+			if last {
+				fn(n, k, 0)
+			} else {
+				p.walk(v, depth+1, fn)
+			}
+		}
+
+	case []interface{}:
+		for i, item := range n {
+			if !seg.matchesItem(i, item) {
+				continue
+			}
+			if last {
+				fn(n, "", i)
+			} else {
+				p.walk(item, depth+1, fn)
+			}
+		}
+	}
+}
+
+func (s segment) matchesKey(k string) bool {
+	return s.typ == anyKey || (s.typ == key && s.key == k)
+}
+
+func (s segment) matchesItem(i int, item interface{}) bool {
+	switch s.typ {
+	case anyItem:
+		return true
+	case index:
+		return s.index == i
+	case namedItem:
+		m, ok := item.(map[string]interface{})
+		return ok && m["name"] == s.key
+	}
+	return false
+}
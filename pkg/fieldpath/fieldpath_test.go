@@ -0,0 +1,103 @@
+package fieldpath
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ghodss/yaml"
+)
+
+const doc = `
+metadata:
+  annotations:
+    example.com/foo: a
+    plain: b
+spec:
+  containers:
+  - name: app
+    image: app:1.0
+    env: [{name: A, value: "1"}]
+  - name: sidecar
+    image: proxy:1.0
+data:
+  x: "1"
+  y: "2"
+`
+
+func decode(t *testing.T) map[string]interface{} {
+	var obj map[string]interface{}
+	if err := yaml.Unmarshal([]byte(doc), &obj); err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	return obj
+}
+
+func collect(t *testing.T, path string) []interface{} {
+	p, err := Parse(path)
+	if err != nil {
+		t.Fatalf("failed to parse %s: %v", path, err)
+	}
+
+	var values []interface{}
+	p.Update(decode(t), func(v interface{}) interface{} {
+		values = append(values, v)
+		return v
+	})
+	return values
+}
+
+func TestUpdate(t *testing.T) {
+	tests := map[string]int{
+		`metadata.annotations["example.com/foo"]`: 1,
+		`metadata.annotations.plain`:              1,
+		`spec.containers[1].image`:                1,
+		`spec.containers[name=app].image`:         1,
+		`spec.containers[*].image`:                2,
+		`spec.containers[*].env[*].value`:         1,
+		`data.*`:                                  2,
+		`*`:                                       3,
+		`spec.containers[name=nope].image`:        0,
+		`spec.containers[9].image`:                0,
+		`metadata.missing.deep`:                   0,
+	}
+
+	for path, count := range tests {
+		if values := collect(t, path); len(values) != count {
+			t.Errorf("%s should match %d values, got %v", path, count, values)
+		}
+	}
+
+	p, _ := Parse("spec.containers[name=sidecar].image")
+	obj := decode(t)
+	p.Update(obj, func(v interface{}) interface{} { return "changed" })
+	if obj["spec"].(map[string]interface{})["containers"].([]interface{})[1].(map[string]interface{})["image"] != "changed" {
+		t.Errorf("Update failed: %v", obj)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	obj := decode(t)
+	for _, path := range []string{`metadata.annotations["example.com/foo"]`, `spec.containers[name=app]`, `data.*`} {
+		p, _ := Parse(path)
+		p.Delete(obj)
+	}
+
+	var expected map[string]interface{}
+	_ = yaml.Unmarshal([]byte(`
+metadata: {annotations: {plain: b}}
+spec: {containers: [{name: sidecar, image: "proxy:1.0"}]}
+data: {}
+`), &expected)
+
+	if !reflect.DeepEqual(obj, expected) {
+		t.Errorf("Delete failed:\nexpected %v\nactual   %v", expected, obj)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, path := range []string{"", ".a", "a.", "a..b", "a[", "a[x]", "a[-1]", `a["b]`, `a["b"`, "a.[0]"} {
+		if _, err := Parse(path); err == nil {
+			t.Errorf("parsing %q should fail", path)
+		}
+	}
+}
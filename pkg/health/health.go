@@ -1,11 +1,17 @@
-// Package health serves health checks over HTTP at /health endpoint.
+// Package health serves health checks over HTTP at /health endpoint,
+// liveness and readiness checks at /healthz and /readyz endpoints, and
+// Prometheus metrics at /metrics endpoint.
 package health
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"sync"
+
+	"github.com/bpineau/katafygio/pkg/metrics"
 )
 
 type logger interface {
@@ -13,21 +19,85 @@ type logger interface {
 	Errorf(format string, args ...interface{})
 }
 
+// Check returns an error when a component isn't healthy
+type Check func() error
+
 // Listener is an http health check listener
 type Listener struct {
-	logger logger
-	port   int
-	donech chan struct{}
-	srv    *http.Server
+	logger     logger
+	port       int
+	donech     chan struct{}
+	srv        *http.Server
+	checksLock sync.RWMutex
+	liveness   map[string]Check
+	readiness  map[string]Check
+}
+
+// Report describes the checks results
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
 }
 
 // New create a new http health check listener
 func New(log logger, port int) *Listener {
 	return &Listener{
-		logger: log,
-		port:   port,
-		donech: make(chan struct{}),
-		srv:    nil,
+		logger:    log,
+		port:      port,
+		donech:    make(chan struct{}),
+		srv:       nil,
+		liveness:  make(map[string]Check),
+		readiness: make(map[string]Check),
+	}
+}
+
+// AddLivenessCheck registers a check for /healthz (and /readyz): the
+// process is failing, and should be restarted, when the check fails.
+func (h *Listener) AddLivenessCheck(name string, check Check) {
+	h.checksLock.Lock()
+	h.liveness[name] = check
+	h.checksLock.Unlock()
+}
+
+// AddReadinessCheck registers a check for /readyz: the backup isn't up to
+// date (yet) when the check fails.
+func (h *Listener) AddReadinessCheck(name string, check Check) {
+	h.checksLock.Lock()
+	h.readiness[name] = check
+	h.checksLock.Unlock()
+}
+
+func (h *Listener) livenessReply(w http.ResponseWriter, r *http.Request) {
+	h.checksLock.RLock()
+	defer h.checksLock.RUnlock()
+	h.reply(w, r, h.liveness)
+}
+
+func (h *Listener) readinessReply(w http.ResponseWriter, r *http.Request) {
+	h.checksLock.RLock()
+	defer h.checksLock.RUnlock()
+	h.reply(w, r, h.liveness, h.readiness)
+}
+
+func (h *Listener) reply(w http.ResponseWriter, r *http.Request, checks ...map[string]Check) {
+	report := &Report{Status: "ok", Checks: make(map[string]string)}
+	for _, set := range checks {
+		for name, check := range set {
+			report.Checks[name] = "ok"
+			if err := check(); err != nil {
+				report.Status = "failed"
+				report.Checks[name] = err.Error()
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		h.logger.Errorf("Failed to reply to http healtcheck from %s: %s\n", r.RemoteAddr, err)
 	}
 }
 
@@ -48,6 +118,9 @@ func (h *Listener) Start() *Listener {
 	h.srv = &http.Server{Addr: fmt.Sprintf(":%d", h.port)}
 
 	http.HandleFunc("/health", h.healthCheckReply)
+	http.HandleFunc("/healthz", h.livenessReply)
+	http.HandleFunc("/readyz", h.readinessReply)
+	http.Handle("/metrics", metrics.Handler())
 
 	go func() {
 		defer close(h.donech)
@@ -1,6 +1,8 @@
 package health
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -40,3 +42,37 @@ func TestHealthCheck(t *testing.T) {
 		t.Errorf("healthCheckReply handler didn't return an HTTP 200 status code")
 	}
 }
+
+func TestProbes(t *testing.T) {
+	hc := New(logs, 0)
+	hc.AddLivenessCheck("recorder", func() error { return nil })
+
+	var gitErr error
+	hc.AddReadinessCheck("git", func() error { return gitErr })
+
+	probe := func(handler http.HandlerFunc) (int, *Report) {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+
+		report := new(Report)
+		if err := json.Unmarshal(rr.Body.Bytes(), report); err != nil {
+			t.Errorf("probes should reply with json: %v", err)
+		}
+		return rr.Code, report
+	}
+
+	if code, report := probe(hc.readinessReply); code != http.StatusOK || report.Checks["recorder"] != "ok" {
+		t.Errorf("readiness should succeed: %d %+v", code, report)
+	}
+
+	gitErr = fmt.Errorf("push failed")
+
+	if code, _ := probe(hc.livenessReply); code != http.StatusOK {
+		t.Error("readiness checks shouldn't fail liveness")
+	}
+
+	code, report := probe(hc.readinessReply)
+	if code != http.StatusServiceUnavailable || report.Status != "failed" || report.Checks["git"] != "push failed" {
+		t.Errorf("failing checks should be reported: %d %+v", code, report)
+	}
+}
@@ -0,0 +1,299 @@
+// Package metrics maintains internal metrics, and exposes them over HTTP
+// using the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type collector interface {
+	write(w io.Writer) error
+}
+
+var (
+	registryLock sync.RWMutex
+	registry     = make(map[string]collector)
+)
+
+func register(name string, c collector) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if _, ok := registry[name]; ok {
+		panic(fmt.Sprintf("metric %s registered twice", name))
+	}
+
+	registry[name] = c
+}
+
+type sample struct {
+	labels []string
+	value  float64
+}
+
+// vec holds the samples of a metric, indexed by labels values
+type vec struct {
+	sync.Mutex
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	samples map[string]*sample
+}
+
+func newVec(kind, name, help string, labels []string) *vec {
+	v := &vec{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		samples: make(map[string]*sample),
+	}
+	register(name, v)
+	return v
+}
+
+func (v *vec) get(values []string) *sample {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s expects %d labels, got %d", v.name, len(v.labels), len(values)))
+	}
+
+	key := strings.Join(values, "\xff")
+	s, ok := v.samples[key]
+	if !ok {
+		s = &sample{labels: values}
+		v.samples[key] = s
+	}
+
+	return s
+}
+
+func (v *vec) write(w io.Writer) error {
+	v.Lock()
+	defer v.Unlock()
+
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind); err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(v.samples))
+	for k := range v.samples {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := v.samples[k]
+		_, err := fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labels, s.labels), formatValue(s.value))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=\"%s\"", name, labelEscaper.Replace(values[i]))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Gauge is a metric that can go up and down
+type Gauge struct {
+	*vec
+}
+
+// NewGauge registers a new gauge, with optional label names
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{newVec("gauge", name, help, labels)}
+}
+
+// Set sets the gauge value for the given labels values
+func (g *Gauge) Set(value float64, labels ...string) {
+	g.Lock()
+	g.get(labels).value = value
+	g.Unlock()
+}
+
+// Add adds a (possibly negative) value to the gauge
+func (g *Gauge) Add(value float64, labels ...string) {
+	g.Lock()
+	g.get(labels).value += value
+	g.Unlock()
+}
+
+// Counter is a metric that only goes up
+type Counter struct {
+	*vec
+}
+
+// NewCounter registers a new counter, with optional label names
+func NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{newVec("counter", name, help, labels)}
+}
+
+// Inc increments the counter for the given labels values
+func (c *Counter) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+// Add adds a positive value to the counter
+func (c *Counter) Add(value float64, labels ...string) {
+	if value < 0 {
+		panic(fmt.Sprintf("counter %s can't decrease", c.name))
+	}
+
+	c.Lock()
+	c.get(labels).value += value
+	c.Unlock()
+}
+
+// DefBuckets are the default histogram buckets, suited for durations in seconds
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+type histogramSample struct {
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Histogram counts observations (eg. durations) in configurable buckets
+type Histogram struct {
+	sync.Mutex
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	samples map[string]*histogramSample
+}
+
+// NewHistogram registers a new histogram, with sorted upper bounds buckets
+// (DefBuckets when nil), and optional label names
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+
+	h := &Histogram{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		samples: make(map[string]*histogramSample),
+	}
+	register(name, h)
+	return h
+}
+
+// Observe adds an observation for the given labels values
+func (h *Histogram) Observe(value float64, labels ...string) {
+	if len(labels) != len(h.labels) {
+		panic(fmt.Sprintf("metric %s expects %d labels, got %d", h.name, len(h.labels), len(labels)))
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	key := strings.Join(labels, "\xff")
+	s, ok := h.samples[key]
+	if !ok {
+		s = &histogramSample{labels: labels, counts: make([]uint64, len(h.buckets))}
+		h.samples[key] = s
+	}
+
+	for i, upper := range h.buckets {
+		if value <= upper {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+func (h *Histogram) write(w io.Writer) error {
+	h.Lock()
+	defer h.Unlock()
+
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name); err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(h.samples))
+	for k := range h.samples {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	names := append(append([]string{}, h.labels...), "le")
+	for _, k := range keys {
+		s := h.samples[k]
+
+		for i, upper := range h.buckets {
+			lbls := formatLabels(names, append(append([]string{}, s.labels...), formatValue(upper)))
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, lbls, s.counts[i]); err != nil {
+				return err
+			}
+		}
+
+		lbls := formatLabels(names, append(append([]string{}, s.labels...), "+Inf"))
+		base := formatLabels(h.labels, s.labels)
+		_, err := fmt.Fprintf(w, "%s_bucket%s %d\n%s_sum%s %s\n%s_count%s %d\n",
+			h.name, lbls, s.count, h.name, base, formatValue(s.sum), h.name, base, s.count)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Write writes all registered metrics to w, in the Prometheus text format
+func Write(w io.Writer) error {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := registry[name].write(w); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Handler returns an http handler serving the registered metrics
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := Write(w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGauge(t *testing.T) {
+	g := NewGauge("test_gauge", "A test gauge", "state")
+	g.Set(3, "modified")
+	g.Add(2, "modified")
+	g.Add(-1, `quoted"value`)
+
+	u := NewGauge("test_unlabelled", "A gauge without labels")
+	u.Set(1.5)
+
+	var buf bytes.Buffer
+	if err := Write(&buf); err != nil {
+		t.Errorf("failed to write metrics: %v", err)
+	}
+
+	for _, line := range []string{
+		"# HELP test_gauge A test gauge\n# TYPE test_gauge gauge\n",
+		`test_gauge{state="modified"} 5` + "\n",
+		`test_gauge{state="quoted\"value"} -1` + "\n",
+		"test_unlabelled 1.5\n",
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("metrics output should contain %q: %s", line, buf.String())
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a metric twice should panic")
+		}
+	}()
+	NewGauge("test_gauge", "duplicate")
+}
+
+func TestCounter(t *testing.T) {
+	c := NewCounter("test_counter_total", "A test counter", "action")
+	c.Inc("upsert")
+	c.Add(2, "upsert")
+	c.Inc("delete")
+
+	var buf bytes.Buffer
+	_ = Write(&buf)
+
+	for _, line := range []string{
+		"# TYPE test_counter_total counter\n",
+		`test_counter_total{action="delete"} 1` + "\n",
+		`test_counter_total{action="upsert"} 3` + "\n",
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("metrics output should contain %q: %s", line, buf.String())
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("decreasing a counter should panic")
+		}
+	}()
+	c.Add(-1, "upsert")
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram("test_duration_seconds", "A test histogram", []float64{0.1, 1}, "op")
+	h.Observe(0.05, "push")
+	h.Observe(0.5, "push")
+	h.Observe(5, "push")
+
+	var buf bytes.Buffer
+	_ = Write(&buf)
+
+	for _, line := range []string{
+		"# TYPE test_duration_seconds histogram\n",
+		`test_duration_seconds_bucket{op="push",le="0.1"} 1` + "\n",
+		`test_duration_seconds_bucket{op="push",le="1"} 2` + "\n",
+		`test_duration_seconds_bucket{op="push",le="+Inf"} 3` + "\n",
+		`test_duration_seconds_sum{op="push"} 5.55` + "\n",
+		`test_duration_seconds_count{op="push"} 3` + "\n",
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("metrics output should contain %q: %s", line, buf.String())
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	req, err := http.NewRequest("GET", "/metrics", nil)
+	if err != nil {
+		t.Error(err)
+	}
+
+	rr := httptest.NewRecorder()
+	Handler().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("metrics handler didn't return an HTTP 200 status code")
+	}
+
+	if !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("metrics handler should reply with text/plain content")
+	}
+}
@@ -0,0 +1,220 @@
+// Package normalize rewrites objects in a canonical form, so that changes
+// that are only cosmetic (lists reordered by a controller, fields explicitly
+// set to their server-side default value) don't show as changes. Maps keys
+// don't need sorting: they're always serialized in order.
+package normalize
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/bpineau/katafygio/pkg/fieldpath"
+)
+
+// unorderedLists maps the names of lists whose items order is meaningless
+// to the items fields identifying them.
+var unorderedLists = map[string][]string{
+	"env":              {"name"},
+	"ports":            {"containerPort", "port", "protocol", "name"},
+	"volumes":          {"name"},
+	"volumeDevices":    {"name"},
+	"imagePullSecrets": {"name"},
+}
+
+// podSpecs gives the path to the pod spec, for the kinds embedding one
+var podSpecs = map[string]string{
+	"pod":                   "spec",
+	"podtemplate":           "template.spec",
+	"replicationcontroller": "spec.template.spec",
+	"replicaset":            "spec.template.spec",
+	"deployment":            "spec.template.spec",
+	"statefulset":           "spec.template.spec",
+	"daemonset":             "spec.template.spec",
+	"job":                   "spec.template.spec",
+	"cronjob":               "spec.jobTemplate.spec.template.spec",
+}
+
+// podSpecDefaults are relative to the pod spec
+var podSpecDefaults = map[string]interface{}{
+	"dnsPolicy":                                  "ClusterFirst",
+	"restartPolicy":                              "Always",
+	"schedulerName":                              "default-scheduler",
+	"terminationGracePeriodSeconds":              30,
+	"securityContext":                            map[string]interface{}{},
+	"containers[*].terminationMessagePath":       "/dev/termination-log",
+	"containers[*].terminationMessagePolicy":     "File",
+	"containers[*].ports[*].protocol":            "TCP",
+	"initContainers[*].terminationMessagePath":   "/dev/termination-log",
+	"initContainers[*].terminationMessagePolicy": "File",
+}
+
+var kindDefaults = map[string]map[string]interface{}{
+	"deployment": {
+		"spec.revisionHistoryLimit":                  10,
+		"spec.progressDeadlineSeconds":               600,
+		"spec.strategy.rollingUpdate.maxSurge":       "25%",
+		"spec.strategy.rollingUpdate.maxUnavailable": "25%",
+	},
+	"daemonset": {
+		"spec.revisionHistoryLimit":                        10,
+		"spec.updateStrategy.rollingUpdate.maxUnavailable": 1,
+	},
+	"statefulset": {
+		"spec.revisionHistoryLimit": 10,
+		"spec.podManagementPolicy":  "OrderedReady",
+	},
+	"cronjob": {
+		"spec.concurrencyPolicy":          "Allow",
+		"spec.suspend":                    false,
+		"spec.successfulJobsHistoryLimit": 3,
+		"spec.failedJobsHistoryLimit":     1,
+	},
+	"service": {
+		"spec.sessionAffinity":   "None",
+		"spec.ports[*].protocol": "TCP",
+	},
+}
+
+type defaultValue struct {
+	path  *fieldpath.Path
+	value interface{}
+}
+
+// Normalizer rewrites objects in a canonical form
+type Normalizer struct {
+	defaults map[string][]defaultValue
+}
+
+// New returns a Normalizer
+func New() *Normalizer {
+	n := &Normalizer{defaults: make(map[string][]defaultValue)}
+
+	for kind, defaults := range kindDefaults {
+		for path, value := range defaults {
+			n.addDefault(kind, path, value)
+		}
+	}
+
+	for kind, spec := range podSpecs {
+		for path, value := range podSpecDefaults {
+			n.addDefault(kind, spec+"."+path, value)
+		}
+	}
+
+	return n
+}
+
+func (n *Normalizer) addDefault(kind, path string, value interface{}) {
+	p, err := fieldpath.Parse(path)
+	if err != nil {
+		panic(fmt.Sprintf("invalid default field path %s: %v", path, err))
+	}
+	n.defaults[kind] = append(n.defaults[kind], defaultValue{path: p, value: value})
+}
+
+// Transform normalizes the object, in place
+func (n *Normalizer) Transform(obj *unstructured.Unstructured) error {
+	for _, def := range n.defaults[strings.ToLower(obj.GetKind())] {
+		def.path.DeleteIf(obj.Object, func(value interface{}) bool {
+			return isDefault(value, def.value)
+		})
+	}
+
+	sortLists(obj.Object)
+	return nil
+}
+
+func isDefault(value, def interface{}) bool {
+	if m, ok := def.(map[string]interface{}); ok && len(m) == 0 {
+		v, ok := value.(map[string]interface{})
+		return ok && len(v) == 0
+	}
+
+	switch value.(type) {
+	case string, bool, int64, int, float64:
+		return fmt.Sprint(value) == fmt.Sprint(def)
+	}
+
+	return false
+}
+
+// sortLists recursively sorts the lists known to be unordered
+func sortLists(node interface{}) {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		for k, v := range n {
+			if list, ok := v.([]interface{}); ok {
+				if keys, ok := unorderedLists[k]; ok && sortable(k, list) {
+					sortItems(list, keys)
+				}
+			}
+			sortLists(v)
+		}
+
+	case []interface{}:
+		for _, item := range n {
+			sortLists(item)
+		}
+	}
+}
+
+// sortable tells if all the list items are maps. Env vars are only sorted
+// when they don't reference each other: "$(VAR)" expansion depends on order.
+func sortable(name string, list []interface{}) bool {
+	for _, item := range list {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			return false
+		}
+
+		if value, ok := m["value"].(string); name == "env" && ok && strings.Contains(value, "$(") {
+			return false
+		}
+	}
+
+	return true
+}
+
+func sortItems(list []interface{}, keys []string) {
+	sort.SliceStable(list, func(i, j int) bool {
+		a, b := list[i].(map[string]interface{}), list[j].(map[string]interface{})
+		for _, k := range keys {
+			if c := compare(a[k], b[k]); c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+}
+
+// compare orders numbers numerically, and other values by their representation
+func compare(a, b interface{}) int {
+	fa, aNum := toFloat(a)
+	fb, bNum := toFloat(b)
+	if aNum && bNum {
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		}
+		return 0
+	}
+
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
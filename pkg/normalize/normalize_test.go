@@ -0,0 +1,73 @@
+package normalize
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ghodss/yaml"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func decode(t *testing.T, doc string) *unstructured.Unstructured {
+	obj := new(unstructured.Unstructured)
+	if err := yaml.Unmarshal([]byte(doc), &obj.Object); err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	return obj
+}
+
+func TestNormalize(t *testing.T) {
+	obj := decode(t, `
+kind: Deployment
+metadata: {name: app}
+spec:
+  replicas: 2
+  revisionHistoryLimit: 10
+  progressDeadlineSeconds: 300
+  template:
+    spec:
+      dnsPolicy: ClusterFirst
+      restartPolicy: Never
+      securityContext: {}
+      terminationGracePeriodSeconds: 30
+      volumes: [{name: b}, {name: a}]
+      containers:
+      - name: app
+        terminationMessagePath: /dev/termination-log
+        env: [{name: B, value: "2"}, {name: A, value: "1"}]
+        ports: [{containerPort: 8080, protocol: TCP}, {containerPort: 443, protocol: UDP}, {containerPort: 443, protocol: TCP}]
+      - name: sidecar
+        env: [{name: B, value: "2"}, {name: A, value: "$(B)"}]
+`)
+
+	expected := decode(t, `
+kind: Deployment
+metadata: {name: app}
+spec:
+  replicas: 2
+  progressDeadlineSeconds: 300
+  template:
+    spec:
+      restartPolicy: Never
+      volumes: [{name: a}, {name: b}]
+      containers:
+      - name: app
+        env: [{name: A, value: "1"}, {name: B, value: "2"}]
+        ports: [{containerPort: 443}, {containerPort: 443, protocol: UDP}, {containerPort: 8080}]
+      - name: sidecar
+        env: [{name: B, value: "2"}, {name: A, value: "$(B)"}]
+`)
+
+	_ = New().Transform(obj)
+	if !reflect.DeepEqual(obj.Object, expected.Object) {
+		t.Errorf("normalization failed:\nexpected %v\nactual   %v", expected.Object, obj.Object)
+	}
+
+	// defaults are only dropped for their kinds
+	other := decode(t, "kind: Foo\nspec: {revisionHistoryLimit: 10}\n")
+	_ = New().Transform(other)
+	if !reflect.DeepEqual(other.Object, decode(t, "kind: Foo\nspec: {revisionHistoryLimit: 10}\n").Object) {
+		t.Errorf("defaults shouldn't be dropped from other kinds: %v", other.Object)
+	}
+}
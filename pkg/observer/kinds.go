@@ -0,0 +1,90 @@
+package observer
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// KindPattern selects API resources by group, version, and kind or
+// resource name, with globs. Patterns have the "[group/[version/]]name"
+// form: "*.cert-manager.io" (a single part matches either the group, kind
+// or resource name), "apps/*", "core/v1/configmaps". The core group is
+// named "core".
+type KindPattern struct {
+	raw     string
+	group   string
+	version string
+	name    string
+}
+
+// ParseKindPatterns parses and validates resources patterns
+func ParseKindPatterns(patterns []string) ([]*KindPattern, error) {
+	parsed := make([]*KindPattern, 0, len(patterns))
+
+	for _, pattern := range patterns {
+		p := &KindPattern{raw: pattern, group: "*", version: "*"}
+
+		parts := strings.Split(strings.ToLower(pattern), "/")
+		switch len(parts) {
+		case 1:
+			p.name = parts[0]
+		case 2:
+			p.group, p.name = parts[0], parts[1]
+		case 3:
+			p.group, p.version, p.name = parts[0], parts[1], parts[2]
+		default:
+			return nil, fmt.Errorf("invalid resource pattern %s: expecting [group/[version/]]name", pattern)
+		}
+
+		for _, part := range parts {
+			if _, err := path.Match(part, ""); err != nil || part == "" {
+				return nil, fmt.Errorf("invalid resource pattern %s", pattern)
+			}
+		}
+
+		parsed = append(parsed, p)
+	}
+
+	return parsed, nil
+}
+
+// String returns the pattern as it was parsed
+func (p *KindPattern) String() string {
+	return p.raw
+}
+
+// Match tells if the pattern selects a resource
+func (p *KindPattern) Match(group, version, kind, resource string) bool {
+	group = strings.ToLower(group)
+	if group == "" {
+		group = "core"
+	}
+
+	if p.group == "*" && p.version == "*" && glob(p.name, group) {
+		// single part patterns can select a whole group
+		return true
+	}
+
+	return glob(p.group, group) && glob(p.version, strings.ToLower(version)) &&
+		(glob(p.name, strings.ToLower(kind)) || glob(p.name, strings.ToLower(resource)))
+}
+
+func isIncluded(included []*KindPattern, group, version, kind, resource string) bool {
+	return len(included) == 0 || matchAny(included, group, version, kind, resource)
+}
+
+func matchAny(patterns []*KindPattern, group, version, kind, resource string) bool {
+	for _, p := range patterns {
+		if p.Match(group, version, kind, resource) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func glob(pattern, name string) bool {
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
@@ -0,0 +1,116 @@
+package observer
+
+import (
+	"net/http"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+)
+
+// Ask the api-server for PartialObjectMetadata (meta.k8s.io/v1 since kubernetes
+// 1.15, v1beta1 before), falling back to full objects for older api-servers.
+const (
+	metadataListAccept = "application/json;as=PartialObjectMetadataList;g=meta.k8s.io;v=v1," +
+		"application/json;as=PartialObjectMetadataList;g=meta.k8s.io;v=v1beta1,application/json"
+	metadataWatchAccept = "application/json;as=PartialObjectMetadata;g=meta.k8s.io;v=v1," +
+		"application/json;as=PartialObjectMetadata;g=meta.k8s.io;v=v1beta1,application/json"
+)
+
+// MetadataOnlyMarker is the annotation marking the dumps of metadata-only
+// kinds, which can't be restored nor compared with the live objects.
+const MetadataOnlyMarker = "katafygio.io/metadata-only"
+
+// metadataFields are the metadata we keep for metadata-only kinds. The
+// resourceVersion is needed by the informers (and stripped from dumps).
+var metadataFields = []string{"name", "namespace", "resourceVersion", "labels", "annotations", "ownerReferences"}
+
+// metadataTransport requests objects metadata only from the api-server
+type metadataTransport struct {
+	rt http.RoundTripper
+}
+
+func (t *metadataTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = utilnet.CloneRequest(req)
+	if req.URL.Query().Get("watch") == "true" {
+		req.Header.Set("Accept", metadataWatchAccept)
+	} else {
+		req.Header.Set("Accept", metadataListAccept)
+	}
+	return t.rt.RoundTrip(req)
+}
+
+// newMetadataClient returns a dynamic client fetching objects metadata only
+func newMetadataClient(config *rest.Config) dynamic.Interface {
+	config = rest.CopyConfig(config)
+	config.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+		return &metadataTransport{rt: rt}
+	})
+	return dynamic.NewForConfigOrDie(config)
+}
+
+// metadataLister lists and watches a resource's objects metadata, as
+// objects of the resource's kind (rather than PartialObjectMetadata).
+type metadataLister struct {
+	client     dynamic.ResourceInterface
+	apiVersion string
+	kind       string
+}
+
+func (m *metadataLister) List(options metav1.ListOptions) (runtime.Object, error) {
+	list, err := m.client.List(options)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range list.Items {
+		m.reduce(&list.Items[i])
+	}
+
+	return list, nil
+}
+
+func (m *metadataLister) Watch(options metav1.ListOptions) (watch.Interface, error) {
+	w, err := m.client.Watch(options)
+	if err != nil {
+		return nil, err
+	}
+
+	return watch.Filter(w, func(ev watch.Event) (watch.Event, bool) {
+		if obj, ok := ev.Object.(*unstructured.Unstructured); ok && ev.Type != watch.Error {
+			m.reduce(obj)
+		}
+		return ev, true
+	}), nil
+}
+
+// reduce strips an object (full, or PartialObjectMetadata) down to its
+// identity, labels, annotations and owners, and marks it as such.
+func (m *metadataLister) reduce(obj *unstructured.Unstructured) {
+	meta, _ := obj.Object["metadata"].(map[string]interface{})
+
+	kept := make(map[string]interface{})
+	for _, field := range metadataFields {
+		if value, ok := meta[field]; ok {
+			kept[field] = value
+		}
+	}
+
+	annotations := map[string]interface{}{MetadataOnlyMarker: "true"}
+	if orig, ok := kept["annotations"].(map[string]interface{}); ok {
+		for k, v := range orig {
+			annotations[k] = v
+		}
+	}
+	kept["annotations"] = annotations
+
+	obj.Object = map[string]interface{}{
+		"apiVersion": m.apiVersion,
+		"kind":       m.kind,
+		"metadata":   kept,
+	}
+}
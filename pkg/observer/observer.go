@@ -5,12 +5,15 @@
 package observer
 
 import (
+	"fmt"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/bpineau/katafygio/pkg/controller"
 	"github.com/bpineau/katafygio/pkg/event"
+	"github.com/bpineau/katafygio/pkg/metrics"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -24,6 +27,9 @@ import (
 
 const discoveryInterval = 60 * time.Second
 
+var watchedGauge = metrics.NewGauge("katafygio_watched_kinds",
+	"Number of resource kinds being watched, across all clusters.")
+
 // ControllerFactory make controllers generation interchangeable
 type ControllerFactory interface {
 	NewController(client cache.ListerWatcher, notifier event.Notifier, name string) controller.Interface
@@ -48,10 +54,14 @@ type Observer struct {
 	notifier     event.Notifier
 	discovery    discovery.DiscoveryInterface
 	cpool        dynamic.Interface
+	mpool        dynamic.Interface
 	ctrls        controllerCollection
 	factory      ControllerFactory
 	logger       logger
+	includedkind []*KindPattern
 	excludedkind []string
+	metadataonly []*KindPattern
+	namespaces   *controller.NamespaceFilter
 }
 
 type gvk struct {
@@ -61,16 +71,24 @@ type gvk struct {
 
 type resources map[string]*gvk
 
-// New returns a new observer, that will watch API resources and create controllers
-func New(log logger, client restclient, notif event.Notifier, factory ControllerFactory, excluded []string) *Observer {
+// New returns a new observer, that will watch API resources and create controllers.
+// When included isn't empty, only the matching resources are watched. Watches are
+// restricted to the selected namespaces, when possible. For resources matching
+// metadataOnly, we only watch (and save) the objects names, labels, annotations
+// and owner references.
+func New(log logger, client restclient, notif event.Notifier, factory ControllerFactory, included []*KindPattern, excluded []string, metadataOnly []*KindPattern, namespaces *controller.NamespaceFilter) *Observer {
 	return &Observer{
 		notifier:     notif,
 		discovery:    discovery.NewDiscoveryClientForConfigOrDie(client.GetRestConfig()),
 		cpool:        dynamic.NewForConfigOrDie(client.GetRestConfig()),
+		mpool:        newMetadataClient(client.GetRestConfig()),
 		ctrls:        make(controllerCollection),
 		factory:      factory,
 		logger:       log,
+		includedkind: included,
 		excludedkind: excluded,
+		metadataonly: metadataOnly,
+		namespaces:   namespaces,
 	}
 }
 
@@ -103,6 +121,30 @@ func (c *Observer) Start() *Observer {
 	return c
 }
 
+// Synced returns an error unless all the controllers completed their initial sync
+func (c *Observer) Synced() error {
+	c.RLock()
+	defer c.RUnlock()
+
+	if len(c.ctrls) == 0 {
+		return fmt.Errorf("no resource kind discovered yet")
+	}
+
+	var pending []string
+	for name, ct := range c.ctrls {
+		if !ct.Synced() {
+			pending = append(pending, name)
+		}
+	}
+
+	if len(pending) > 0 {
+		sort.Strings(pending)
+		return fmt.Errorf("initial sync pending for %s", strings.Join(pending, ", "))
+	}
+
+	return nil
+}
+
 // Stop halts the observer
 func (c *Observer) Stop() {
 	c.logger.Infof("Stopping all kubernetes controllers")
@@ -139,18 +181,44 @@ func (c *Observer) refresh() error {
 		}
 
 		cname := strings.ToLower(res.apiResource.Kind)
-		namespace := metav1.NamespaceAll
+		namespace, fieldSelector := metav1.NamespaceAll, ""
+		if res.apiResource.Namespaced {
+			if ns, ok := c.namespaces.Single(); ok {
+				namespace = ns
+			}
+			fieldSelector = c.namespaces.FieldSelector()
+		}
+
+		client := c.cpool.Resource(resource).Namespace(namespace)
+		var lister cache.ListerWatcher = &cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return client.List(options)
+			},
+			WatchFunc: client.Watch,
+		}
+
+		if matchAny(c.metadataonly, resource.Group, resource.Version, res.apiResource.Kind, resource.Resource) {
+			lister = &metadataLister{
+				client:     c.mpool.Resource(resource).Namespace(namespace),
+				apiVersion: res.groupVersion.String(),
+				kind:       res.apiResource.Kind,
+			}
+		}
+
 		lw := &cache.ListWatch{
 			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
-				return c.cpool.Resource(resource).Namespace(namespace).List(options)
+				options.FieldSelector = withSelector(options.FieldSelector, fieldSelector)
+				return lister.List(options)
 			},
 			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
-				return c.cpool.Resource(resource).Namespace(namespace).Watch(options)
+				options.FieldSelector = withSelector(options.FieldSelector, fieldSelector)
+				return lister.Watch(options)
 			},
 		}
 
 		c.ctrls[name] = c.factory.NewController(lw, c.notifier, cname)
 		go c.ctrls[name].Start()
+		watchedGauge.Add(1)
 	}
 
 	return nil
@@ -185,7 +253,7 @@ func (c *Observer) expandAndFilterAPIResources(groups []*metav1.APIResourceList)
 			}
 
 			// remove user filtered objet kinds
-			if isExcluded(c.excludedkind, ar.Kind) {
+			if !isIncluded(c.includedkind, gv.Group, gv.Version, ar.Kind, ar.Name) || isExcluded(c.excludedkind, ar.Kind) {
 				continue
 			}
 
@@ -210,6 +278,14 @@ func (c *Observer) expandAndFilterAPIResources(groups []*metav1.APIResourceList)
 	return resources
 }
 
+// withSelector adds a requirement to a (label or field) selector
+func withSelector(selector, requirement string) string {
+	if selector == "" || requirement == "" {
+		return selector + requirement
+	}
+	return selector + "," + requirement
+}
+
 func isExcluded(excluded []string, name string) bool {
 	lname := strings.ToLower(name)
 	for _, ctl := range excluded {
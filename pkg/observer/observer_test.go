@@ -13,12 +13,16 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	extv1beta1 "k8s.io/api/extensions/v1beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
 	_ "k8s.io/apimachinery/pkg/version"
 	fakediscovery "k8s.io/client-go/discovery/fake"
+	fakedynamic "k8s.io/client-go/dynamic/fake"
 	fakeclientset "k8s.io/client-go/kubernetes/fake"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
 	fakerest "k8s.io/client-go/rest/fake"
+	k8stesting "k8s.io/client-go/testing"
 	"k8s.io/client-go/tools/cache"
 )
 
@@ -34,12 +38,18 @@ type mockCtrl struct{}
 func (m *mockCtrl) Start() {}
 func (m *mockCtrl) Stop()  {}
 
+func (m *mockCtrl) Synced() bool { return true }
+
 type mockFactory struct {
 	names []string
+	lws   map[string]cache.ListerWatcher
 }
 
 func (m *mockFactory) NewController(client cache.ListerWatcher, notifier event.Notifier, name string) controller.Interface {
 	m.names = append(m.names, name)
+	if m.lws != nil {
+		m.lws[name] = client
+	}
 	return &mockCtrl{}
 }
 
@@ -60,6 +70,7 @@ var emptyExclude = make([]string, 0)
 type resTest struct {
 	title     string
 	resources []*metav1.APIResourceList
+	include   []string
 	exclude   []string
 	expect    []string
 }
@@ -167,12 +178,59 @@ var resourcesTests = []resTest{
 			},
 		},
 	},
+
+	{
+		title:   "Only user included",
+		include: []string{"*.cert-manager.io", "apps/*", "core/v1/configmaps", "Secret"},
+		exclude: []string{"daemonset"},
+		expect:  []string{"certificate", "issuer", "deployment", "configmap", "secret"},
+		resources: []*metav1.APIResourceList{
+			{
+				GroupVersion: corev1.SchemeGroupVersion.String(),
+				APIResources: []metav1.APIResource{
+					{Name: "pods", Namespaced: true, Kind: "Pod", Verbs: stdVerbs},
+					{Name: "configmaps", Namespaced: true, Kind: "ConfigMap", Verbs: stdVerbs},
+					{Name: "secrets", Namespaced: true, Kind: "Secret", Verbs: stdVerbs},
+				},
+			},
+			{
+				GroupVersion: appsv1beta2.SchemeGroupVersion.String(),
+				APIResources: []metav1.APIResource{
+					{Name: "deployments", Namespaced: true, Kind: "Deployment", Verbs: stdVerbs},
+					{Name: "daemonsets", Namespaced: true, Kind: "DaemonSet", Verbs: stdVerbs},
+				},
+			},
+			{
+				GroupVersion: "acme.cert-manager.io/v1alpha2",
+				APIResources: []metav1.APIResource{
+					{Name: "issuers", Namespaced: true, Kind: "Issuer", Verbs: stdVerbs},
+				},
+			},
+			{
+				GroupVersion: "certs.cert-manager.io/v1alpha2",
+				APIResources: []metav1.APIResource{
+					{Name: "certificates", Namespaced: true, Kind: "Certificate", Verbs: stdVerbs},
+				},
+			},
+			{
+				GroupVersion: "example.com/v1",
+				APIResources: []metav1.APIResource{
+					{Name: "foos", Namespaced: true, Kind: "Foo", Verbs: stdVerbs},
+				},
+			},
+		},
+	},
 }
 
 func TestObserver(t *testing.T) {
 	for _, tt := range resourcesTests {
+		included, err := ParseKindPatterns(tt.include)
+		if err != nil {
+			t.Fatalf("%s failed: %v", tt.title, err)
+		}
+
 		factory := new(mockFactory)
-		obs := New(new(mockLog), new(mockClient), &mockNotifier{}, factory, tt.exclude)
+		obs := New(new(mockLog), new(mockClient), &mockNotifier{}, factory, included, tt.exclude, nil, nil)
 
 		client := fakeclientset.NewSimpleClientset()
 		fakeDiscovery, _ := client.Discovery().(*fakediscovery.FakeDiscovery)
@@ -213,7 +271,7 @@ func TestObserverDuplicas(t *testing.T) {
 	fakeDiscovery.Resources = duplicatesTest
 
 	factory := new(mockFactory)
-	obs := New(new(mockLog), new(mockClient), &mockNotifier{}, factory, make([]string, 0))
+	obs := New(new(mockLog), new(mockClient), &mockNotifier{}, factory, nil, make([]string, 0), nil, nil)
 	obs.discovery = fakeDiscovery
 	obs.Start()
 	err := obs.refresh()
@@ -243,7 +301,7 @@ func TestObserverRecoverFromDicoveryFailure(t *testing.T) {
 	}
 
 	factory := new(mockFactory)
-	obs := New(new(mockLog), new(mockClient), &mockNotifier{}, factory, make([]string, 0))
+	obs := New(new(mockLog), new(mockClient), &mockNotifier{}, factory, nil, make([]string, 0), nil, nil)
 
 	// failing discovery
 	obs.discovery.RESTClient().(*rest.RESTClient).Client = fakeClient.Client
@@ -262,3 +320,152 @@ func TestObserverRecoverFromDicoveryFailure(t *testing.T) {
 		t.Errorf("%s failed: expected %v actual %v", "Recover from failure", expected, factory.names)
 	}
 }
+
+func TestObserverNamespaces(t *testing.T) {
+	client := fakeclientset.NewSimpleClientset()
+	fakeDiscovery, _ := client.Discovery().(*fakediscovery.FakeDiscovery)
+	fakeDiscovery.Resources = []*metav1.APIResourceList{
+		{
+			GroupVersion: corev1.SchemeGroupVersion.String(),
+			APIResources: []metav1.APIResource{
+				{Name: "pods", Namespaced: true, Kind: "Pod", Verbs: stdVerbs},
+				{Name: "nodes", Namespaced: false, Kind: "Node", Verbs: stdVerbs},
+			},
+		},
+	}
+
+	namespaces, _ := controller.NewNamespaceFilter([]string{"prod"}, []string{"kube-system"})
+	factory := &mockFactory{lws: make(map[string]cache.ListerWatcher)}
+	obs := New(new(mockLog), new(mockClient), &mockNotifier{}, factory, nil, emptyExclude, nil, namespaces)
+	obs.discovery = fakeDiscovery
+	dyn := fakedynamic.NewSimpleDynamicClient(runtime.NewScheme())
+	obs.cpool = dyn
+
+	if err := obs.refresh(); err != nil {
+		t.Errorf("refresh failed: %v", err)
+	}
+
+	for _, name := range []string{"pod", "node"} {
+		_, _ = factory.lws[name].List(metav1.ListOptions{FieldSelector: "type=foo"})
+	}
+
+	actions := dyn.Actions()
+	if len(actions) != 2 {
+		t.Fatalf("expected 2 list actions, got %d", len(actions))
+	}
+
+	for _, action := range actions {
+		list := action.(k8stesting.ListAction)
+		fields := list.GetListRestrictions().Fields.String()
+		switch list.GetResource().Resource {
+		case "pods":
+			if list.GetNamespace() != "prod" || fields != "metadata.namespace!=kube-system,type=foo" {
+				t.Errorf("pods should only be listed from selected namespaces: %q %q", list.GetNamespace(), fields)
+			}
+		case "nodes":
+			if list.GetNamespace() != "" || fields != "type=foo" {
+				t.Errorf("cluster scoped resources shouldn't be restricted: %q %q", list.GetNamespace(), fields)
+			}
+		}
+	}
+}
+
+func TestKindPatterns(t *testing.T) {
+	for _, invalid := range [][]string{{"a/b/c/d"}, {"apps/"}, {"apps/[v1"}} {
+		if _, err := ParseKindPatterns(invalid); err == nil {
+			t.Errorf("ParseKindPatterns should fail on %v", invalid)
+		}
+	}
+
+	patterns, _ := ParseKindPatterns([]string{"extensions/v1beta1/ingresses"})
+	if !patterns[0].Match("extensions", "v1beta1", "Ingress", "ingresses") {
+		t.Error("group/version/resource patterns should match")
+	}
+	if patterns[0].Match("networking.k8s.io", "v1beta1", "Ingress", "ingresses") {
+		t.Error("patterns shouldn't match other groups")
+	}
+}
+
+type mockTransport struct {
+	accept []string
+}
+
+func (m *mockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	m.accept = append(m.accept, req.Header.Get("Accept"))
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+}
+
+func TestMetadataOnly(t *testing.T) {
+	rt := new(mockTransport)
+	mt := &metadataTransport{rt: rt}
+	for _, url := range []string{"http://localhost/api/v1/pods", "http://localhost/api/v1/pods?watch=true"} {
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set("Accept", "application/json")
+		_, _ = mt.RoundTrip(req)
+		if req.Header.Get("Accept") != "application/json" {
+			t.Error("metadataTransport shouldn't alter the original request")
+		}
+	}
+	if !reflect.DeepEqual(rt.accept, []string{metadataListAccept, metadataWatchAccept}) {
+		t.Errorf("metadataTransport should request PartialObjectMetadata, got %v", rt.accept)
+	}
+
+	client := fakeclientset.NewSimpleClientset()
+	fakeDiscovery, _ := client.Discovery().(*fakediscovery.FakeDiscovery)
+	fakeDiscovery.Resources = []*metav1.APIResourceList{
+		{
+			GroupVersion: corev1.SchemeGroupVersion.String(),
+			APIResources: []metav1.APIResource{
+				{Name: "pods", Namespaced: true, Kind: "Pod", Verbs: stdVerbs},
+			},
+		},
+	}
+
+	pod := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Pod",
+		"metadata": map[string]interface{}{
+			"name":            "foo",
+			"namespace":       "default",
+			"labels":          map[string]interface{}{"app": "foo"},
+			"ownerReferences": []interface{}{map[string]interface{}{"kind": "ReplicaSet", "name": "foo-123"}},
+			"uid":             "1234",
+		},
+		"spec": map[string]interface{}{"nodeName": "node1"},
+	}}
+
+	patterns, _ := ParseKindPatterns([]string{"pod"})
+	factory := &mockFactory{lws: make(map[string]cache.ListerWatcher)}
+	obs := New(new(mockLog), new(mockClient), &mockNotifier{}, factory, nil, emptyExclude, patterns, nil)
+	obs.discovery = fakeDiscovery
+	obs.mpool = fakedynamic.NewSimpleDynamicClient(runtime.NewScheme(), pod)
+
+	if err := obs.refresh(); err != nil {
+		t.Errorf("refresh failed: %v", err)
+	}
+
+	list, err := factory.lws["pod"].List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("failed to list pods metadata: %v", err)
+	}
+
+	items := list.(*unstructured.UnstructuredList).Items
+	if len(items) != 1 {
+		t.Fatalf("expected 1 pod, got %d", len(items))
+	}
+
+	expected := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Pod",
+		"metadata": map[string]interface{}{
+			"name":            "foo",
+			"namespace":       "default",
+			"labels":          map[string]interface{}{"app": "foo"},
+			"annotations":     map[string]interface{}{MetadataOnlyMarker: "true"},
+			"ownerReferences": []interface{}{map[string]interface{}{"kind": "ReplicaSet", "name": "foo-123"}},
+		},
+	}
+	if !reflect.DeepEqual(items[0].Object, expected) {
+		t.Errorf("metadata-only kinds should only keep metadata, got %v", items[0].Object)
+	}
+}
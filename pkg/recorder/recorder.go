@@ -1,5 +1,5 @@
 // Package recorder listen for event notifications from controllers,
-// and persists those events' content as files on disk.
+// and persists those events' content using a storage backend.
 package recorder
 
 import (
@@ -7,18 +7,35 @@ import (
 	"hash/crc64"
 	"os"
 	"path/filepath"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/spf13/afero"
-
 	"github.com/bpineau/katafygio/pkg/event"
+	"github.com/bpineau/katafygio/pkg/metrics"
+	"github.com/bpineau/katafygio/pkg/store"
 )
 
 var (
-	appFs      = afero.NewOsFs()
 	crc64Table = crc64.MakeTable(crc64.ECMA)
+
+	// heartbeatInterval is the pace at which an idle recorder reports it's alive
+	heartbeatInterval = 10 * time.Second
+
+	// workerQueueLen is the number of notifications queued for each worker
+	workerQueueLen = 16
+
+	// drainRecheck is the pace at which we check if the notifier is drained, on stop
+	drainRecheck = 100 * time.Millisecond
+
+	// MaxStall is how long the recorder may be stuck (eg. on a store
+	// operation) before it's considered failed
+	MaxStall = 10 * time.Minute
+
+	eventsCounter = metrics.NewCounter("katafygio_events_total",
+		"Number of events processed, by action.", "action")
+	errorsCounter = metrics.NewCounter("katafygio_store_errors_total",
+		"Number of failed store operations, by operation.", "operation")
 )
 
 type logger interface {
@@ -27,63 +44,141 @@ type logger interface {
 }
 
 // activeFiles will contain a list of active (present in cluster) objets; we'll
-// use that to periodically find and garbage collect stale objets in the git repos
+// use that to periodically find and garbage collect stale objets in the store
 // (ie. if some objects were delete from cluster while katafygio was not running),
 // and to skip already existing and unchanged files.
 type activeFiles map[string]uint64
 
-// Listener receive events from controllers and save them to disk as yaml files
+// Listener receive events from controllers and save them to a store as yaml files
 type Listener struct {
 	logger      logger
 	events      event.Notifier
+	store       store.Interface
 	actives     activeFiles
 	activesLock sync.RWMutex
-	localDir    string
+	gcLock      sync.RWMutex // prevent gc while workers save files
 	gcInterval  time.Duration
+	workers     int
 	dryRun      bool
+	heartbeat   int64 // unix nanoseconds, updated atomically
 	stopch      chan struct{}
 	donech      chan struct{}
 }
 
-// New creates a new event Listener
-func New(log logger, events event.Notifier, localDir string, gcInterval int, dryRun bool) *Listener {
+// New creates a new event Listener. Store operations are processed by a
+// pool of workers; notifications for a given object are always processed
+// in order, by the same worker.
+func New(log logger, events event.Notifier, st store.Interface, gcInterval int, workers int, dryRun bool) *Listener {
+	if workers < 1 {
+		workers = 1
+	}
+
 	return &Listener{
 		logger:     log,
 		events:     events,
+		store:      st,
 		actives:    activeFiles{},
-		localDir:   localDir,
 		dryRun:     dryRun,
 		gcInterval: time.Duration(gcInterval) * time.Second,
+		workers:    workers,
 		stopch:     make(chan struct{}),
 		donech:     make(chan struct{}),
 	}
 }
 
-// Start continuously receive events and saves them to disk as files
+// Start continuously receive events and saves them to the store
 func (w *Listener) Start() *Listener {
 	w.logger.Infof("Starting event recorder")
 
+	w.beat()
+
+	var wg sync.WaitGroup
+	queues := make([]chan event.Notification, w.workers)
+	for i := range queues {
+		queues[i] = make(chan event.Notification, workerQueueLen)
+		wg.Add(1)
+		go w.worker(queues[i], &wg)
+	}
+
 	go func() {
 		evCh := w.events.ReadChan()
 		gcTick := time.NewTicker(w.gcInterval)
 		defer gcTick.Stop()
+		beatTick := time.NewTicker(heartbeatInterval)
+		defer beatTick.Stop()
 		defer close(w.donech)
 
 		for {
 			select {
 			case <-w.stopch:
+				w.drain(evCh, queues)
+				for _, q := range queues {
+					close(q)
+				}
+				wg.Wait()
 				return
 			case ev := <-evCh:
-				w.processNextEvent(&ev)
+				w.dispatch(queues, ev)
 			case <-gcTick.C:
 				w.deleteObsoleteFiles()
+			case <-beatTick.C:
 			}
+			w.beat()
 		}
 	}()
 
 	return w
 }
 
+func (w *Listener) worker(queue <-chan event.Notification, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for ev := range queue {
+		w.gcLock.RLock()
+		w.processNextEvent(&ev)
+		w.gcLock.RUnlock()
+	}
+}
+
+// dispatch routes notifications to workers by object, to preserve ordering
+func (w *Listener) dispatch(queues []chan event.Notification, ev event.Notification) {
+	sum := crc64.Checksum([]byte(ev.Cluster+":"+ev.Kind+":"+ev.Key), crc64Table)
+	queues[sum%uint64(len(queues))] <- ev
+}
+
+// drain dispatches the notifications still buffered by the notifier, if any
+func (w *Listener) drain(evCh <-chan event.Notification, queues []chan event.Notification) {
+	buffered, ok := w.events.(interface{ Len() int })
+	if !ok {
+		return
+	}
+
+	for buffered.Len() > 0 {
+		select {
+		case ev := <-evCh:
+			w.dispatch(queues, ev)
+		case <-time.After(drainRecheck):
+		}
+	}
+}
+
+func (w *Listener) beat() {
+	atomic.StoreInt64(&w.heartbeat, time.Now().UnixNano())
+}
+
+// Alive returns an error when the recorder isn't draining events anymore
+func (w *Listener) Alive() error {
+	last := atomic.LoadInt64(&w.heartbeat)
+	if last == 0 {
+		return fmt.Errorf("recorder not started")
+	}
+
+	if stall := time.Since(time.Unix(0, last)); stall > MaxStall {
+		return fmt.Errorf("recorder stuck for %s", stall.Round(time.Second))
+	}
+
+	return nil
+}
+
 // Stop halts the recorder service
 func (w *Listener) Stop() {
 	w.logger.Infof("Stopping event recorder")
@@ -92,127 +187,112 @@ func (w *Listener) Stop() {
 }
 
 func (w *Listener) processNextEvent(ev *event.Notification) {
-	path, err := getPath(w.localDir, ev)
-	if err != nil {
-		w.logger.Errorf("failed to get %s path: %v", ev.Key, err)
-	}
+	var err error
+	path := ObjectPath(ev)
 
+	var changed bool
 	switch ev.Action {
 	case event.Upsert:
-		err = w.save(path, ev.Object)
+		eventsCounter.Inc("upsert")
+		if changed, err = w.save(path, ev.Object); err != nil {
+			errorsCounter.Inc("save")
+		}
 	case event.Delete:
-		err = w.remove(path)
+		eventsCounter.Inc("delete")
+		if changed, err = w.remove(path); err != nil {
+			errorsCounter.Inc("remove")
+		}
 	}
 
 	if err != nil {
 		w.logger.Errorf("failed to delete or save %s: %v", ev.Key, err)
+		return
 	}
-}
-
-func getPath(root string, ev *event.Notification) (string, error) {
-	filename := ev.Kind + "-" + filepath.Base(ev.Key) + ".yaml"
 
-	dir, err := filepath.Abs(filepath.Dir(root + "/" + ev.Key))
-	if err != nil {
-		return "", err
+	if journal, ok := w.store.(store.Journal); ok && changed {
+		journal.Record(path, ev)
 	}
+}
 
-	return dir + "/" + filename, nil
+// ObjectPath returns an object's store key: a file path relative to the dump
+// directory. Objects from named clusters are stored in a per-cluster directory.
+func ObjectPath(ev *event.Notification) string {
+	filename := ev.Kind + "-" + filepath.Base(ev.Key) + ".yaml"
+	return filepath.Join(ev.Cluster, filepath.Dir(ev.Key), filename)
 }
 
-func (w *Listener) remove(file string) error {
+func (w *Listener) remove(key string) (bool, error) {
 	if w.dryRun {
-		return nil
+		return false, nil
 	}
 
 	w.activesLock.Lock()
-	delete(w.actives, file)
+	_, saved := w.actives[key]
+	delete(w.actives, key)
 	w.activesLock.Unlock()
-	return appFs.Remove(filepath.Clean(file))
-}
 
-func (w *Listener) relativePath(file string) string {
-	root := filepath.Clean(w.localDir)
-	return strings.Replace(file, root+"/", "", 1)
+	err := w.store.Remove(key)
+	if !saved && os.IsNotExist(err) {
+		// eg. excluded objects: we have no file to remove. Still, we try to, as
+		// the file may be left over from a run that missed the object deletion.
+		return false, nil
+	}
+
+	return err == nil, err
 }
 
-func (w *Listener) save(file string, data []byte) error {
+// save stores an object, unless it's unchanged since it was last saved
+func (w *Listener) save(key string, data []byte) (bool, error) {
 	if w.dryRun {
-		return nil
+		return false, nil
 	}
 
 	csum := crc64.Checksum(data, crc64Table)
 
 	w.activesLock.RLock()
-	prevsum, ok := w.actives[w.relativePath(file)]
+	prevsum, ok := w.actives[key]
 	w.activesLock.RUnlock()
 	if ok && prevsum == csum {
-		return nil
-	}
-
-	dir := filepath.Clean(filepath.Dir(file))
-
-	err := appFs.MkdirAll(dir, 0700)
-	if err != nil {
-		return fmt.Errorf("can't create local directory %s: %v", dir, err)
+		return false, nil
 	}
 
-	tmpf, err := afero.TempFile(appFs, dir, ".temp-katafygio-")
-	if err != nil {
-		return fmt.Errorf("failed to create a temporary file: %v", err)
-	}
-
-	_, err = tmpf.Write(data)
-	if err != nil {
-		return fmt.Errorf("failed to write to %s on disk: %v", tmpf.Name(), err)
-	}
-
-	if err := tmpf.Close(); err != nil {
-		return fmt.Errorf("failed to close a temporary file: %v", err)
-	}
-
-	if err := appFs.Rename(tmpf.Name(), file); err != nil {
-		return fmt.Errorf("failed to rename %s to %s: %v", tmpf.Name(), file, err)
+	if err := w.store.Save(key, data); err != nil {
+		return false, err
 	}
 
 	w.activesLock.Lock()
-	w.actives[w.relativePath(file)] = csum
+	w.actives[key] = csum
 	w.activesLock.Unlock()
 
-	return nil
+	return true, nil
 }
 
 func (w *Listener) deleteObsoleteFiles() {
+	w.gcLock.Lock()
+	defer w.gcLock.Unlock()
+
 	w.activesLock.RLock()
 	defer w.activesLock.RUnlock()
-	root := filepath.Clean(w.localDir)
 
-	err := afero.Walk(appFs, root, func(path string, info os.FileInfo, err error) error {
-		if info == nil {
-			return fmt.Errorf("can't stat %s", path)
-		}
-
-		if info.IsDir() {
-			return nil
-		}
+	keys, err := w.store.List()
+	if err != nil {
+		errorsCounter.Inc("list")
+		w.logger.Errorf("failed to list stored objects: %v", err)
+		return
+	}
 
-		if !strings.HasSuffix(path, "yaml") {
-			return nil
+	for _, key := range keys {
+		if _, ok := w.actives[key]; ok {
+			continue
 		}
 
-		_, ok := w.actives[w.relativePath(path)]
-		if ok {
-			return nil
+		if w.dryRun {
+			continue
 		}
 
-		if !w.dryRun {
-			return appFs.Remove(filepath.Clean(path))
+		if err := w.store.Remove(key); err != nil {
+			errorsCounter.Inc("remove")
+			w.logger.Errorf("failed to gc %s: %v", key, err)
 		}
-
-		return nil
-	})
-
-	if err != nil {
-		w.logger.Errorf("failed to gc some files: %v", err)
 	}
 }
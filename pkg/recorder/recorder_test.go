@@ -1,12 +1,17 @@
 package recorder
 
 import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
-	"github.com/spf13/afero"
-
 	"github.com/bpineau/katafygio/pkg/event"
+	"github.com/bpineau/katafygio/pkg/metrics"
 )
 
 type mockLog struct{}
@@ -14,6 +19,66 @@ type mockLog struct{}
 func (m *mockLog) Infof(format string, args ...interface{})  {}
 func (m *mockLog) Errorf(format string, args ...interface{}) {}
 
+// mockStore is an in-memory store.Interface, that can be switched to failure mode
+type mockStore struct {
+	sync.Mutex
+	files   map[string][]byte
+	failing bool
+}
+
+func newMockStore() *mockStore {
+	return &mockStore{files: make(map[string][]byte)}
+}
+
+func (m *mockStore) Start() error                      { return nil }
+func (m *mockStore) Stop()                             {}
+func (m *mockStore) Commit() (changed bool, err error) { return false, nil }
+
+func (m *mockStore) Save(key string, data []byte) error {
+	m.Lock()
+	defer m.Unlock()
+	if m.failing {
+		return fmt.Errorf("read-only store")
+	}
+	m.files[key] = data
+	return nil
+}
+
+func (m *mockStore) Remove(key string) error {
+	m.Lock()
+	defer m.Unlock()
+	if m.failing {
+		return fmt.Errorf("read-only store")
+	}
+	if _, ok := m.files[key]; !ok {
+		return &os.PathError{Op: "remove", Path: key, Err: os.ErrNotExist}
+	}
+	delete(m.files, key)
+	return nil
+}
+
+func (m *mockStore) List() ([]string, error) {
+	m.Lock()
+	defer m.Unlock()
+	if m.failing {
+		return nil, fmt.Errorf("unreachable store")
+	}
+	var keys []string
+	for k := range m.files {
+		if strings.HasSuffix(k, ".yaml") {
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
+
+func (m *mockStore) exists(key string) bool {
+	m.Lock()
+	defer m.Unlock()
+	_, ok := m.files[key]
+	return ok
+}
+
 func newNotif(action event.Action, key string) *event.Notification {
 	return &event.Notification{
 		Action: action,
@@ -23,90 +88,101 @@ func newNotif(action event.Action, key string) *event.Notification {
 	}
 }
 
-var (
-	logs    = new(mockLog)
-	fakedir = "/tmp/ktest"
-)
+var logs = new(mockLog)
 
 func TestRecorder(t *testing.T) {
-	appFs = afero.NewMemMapFs()
+	st := newMockStore()
 
 	evt := event.New()
 
-	rec := New(logs, evt, fakedir, 120, false).Start()
+	rec := New(logs, evt, st, 120, 1, false).Start()
 
 	evt.Send(newNotif(event.Upsert, "foo1"))
 	evt.Send(newNotif(event.Upsert, "foo2"))
 	evt.Send(newNotif(event.Delete, "foo1"))
 	evt.Send(newNotif(event.Upsert, "foo2"))
+	evt.Send(newNotif(event.Upsert, "ns1/foo3"))
 
-	rec.Stop() // to flush ongoing fs operations
+	rec.Stop() // to flush ongoing store operations
 
-	exist, _ := afero.Exists(appFs, fakedir+"/foo-foo2.yaml")
-	if !exist {
+	if !st.exists("foo-foo2.yaml") {
 		t.Error("foo-foo2.yaml should exist; upsert event didn't propagate")
 	}
 
-	exist, _ = afero.Exists(appFs, fakedir+"/foo-foo1.yaml")
-	if exist {
+	if !st.exists("ns1/foo-foo3.yaml") {
+		t.Error("ns1/foo-foo3.yaml should exist; namespaced objects should be saved in a sub directory")
+	}
+
+	if st.exists("foo-foo1.yaml") {
 		t.Error("foo-foo1.yaml shouldn't exist, delete event didn't propagate")
 	}
 
-	rogue := fakedir + "/roguefile.yaml"
-	_ = afero.WriteFile(appFs, rogue, []byte{42}, 0600)
-	_ = afero.WriteFile(appFs, rogue+".txt", []byte{42}, 0600)
+	rogue := "roguefile.yaml"
+	_ = st.Save(rogue, []byte{42})
+	_ = st.Save(rogue+".txt", []byte{42})
 	rec.deleteObsoleteFiles()
 
-	exist, _ = afero.Exists(appFs, rogue)
-	if exist {
+	if st.exists(rogue) {
 		t.Errorf("%s file should have been garbage collected", rogue)
 	}
 
-	exist, _ = afero.Exists(appFs, rogue+".txt")
-	if !exist {
+	if !st.exists(rogue + ".txt") {
 		t.Errorf("garbage collection should only touch .yaml files")
 	}
 }
 
+func TestRecorderStaleFile(t *testing.T) {
+	st := newMockStore()
+	_ = st.Save("foo-foo1.yaml", []byte{42}) // left by a previous run
+
+	evt := event.New()
+	rec := New(logs, evt, st, 120, 1, false).Start()
+	evt.Send(newNotif(event.Delete, "foo1"))
+	evt.Send(newNotif(event.Delete, "foo2")) // no file to remove
+	rec.Stop()
+
+	if st.exists("foo-foo1.yaml") {
+		t.Error("foo-foo1.yaml should have been removed on delete, though it was saved by a previous run")
+	}
+}
+
 func TestDryRunRecorder(t *testing.T) {
-	appFs = afero.NewMemMapFs()
+	st := newMockStore()
 
 	dryevt := event.New()
-	dryrec := New(logs, dryevt, fakedir, 60, true).Start()
+	dryrec := New(logs, dryevt, st, 60, 1, true).Start()
 	dryevt.Send(newNotif(event.Upsert, "foo3"))
 	dryevt.Send(newNotif(event.Upsert, "foo4"))
 	dryevt.Send(newNotif(event.Delete, "foo4"))
 	dryrec.Stop()
 
-	exist, _ := afero.Exists(appFs, fakedir+"/foo-foo3.yaml")
-	if exist {
+	if st.exists("foo-foo3.yaml") {
 		t.Error("foo-foo3.yaml was created but we're in dry-run mode")
 	}
 
-	rogue := fakedir + "/roguefile.yaml"
-	_ = afero.WriteFile(appFs, rogue, []byte{42}, 0600)
+	rogue := "roguefile.yaml"
+	_ = st.Save(rogue, []byte{42})
 	dryrec.deleteObsoleteFiles()
 
-	exist, _ = afero.Exists(appFs, rogue)
-	if !exist {
+	if !st.exists(rogue) {
 		t.Errorf("garbage collection shouldn't remove files in dry-run mode")
 	}
 }
 
-// testing behavior on fs errors (we shouldn't block the program)
-func TestFailingFSRecorder(t *testing.T) {
-	appFs = afero.NewMemMapFs()
+// testing behavior on store errors (we shouldn't block the program)
+func TestFailingStoreRecorder(t *testing.T) {
+	st := newMockStore()
 
 	evt := event.New()
 
-	rec := New(logs, evt, fakedir, 60, false).Start()
+	rec := New(logs, evt, st, 60, 1, false).Start()
 
-	_ = afero.WriteFile(appFs, fakedir+"/foo.yaml", []byte{42}, 0600)
+	_ = st.Save("foo.yaml", []byte{42})
 
-	// switching to failing (read-only) filesystem
-	appFs = afero.NewReadOnlyFs(appFs)
+	// switching to failing (read-only) store
+	st.failing = true
 
-	err := rec.save("foo", []byte("bar"))
+	_, err := rec.save("foo", []byte("bar"))
 	if err == nil {
 		t.Error("save should return an error in case of failure")
 	}
@@ -125,20 +201,116 @@ func TestFailingFSRecorder(t *testing.T) {
 	select {
 	case <-ch:
 	case <-time.After(5 * time.Second):
-		t.Error("recorder shouldn't block in case of fs failure")
+		t.Error("recorder shouldn't block in case of store failure")
 	}
 
 	// back to normal operations
-	rec.Stop() // just to flush ongoing ops before switch filesystem
-	appFs = afero.NewMemMapFs()
+	rec.Stop() // just to flush ongoing ops before switching the store back
+
+	var buf bytes.Buffer
+	_ = metrics.Write(&buf)
+	if !strings.Contains(buf.String(), `katafygio_store_errors_total{operation="save"} 2`) {
+		t.Errorf("store errors weren't accounted: %s", buf.String())
+	}
+
+	st.failing = false
 	rec.stopch = make(chan struct{})
 	rec.donech = make(chan struct{})
 	rec.Start()
 	evt.Send(newNotif(event.Upsert, "foo2"))
+	evt.Send(newNotif(event.Upsert, "foo3"))
 	rec.Stop() // flush ongoing ops
 
-	exist, _ := afero.Exists(appFs, fakedir+"/foo-foo2.yaml")
-	if !exist {
-		t.Error("foo-foo2.yaml should exist; recorder should recover from fs failures")
+	if !st.exists("foo-foo2.yaml") || !st.exists("foo-foo3.yaml") {
+		t.Error("foo-foo2.yaml should exist; recorder should recover from store failures")
+	}
+}
+
+func TestObjectPath(t *testing.T) {
+	for key, expected := range map[string]string{
+		"ns1/bar": "ns1/foo-bar.yaml",
+		"bar":     "foo-bar.yaml",
+	} {
+		if path := ObjectPath(newNotif(event.Upsert, key)); path != expected {
+			t.Errorf("ObjectPath failed: expected %s actual %s", expected, path)
+		}
+	}
+
+	notif := newNotif(event.Upsert, "ns1/bar")
+	notif.Cluster = "prod"
+	if path := ObjectPath(notif); path != "prod/ns1/foo-bar.yaml" {
+		t.Errorf("clusters objects should be stored in a cluster directory, got %s", path)
+	}
+}
+
+func TestRecorderWorkers(t *testing.T) {
+	st := newMockStore()
+	evt := event.NewCoalescing(100)
+	rec := New(logs, evt, st, 120, 4, false).Start()
+
+	for i := 0; i < 50; i++ {
+		evt.Send(newNotif(event.Upsert, fmt.Sprintf("ns/obj%d", i)))
+		evt.Send(newNotif(event.Delete, fmt.Sprintf("ns/obj%d", i)))
+		if i%2 == 0 {
+			evt.Send(newNotif(event.Upsert, fmt.Sprintf("ns/obj%d", i)))
+		}
+	}
+
+	rec.Stop() // should drain the buffered notifications
+
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("ns/foo-obj%d.yaml", i)
+		if st.exists(key) != (i%2 == 0) {
+			t.Errorf("%s existence doesn't match the last notification", key)
+		}
+	}
+}
+
+func TestRecorderAlive(t *testing.T) {
+	rec := New(logs, event.New(), newMockStore(), 60, 1, false)
+	if rec.Alive() == nil {
+		t.Error("a recorder that wasn't started shouldn't be alive")
+	}
+
+	rec.Start()
+	defer rec.Stop()
+
+	if err := rec.Alive(); err != nil {
+		t.Errorf("a started recorder should be alive: %v", err)
+	}
+
+	atomic.StoreInt64(&rec.heartbeat, time.Now().Add(-2*MaxStall).UnixNano())
+	if rec.Alive() == nil {
+		t.Error("a stuck recorder shouldn't be alive")
+	}
+}
+
+// mockJournal records the changes reported to a store.Journal
+type mockJournal struct {
+	*mockStore
+	recorded []string
+}
+
+func (m *mockJournal) Record(key string, ev *event.Notification) {
+	m.Lock()
+	defer m.Unlock()
+	m.recorded = append(m.recorded, key)
+}
+
+func TestRecorderJournal(t *testing.T) {
+	st := &mockJournal{mockStore: newMockStore()}
+	evt := event.New()
+	rec := New(logs, evt, st, 120, 1, false).Start()
+
+	evt.Send(newNotif(event.Upsert, "foo1"))
+	evt.Send(newNotif(event.Upsert, "foo1")) // unchanged
+	evt.Send(newNotif(event.Delete, "foo2")) // never saved
+	evt.Send(newNotif(event.Delete, "foo1"))
+
+	rec.Stop()
+
+	expected := []string{"foo-foo1.yaml", "foo-foo1.yaml"}
+	if fmt.Sprint(st.recorded) != fmt.Sprint(expected) {
+		t.Errorf("only actual changes should be journaled: expected %v, got %v", expected, st.recorded)
 	}
 }
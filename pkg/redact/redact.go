@@ -0,0 +1,203 @@
+// Package redact replaces sensitive values of the dumped objects (eg.
+// passwords embedded in ConfigMaps) with a placeholder derived from a hash
+// of the value. The placeholder is stable, so diffs still show that a value
+// changed, without leaking it.
+package redact
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/bpineau/katafygio/pkg/fieldpath"
+)
+
+var placeholderRegex = regexp.MustCompile(`<redacted:[0-9a-f]{16}>`)
+
+// Rule selects the values to redact
+type Rule struct {
+	// Kind is a lowercase kind name, or "*" for all kinds
+	Kind string
+
+	// Path selects the fields to redact. Maps and lists have all their
+	// values redacted.
+	Path *fieldpath.Path
+
+	// Regex, when not nil, restricts the redaction to the parts of string
+	// values matching the regex (or to its first capturing group, if any).
+	Regex *regexp.Regexp
+}
+
+// ParseRule parses a "kind:path[:regex]" rule. Eg.:
+// "secret:data.*", "*:metadata.annotations["example.com/token"]",
+// or "configmap:data.*:password=(\S+)".
+func ParseRule(rule string) (*Rule, error) {
+	parts := strings.SplitN(rule, ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return nil, fmt.Errorf("invalid redaction rule %s: expecting kind:path[:regex]", rule)
+	}
+
+	path, regex := splitPath(parts[1])
+	p, err := fieldpath.Parse(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redaction rule %s: %v", rule, err)
+	}
+
+	r := &Rule{Kind: strings.ToLower(parts[0]), Path: p}
+	if regex != "" {
+		if r.Regex, err = regexp.Compile(regex); err != nil {
+			return nil, fmt.Errorf("invalid redaction rule %s: %v", rule, err)
+		}
+	}
+
+	return r, nil
+}
+
+// splitPath splits "path:regex" on the first colon outside of quoted keys
+func splitPath(s string) (string, string) {
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quoted:
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == ':' && !quoted:
+			return s[:i], s[i+1:]
+		}
+	}
+	return s, ""
+}
+
+// Redactor applies redaction rules to objects
+type Redactor struct {
+	rules []*Rule
+	key   []byte
+}
+
+// New returns a Redactor. When key isn't empty, placeholders are keyed
+// hashes (HMAC) of the values, which can't be brute-forced without the key.
+func New(rules []*Rule, key []byte) *Redactor {
+	return &Redactor{rules: rules, key: key}
+}
+
+// Transform redacts the object's values matching the rules, in place
+func (r *Redactor) Transform(obj *unstructured.Unstructured) error {
+	kind := strings.ToLower(obj.GetKind())
+
+	for _, rule := range r.rules {
+		if rule.Kind != "*" && rule.Kind != kind {
+			continue
+		}
+
+		rule.Path.Update(obj.Object, func(value interface{}) interface{} {
+			return r.redact(value, rule.Regex)
+		})
+	}
+
+	return nil
+}
+
+func (r *Redactor) redact(value interface{}, re *regexp.Regexp) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = r.redact(item, re)
+		}
+		return v
+
+	case []interface{}:
+		for i, item := range v {
+			v[i] = r.redact(item, re)
+		}
+		return v
+
+	case nil:
+		return nil
+
+	case string:
+		if re != nil {
+			return r.redactMatches(v, re)
+		}
+		return r.placeholder(v)
+	}
+
+	if re != nil {
+		// regexes only apply to strings
+		return value
+	}
+
+	return r.placeholder(fmt.Sprint(value))
+}
+
+func (r *Redactor) redactMatches(value string, re *regexp.Regexp) string {
+	var b strings.Builder
+	last := 0
+
+	for _, m := range re.FindAllStringSubmatchIndex(value, -1) {
+		start, end := m[0], m[1]
+		if len(m) > 2 && m[2] >= 0 {
+			// redact the first capturing group only
+			start, end = m[2], m[3]
+		}
+
+		b.WriteString(value[last:start])
+		b.WriteString(r.placeholder(value[start:end]))
+		last = end
+	}
+
+	b.WriteString(value[last:])
+	return b.String()
+}
+
+// placeholder returns a stable, non reversible, replacement for a value
+func (r *Redactor) placeholder(value string) string {
+	var sum []byte
+	if len(r.key) > 0 {
+		mac := hmac.New(sha256.New, r.key)
+		_, _ = mac.Write([]byte(value))
+		sum = mac.Sum(nil)
+	} else {
+		s := sha256.Sum256([]byte(value))
+		sum = s[:]
+	}
+
+	return "<redacted:" + hex.EncodeToString(sum[:8]) + ">"
+}
+
+// Redacted returns the paths of the fields holding redaction placeholders
+func Redacted(obj map[string]interface{}) []string {
+	var paths []string
+	findRedacted("", obj, &paths)
+	sort.Strings(paths)
+	return paths
+}
+
+func findRedacted(path string, value interface{}, paths *[]string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			key := k
+			if path != "" {
+				key = path + "." + k
+			}
+			findRedacted(key, item, paths)
+		}
+
+	case []interface{}:
+		for i, item := range v {
+			findRedacted(fmt.Sprintf("%s[%d]", path, i), item, paths)
+		}
+
+	case string:
+		if placeholderRegex.MatchString(v) {
+			*paths = append(*paths, path)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package redact
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ghodss/yaml"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func newObj(kind, password string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"kind": kind,
+		"metadata": map[string]interface{}{
+			"name":        "foo",
+			"annotations": map[string]interface{}{"example.com/token": "t0k3n"},
+		},
+		"data": map[string]interface{}{
+			"app.conf": "user=admin\npassword=" + password + "\n",
+			"plain":    "nothing to hide",
+		},
+		"spec": map[string]interface{}{"port": int64(42)},
+	}}
+}
+
+func mustParse(t *testing.T, rules ...string) []*Rule {
+	var parsed []*Rule
+	for _, rule := range rules {
+		r, err := ParseRule(rule)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %v", rule, err)
+		}
+		parsed = append(parsed, r)
+	}
+	return parsed
+}
+
+func dump(t *testing.T, obj *unstructured.Unstructured) string {
+	yml, err := yaml.Marshal(obj)
+	if err != nil {
+		t.Fatalf("failed to marshal: %v", err)
+	}
+	return string(yml)
+}
+
+func TestRedact(t *testing.T) {
+	rules := mustParse(t,
+		`configmap:data.*:password=(\S+)`,
+		`*:metadata.annotations["example.com/token"]`,
+		`configmap:spec`,
+	)
+	red := New(rules, []byte("key"))
+
+	obj := newObj("ConfigMap", "hunter2")
+	_ = red.Transform(obj)
+	yml := dump(t, obj)
+
+	for _, leak := range []string{"hunter2", "t0k3n", "42"} {
+		if strings.Contains(yml, leak) {
+			t.Errorf("%s wasn't redacted:\n%s", leak, yml)
+		}
+	}
+
+	for _, kept := range []string{"user=admin", "password=<redacted:", "nothing to hide", "name: foo"} {
+		if !strings.Contains(yml, kept) {
+			t.Errorf("%s should be kept:\n%s", kept, yml)
+		}
+	}
+
+	// placeholders are stable, and change with the value
+	same := newObj("ConfigMap", "hunter2")
+	_ = red.Transform(same)
+	if dump(t, same) != yml {
+		t.Error("redacting the same value should yield the same placeholder")
+	}
+
+	changed := newObj("ConfigMap", "hunter3")
+	_ = red.Transform(changed)
+	if dump(t, changed) == yml {
+		t.Error("redacting a distinct value should yield a distinct placeholder")
+	}
+
+	unkeyed := newObj("ConfigMap", "hunter2")
+	_ = New(rules, nil).Transform(unkeyed)
+	if dump(t, unkeyed) == yml {
+		t.Error("keyed and unkeyed placeholders should differ")
+	}
+
+	// rules only apply to their kind
+	other := newObj("Foo", "hunter2")
+	_ = red.Transform(other)
+	if !strings.Contains(dump(t, other), "hunter2") || strings.Contains(dump(t, other), "t0k3n") {
+		t.Errorf("rules should apply to their kinds only:\n%s", dump(t, other))
+	}
+
+	// redacted fields are spotted (eg. to refuse restoring them)
+	if paths := Redacted(other.Object); len(paths) != 1 || paths[0] != "metadata.annotations.example.com/token" {
+		t.Errorf("redacted fields not found: %v", paths)
+	}
+	if paths := Redacted(newObj("Foo", "hunter2").Object); len(paths) != 0 {
+		t.Errorf("unredacted objects shouldn't hold redacted fields: %v", paths)
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	r, err := ParseRule(`Secret:metadata.annotations["a:b"]:x:y`)
+	if err != nil || r.Kind != "secret" || r.Path.String() != `metadata.annotations["a:b"]` || r.Regex.String() != "x:y" {
+		t.Errorf("failed to parse a rule: %+v (%v)", r, err)
+	}
+
+	for _, rule := range []string{"", "secret", ":data", "secret:", "secret:data..x", "secret:data:(("} {
+		if _, err := ParseRule(rule); err == nil {
+			t.Errorf("parsing %q should fail", rule)
+		}
+	}
+}
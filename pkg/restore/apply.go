@@ -0,0 +1,116 @@
+package restore
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/restmapper"
+)
+
+var (
+	// FieldManager is the server-side apply manager name we use
+	FieldManager = "katafygio"
+
+	// newly created CRDs may take a moment to be served by the api-server
+	noMatchRetries  = 5
+	noMatchInterval = 2 * time.Second
+
+	// attributes that change on every write, ignored when comparing objects
+	volatile = []string{"resourceVersion", "generation", "managedFields"}
+)
+
+type dynamicApplier struct {
+	client dynamic.Interface
+	mapper *restmapper.DeferredDiscoveryRESTMapper
+}
+
+func newDynamicApplier(client restclient) *dynamicApplier {
+	disco := discovery.NewDiscoveryClientForConfigOrDie(client.GetRestConfig())
+	return &dynamicApplier{
+		client: dynamic.NewForConfigOrDie(client.GetRestConfig()),
+		mapper: restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(disco)),
+	}
+}
+
+func (a *dynamicApplier) resourceFor(obj *unstructured.Unstructured) (dynamic.ResourceInterface, error) {
+	gvk := obj.GroupVersionKind()
+
+	mapping, err := a.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	for i := 0; meta.IsNoMatchError(err) && i < noMatchRetries; i++ {
+		// maybe a CRD we just restored: refresh the discovery cache
+		time.Sleep(noMatchInterval)
+		a.mapper.Reset()
+		mapping, err = a.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unknown resource kind %s: %v", gvk, err)
+	}
+
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+		return a.client.Resource(mapping.Resource).Namespace(obj.GetNamespace()), nil
+	}
+
+	return a.client.Resource(mapping.Resource), nil
+}
+
+// Apply server-side applies an object, and tells wether it was created, updated or left as is
+func (a *dynamicApplier) Apply(obj *unstructured.Unstructured, dryRun bool) (Action, error) {
+	ri, err := a.resourceFor(obj)
+	if err != nil {
+		return Failed, err
+	}
+
+	existing, err := ri.Get(obj.GetName(), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		existing = nil
+	} else if err != nil {
+		return Failed, fmt.Errorf("failed to get current object: %v", err)
+	}
+
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return Failed, fmt.Errorf("failed to serialize: %v", err)
+	}
+
+	force := true
+	opts := metav1.PatchOptions{FieldManager: FieldManager, Force: &force}
+	if dryRun {
+		opts.DryRun = []string{metav1.DryRunAll}
+	}
+
+	applied, err := ri.Patch(obj.GetName(), types.ApplyPatchType, data, opts)
+	if err != nil {
+		return Failed, fmt.Errorf("failed to apply: %v", err)
+	}
+
+	if existing == nil {
+		return Created, nil
+	}
+
+	if equivalent(existing, applied) {
+		return Skipped, nil
+	}
+
+	return Updated, nil
+}
+
+func equivalent(a, b *unstructured.Unstructured) bool {
+	a, b = a.DeepCopy(), b.DeepCopy()
+	for _, obj := range []*unstructured.Unstructured{a, b} {
+		for _, attr := range volatile {
+			unstructured.RemoveNestedField(obj.Object, "metadata", attr)
+		}
+	}
+
+	return equality.Semantic.DeepEqual(a.Object, b.Object)
+}
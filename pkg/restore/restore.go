@@ -0,0 +1,318 @@
+// Package restore reads back the yaml files dumped by the recorder, sorts
+// them so that objects are created after the objects they depend on (ie.
+// namespaces and CRDs before namespaced objects and custom resources), and
+// server-side applies them to a cluster.
+package restore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/spf13/afero"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/rest"
+
+	"github.com/bpineau/katafygio/pkg/observer"
+	"github.com/bpineau/katafygio/pkg/redact"
+)
+
+var appFs = afero.NewOsFs()
+
+// Action is the outcome of an object restoration
+type Action int
+
+const (
+	// Failed means the object couldn't be restored
+	Failed Action = iota
+
+	// Created means the object didn't exist in the cluster
+	Created
+
+	// Updated means the object existed but differed from the backup
+	Updated
+
+	// Skipped means the object was already up to date in the cluster
+	Skipped
+)
+
+func (a Action) String() string {
+	switch a {
+	case Created:
+		return "created"
+	case Updated:
+		return "updated"
+	case Skipped:
+		return "skipped"
+	default:
+		return "failed"
+	}
+}
+
+// Result reports an object restoration outcome
+type Result struct {
+	Path   string
+	Object *unstructured.Unstructured
+	Action Action
+	Err    error
+}
+
+// String returns a "kind namespace/name" representation of the restored object
+func (r *Result) String() string {
+	if r.Object == nil {
+		return r.Path
+	}
+
+	name := r.Object.GetName()
+	if ns := r.Object.GetNamespace(); ns != "" {
+		name = ns + "/" + name
+	}
+
+	return strings.ToLower(r.Object.GetKind()) + " " + name
+}
+
+type logger interface {
+	Infof(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+type restclient interface {
+	GetRestConfig() *rest.Config
+}
+
+// applier submit an object to the cluster
+type applier interface {
+	Apply(obj *unstructured.Unstructured, dryRun bool) (Action, error)
+}
+
+// Decrypter decrypts the objects that were encrypted at backup time
+type Decrypter interface {
+	Decrypt(obj *unstructured.Unstructured) error
+}
+
+// Restorer re-applies backed up objects to a cluster
+type Restorer struct {
+	logger     logger
+	applier    applier
+	decrypter  Decrypter
+	dryRun     bool
+	namespaces []string
+	kinds      []string
+}
+
+// New returns a Restorer. When not empty, namespaces and kinds restrict
+// the restoration to the objects matching those. The decrypter may be
+// nil, in which case encrypted objects fail to restore.
+func New(log logger, client restclient, dec Decrypter, dryRun bool, namespaces, kinds []string) *Restorer {
+	return &Restorer{
+		logger:     log,
+		applier:    newDynamicApplier(client),
+		decrypter:  dec,
+		dryRun:     dryRun,
+		namespaces: namespaces,
+		kinds:      kinds,
+	}
+}
+
+// ReadDir collects the yaml files content from a local directory, but for
+// hidden directories (eg. .git)
+func ReadDir(root string) (map[string][]byte, error) {
+	root = filepath.Clean(root)
+	files := make(map[string][]byte)
+
+	err := afero.Walk(appFs, root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			if path != root && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !strings.HasSuffix(path, ".yaml") {
+			return nil
+		}
+
+		data, err := afero.ReadFile(appFs, path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", path, err)
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		files[rel] = data
+		return nil
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", root, err)
+	}
+
+	return files, nil
+}
+
+// Restore applies the provided files (a map of paths to yaml content), in
+// dependency order, and returns a per-object report.
+func (r *Restorer) Restore(files map[string][]byte) []*Result {
+	var results, pending []*Result
+
+	for path, data := range files {
+		obj := new(unstructured.Unstructured)
+		if err := yaml.Unmarshal(data, &obj.Object); err != nil {
+			results = append(results, &Result{Path: path, Action: Failed,
+				Err: fmt.Errorf("failed to decode: %v", err)})
+			continue
+		}
+
+		if obj.Object == nil || obj.GetKind() == "" || obj.GetName() == "" {
+			results = append(results, &Result{Path: path, Action: Failed,
+				Err: fmt.Errorf("not a kubernetes object")})
+			continue
+		}
+
+		if !r.selected(obj) {
+			continue
+		}
+
+		if obj.GetAnnotations()[observer.MetadataOnlyMarker] == "true" {
+			r.logger.Infof("skipping %s: only its metadata were saved", &Result{Path: path, Object: obj})
+			continue
+		}
+
+		if _, encrypted := obj.Object["sops"]; encrypted {
+			if err := r.decrypt(obj); err != nil {
+				results = append(results, &Result{Path: path, Object: obj, Action: Failed, Err: err})
+				continue
+			}
+		}
+
+		// applying redaction placeholders would overwrite the real values
+		if paths := redact.Redacted(obj.Object); len(paths) > 0 {
+			results = append(results, &Result{Path: path, Object: obj, Action: Failed,
+				Err: fmt.Errorf("holds redacted values (%s), restore it manually", strings.Join(paths, ", "))})
+			continue
+		}
+
+		pending = append(pending, &Result{Path: path, Object: obj})
+	}
+
+	sortByDependencies(pending)
+
+	for _, res := range pending {
+		res.Action, res.Err = r.applier.Apply(res.Object, r.dryRun)
+		if res.Err != nil {
+			res.Action = Failed
+			r.logger.Errorf("failed to restore %s: %v", res, res.Err)
+		} else {
+			r.logger.Infof("%s %s", res.Action, res)
+		}
+	}
+
+	return append(results, pending...)
+}
+
+func (r *Restorer) decrypt(obj *unstructured.Unstructured) error {
+	if r.decrypter == nil {
+		return fmt.Errorf("object is encrypted, and no decryption key was provided")
+	}
+
+	if err := r.decrypter.Decrypt(obj); err != nil {
+		return fmt.Errorf("failed to decrypt: %v", err)
+	}
+
+	return nil
+}
+
+func (r *Restorer) selected(obj *unstructured.Unstructured) bool {
+	if len(r.kinds) > 0 && !contains(r.kinds, obj.GetKind()) {
+		return false
+	}
+
+	if len(r.namespaces) == 0 {
+		return true
+	}
+
+	if strings.ToLower(obj.GetKind()) == "namespace" {
+		return contains(r.namespaces, obj.GetName())
+	}
+
+	return contains(r.namespaces, obj.GetNamespace())
+}
+
+func contains(list []string, name string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// installOrder lists kinds that other objects commonly depend on, by
+// creation priority. Unlisted kinds go after them, then custom resources.
+var installOrder = []string{
+	"namespace",
+	"customresourcedefinition",
+	"podsecuritypolicy",
+	"priorityclass",
+	"storageclass",
+	"clusterrole",
+	"clusterrolebinding",
+	"resourcequota",
+	"limitrange",
+	"serviceaccount",
+	"role",
+	"rolebinding",
+	"secret",
+	"configmap",
+	"persistentvolume",
+	"persistentvolumeclaim",
+	"service",
+}
+
+func rank(obj *unstructured.Unstructured, customGroups map[string]bool) int {
+	kind := strings.ToLower(obj.GetKind())
+	for i, k := range installOrder {
+		if k == kind {
+			return i
+		}
+	}
+
+	if customGroups[obj.GroupVersionKind().Group] {
+		return len(installOrder) + 1
+	}
+
+	return len(installOrder)
+}
+
+// sortByDependencies orders objects so that namespaces and CRDs come first,
+// and custom resources (whose group is defined by a CRD) come last.
+func sortByDependencies(objs []*Result) {
+	customGroups := make(map[string]bool)
+	for _, res := range objs {
+		if strings.ToLower(res.Object.GetKind()) != "customresourcedefinition" {
+			continue
+		}
+		group, _, _ := unstructured.NestedString(res.Object.Object, "spec", "group")
+		customGroups[group] = true
+	}
+
+	sort.SliceStable(objs, func(i, j int) bool {
+		ri, rj := rank(objs[i].Object, customGroups), rank(objs[j].Object, customGroups)
+		if ri != rj {
+			return ri < rj
+		}
+		return objs[i].Path < objs[j].Path
+	})
+}
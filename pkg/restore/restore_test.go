@@ -0,0 +1,204 @@
+package restore
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+type mockLog struct{}
+
+func (m *mockLog) Infof(format string, args ...interface{})  {}
+func (m *mockLog) Errorf(format string, args ...interface{}) {}
+
+type mockApplier struct {
+	applied []string
+}
+
+func (m *mockApplier) Apply(obj *unstructured.Unstructured, dryRun bool) (Action, error) {
+	name := obj.GetKind() + ":" + obj.GetName()
+	m.applied = append(m.applied, name)
+	switch obj.GetName() {
+	case "broken":
+		return Created, fmt.Errorf("apply failed")
+	case "unchanged":
+		return Skipped, nil
+	}
+	return Created, nil
+}
+
+var backup = map[string][]byte{
+	"ns1/deployment-app.yaml": []byte("apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: app\n  namespace: ns1\n"),
+	"ns1/foo-bar.yaml":        []byte("apiVersion: example.com/v1\nkind: Foo\nmetadata:\n  name: bar\n  namespace: ns1\n"),
+	"ns1/configmap-cm.yaml":   []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: unchanged\n  namespace: ns1\n"),
+	"ns2/secret-s.yaml":       []byte("apiVersion: v1\nkind: Secret\nmetadata:\n  name: broken\n  namespace: ns2\n"),
+	"namespace-ns1.yaml":      []byte("apiVersion: v1\nkind: Namespace\nmetadata:\n  name: ns1\n"),
+	"namespace-ns2.yaml":      []byte("apiVersion: v1\nkind: Namespace\nmetadata:\n  name: ns2\n"),
+	"customresourcedefinition-foos.example.com.yaml": []byte("apiVersion: apiextensions.k8s.io/v1beta1\n" +
+		"kind: CustomResourceDefinition\nmetadata:\n  name: foos.example.com\nspec:\n  group: example.com\n"),
+	"garbage.yaml": []byte("{{{ not yaml"),
+}
+
+func TestRestoreOrder(t *testing.T) {
+	ap := new(mockApplier)
+	rs := &Restorer{logger: new(mockLog), applier: ap}
+
+	results := rs.Restore(backup)
+
+	expected := []string{
+		"Namespace:ns1",
+		"Namespace:ns2",
+		"CustomResourceDefinition:foos.example.com",
+		"Secret:broken",
+		"ConfigMap:unchanged",
+		"Deployment:app",
+		"Foo:bar",
+	}
+	if !reflect.DeepEqual(ap.applied, expected) {
+		t.Errorf("wrong restoration order: expected %v actual %v", expected, ap.applied)
+	}
+
+	actions := make(map[string]Action)
+	for _, res := range results {
+		actions[res.Path] = res.Action
+	}
+
+	if len(actions) != len(backup) {
+		t.Errorf("all objects should be reported: expected %d actual %d", len(backup), len(actions))
+	}
+
+	for path, action := range map[string]Action{
+		"garbage.yaml":            Failed,
+		"ns2/secret-s.yaml":       Failed,
+		"ns1/configmap-cm.yaml":   Skipped,
+		"ns1/deployment-app.yaml": Created,
+	} {
+		if actions[path] != action {
+			t.Errorf("%s should be reported as %s, got %s", path, action, actions[path])
+		}
+	}
+}
+
+func TestRestoreSelection(t *testing.T) {
+	ap := new(mockApplier)
+	rs := &Restorer{logger: new(mockLog), applier: ap, namespaces: []string{"ns1"}}
+	rs.Restore(backup)
+
+	expected := []string{"Namespace:ns1", "ConfigMap:unchanged", "Deployment:app", "Foo:bar"}
+	if !reflect.DeepEqual(ap.applied, expected) {
+		t.Errorf("namespace selection failed: expected %v actual %v", expected, ap.applied)
+	}
+
+	ap = new(mockApplier)
+	rs = &Restorer{logger: new(mockLog), applier: ap, kinds: []string{"deployment", "namespace"}}
+	rs.Restore(backup)
+
+	expected = []string{"Namespace:ns1", "Namespace:ns2", "Deployment:app"}
+	if !reflect.DeepEqual(ap.applied, expected) {
+		t.Errorf("kind selection failed: expected %v actual %v", expected, ap.applied)
+	}
+}
+
+type mockDecrypter struct{}
+
+func (m *mockDecrypter) Decrypt(obj *unstructured.Unstructured) error {
+	if obj.GetName() == "tampered" {
+		return fmt.Errorf("mac mismatch")
+	}
+	delete(obj.Object, "sops")
+	return nil
+}
+
+func TestRestoreEncrypted(t *testing.T) {
+	files := map[string][]byte{
+		"ns1/secret-s.yaml": []byte("kind: Secret\nmetadata: {name: s, namespace: ns1}\nsops: {version: 3.7.3}\n"),
+		"ns1/secret-t.yaml": []byte("kind: Secret\nmetadata: {name: tampered, namespace: ns1}\nsops: {version: 3.7.3}\n"),
+	}
+
+	ap := new(mockApplier)
+	rs := &Restorer{logger: new(mockLog), applier: ap}
+	for _, res := range rs.Restore(files) {
+		if res.Action != Failed {
+			t.Errorf("encrypted objects shouldn't be restored without a key: %s", res)
+		}
+	}
+
+	ap = new(mockApplier)
+	rs = &Restorer{logger: new(mockLog), applier: ap, decrypter: new(mockDecrypter)}
+	rs.Restore(files)
+
+	expected := []string{"Secret:s"}
+	if !reflect.DeepEqual(ap.applied, expected) {
+		t.Errorf("decryption failed: expected %v actual %v", expected, ap.applied)
+	}
+}
+
+func TestRestoreRedacted(t *testing.T) {
+	files := map[string][]byte{
+		"ns1/configmap-clear.yaml": []byte("kind: ConfigMap\nmetadata: {name: clear, namespace: ns1}\ndata: {a: b}\n"),
+		"ns1/configmap-red.yaml": []byte("kind: ConfigMap\nmetadata: {name: red, namespace: ns1}\n" +
+			"data: {a: 'password=<redacted:0123456789abcdef>'}\n"),
+	}
+
+	ap := new(mockApplier)
+	rs := &Restorer{logger: new(mockLog), applier: ap}
+	for _, res := range rs.Restore(files) {
+		if res.Object.GetName() == "red" && (res.Action != Failed || !strings.Contains(res.Err.Error(), "data.a")) {
+			t.Errorf("objects holding redacted values should fail: %s %v", res, res.Err)
+		}
+	}
+
+	expected := []string{"ConfigMap:clear"}
+	if !reflect.DeepEqual(ap.applied, expected) {
+		t.Errorf("redacted objects shouldn't be applied: expected %v actual %v", expected, ap.applied)
+	}
+}
+
+func TestRestoreMetadataOnly(t *testing.T) {
+	files := map[string][]byte{
+		"ns1/configmap-full.yaml": []byte("kind: ConfigMap\nmetadata: {name: full, namespace: ns1}\n"),
+		"ns1/pod-meta.yaml": []byte("kind: Pod\nmetadata: {name: meta, namespace: ns1, " +
+			"annotations: {katafygio.io/metadata-only: 'true'}}\n"),
+	}
+
+	ap := new(mockApplier)
+	rs := &Restorer{logger: new(mockLog), applier: ap}
+	rs.Restore(files)
+
+	expected := []string{"ConfigMap:full"}
+	if !reflect.DeepEqual(ap.applied, expected) {
+		t.Errorf("metadata-only dumps shouldn't be restored: expected %v actual %v", expected, ap.applied)
+	}
+}
+
+func TestReadDir(t *testing.T) {
+	appFs = afero.NewMemMapFs()
+	_ = afero.WriteFile(appFs, "/tmp/ktest/ns1/deployment-app.yaml", []byte("foo"), 0600)
+	_ = afero.WriteFile(appFs, "/tmp/ktest/namespace-ns1.yaml", []byte("bar"), 0600)
+	_ = afero.WriteFile(appFs, "/tmp/ktest/README.md", []byte("spam"), 0600)
+	_ = afero.WriteFile(appFs, "/tmp/ktest/.git/config.yaml", []byte("egg"), 0600)
+	_ = afero.WriteFile(appFs, "/tmp/ktest/.branches/prod/namespace-ns2.yaml", []byte("egg"), 0600)
+
+	files, err := ReadDir("/tmp/ktest/")
+	if err != nil {
+		t.Errorf("ReadDir failed: %v", err)
+	}
+
+	expected := map[string][]byte{
+		"ns1/deployment-app.yaml": []byte("foo"),
+		"namespace-ns1.yaml":      []byte("bar"),
+	}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("ReadDir failed: expected %v actual %v", expected, files)
+	}
+
+	_, err = ReadDir("/does/not/exist")
+	if err == nil {
+		t.Error("ReadDir should fail on missing directories")
+	}
+}
@@ -0,0 +1,540 @@
+// Package sops encrypts selected fields of the dumped objects (by default,
+// Secrets' data and stringData) before they're stored. Files are written in
+// the Mozilla SOPS format, with OpenPGP recipients, so they can be decrypted
+// with the standard sops tool as well as by katafygio's restore command.
+package sops
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+
+	// openpgp falls back to RIPEMD160 for keys without hash preferences
+	_ "golang.org/x/crypto/ripemd160"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// Version is the sops format version we're compatible with
+	Version = "3.7.3"
+
+	// DefaultRegex selects the fields encrypted when none are specified
+	DefaultRegex = `^(data|stringData)$`
+
+	// lastAppliedRegex matches the annotation left by "kubectl apply": it holds
+	// a copy of the object, so it's always encrypted along with the fields
+	lastAppliedRegex = `^kubectl\.kubernetes\.io/last-applied-configuration$`
+
+	// metadataKey holds the sops metadata in encrypted documents
+	metadataKey = "sops"
+
+	dataKeySize = 32
+	nonceSize   = 32
+)
+
+var encryptedValue = regexp.MustCompile(`^ENC\[AES256_GCM,data:(.*),iv:(.*),tag:(.*),type:(.*)\]$`)
+
+// ReadKeyRing loads an armored OpenPGP keyring (public keys for encryption,
+// or private keys for decryption) from a file.
+func ReadKeyRing(path string) (openpgp.EntityList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open keyring %s: %v", path, err)
+	}
+	defer f.Close()
+
+	keys, err := openpgp.ReadArmoredKeyRing(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyring %s: %v", path, err)
+	}
+
+	return keys, nil
+}
+
+// IsEncrypted tells if a decoded document holds sops metadata
+func IsEncrypted(obj map[string]interface{}) bool {
+	_, ok := obj[metadataKey]
+	return ok
+}
+
+// IsEncryptedValue tells if a value was encrypted by sops
+func IsEncryptedValue(value interface{}) bool {
+	str, ok := value.(string)
+	return ok && encryptedValue.MatchString(str)
+}
+
+// Encrypter encrypts the objects of some kinds
+type Encrypter struct {
+	recipients openpgp.EntityList
+	kinds      []string
+	rawRegex   string
+	regex      *regexp.Regexp
+	cache      map[string]*cached
+	cacheLock  sync.Mutex
+}
+
+// cached lets us reuse a previous encryption when an object didn't change,
+// since each encryption (with a new data key and iv) yields a distinct file.
+// The cache only lives in memory: after a restart, every object is encrypted
+// anew, and all the encrypted files change once.
+type cached struct {
+	digest [sha256.Size]byte
+	object map[string]interface{}
+}
+
+// NewEncrypter returns an Encrypter for the given OpenPGP recipients. Objects
+// of the listed kinds (eg. "secret") have their fields matching the regex
+// encrypted (a field is encrypted when any of its parent keys match), as well
+// as their kubectl last-applied-configuration annotation.
+func NewEncrypter(recipients openpgp.EntityList, kinds []string, regex string) (*Encrypter, error) {
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("no encryption recipient")
+	}
+
+	if regex == "" {
+		regex = DefaultRegex
+	}
+
+	if _, err := regexp.Compile(regex); err != nil {
+		return nil, fmt.Errorf("invalid encryption regex %s: %v", regex, err)
+	}
+
+	// recorded as the file's encrypted_regex, so sops decrypts the annotation too
+	regex = "(?:" + regex + ")|" + lastAppliedRegex
+	re := regexp.MustCompile(regex)
+
+	return &Encrypter{
+		recipients: recipients,
+		kinds:      kinds,
+		rawRegex:   regex,
+		regex:      re,
+		cache:      make(map[string]*cached),
+	}, nil
+}
+
+// Transform encrypts the object in place, when it's of a selected kind
+func (e *Encrypter) Transform(obj *unstructured.Unstructured) error {
+	if !e.selected(obj.GetKind()) {
+		return nil
+	}
+
+	plain, err := json.Marshal(obj.Object)
+	if err != nil {
+		return fmt.Errorf("failed to serialize object: %v", err)
+	}
+	digest := sha256.Sum256(plain)
+	key := obj.GetName()
+	if obj.GetNamespace() != "" {
+		key = obj.GetNamespace() + "/" + key
+	}
+	key = cacheKey(obj.GetKind(), key)
+
+	e.cacheLock.Lock()
+	defer e.cacheLock.Unlock()
+
+	if c, ok := e.cache[key]; ok && c.digest == digest {
+		obj.Object = deepCopy(c.object)
+		return nil
+	}
+
+	encrypted, err := e.encrypt(obj.Object)
+	if err != nil {
+		return err
+	}
+
+	e.cache[key] = &cached{digest: digest, object: deepCopy(encrypted)}
+	obj.Object = encrypted
+	return nil
+}
+
+// Forget implements controller.Forgetter: deleted objects are evicted from
+// the cache, which would otherwise grow with every object ever seen.
+func (e *Encrypter) Forget(kind, key string) {
+	e.cacheLock.Lock()
+	defer e.cacheLock.Unlock()
+	delete(e.cache, cacheKey(kind, key))
+}
+
+// cacheKey returns an object's cache key, from its kind and its
+// "namespace/name" (or "name") key.
+func cacheKey(kind, key string) string {
+	return strings.ToLower(kind) + ":" + key
+}
+
+func (e *Encrypter) selected(kind string) bool {
+	for _, k := range e.kinds {
+		if strings.EqualFold(k, kind) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *Encrypter) encrypt(tree map[string]interface{}) (map[string]interface{}, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, fmt.Errorf("failed to generate a data key: %v", err)
+	}
+
+	mac := sha512.New()
+	out, err := walk(tree, nil, func(value interface{}, path []string) (interface{}, error) {
+		mac.Write(toBytes(value))
+		if value == nil || !e.matches(path) {
+			return value, nil
+		}
+		return encryptValue(value, dataKey, strings.Join(path, ":")+":")
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	lastModified := time.Now().UTC().Format(time.RFC3339)
+	encMac, err := encryptValue(fmt.Sprintf("%X", mac.Sum(nil)), dataKey, lastModified)
+	if err != nil {
+		return nil, err
+	}
+
+	pgp := make([]interface{}, 0, len(e.recipients))
+	for _, recipient := range e.recipients {
+		enc, err := encryptDataKey(dataKey, recipient)
+		if err != nil {
+			return nil, err
+		}
+		pgp = append(pgp, map[string]interface{}{
+			"created_at": lastModified,
+			"enc":        enc,
+			"fp":         fmt.Sprintf("%X", recipient.PrimaryKey.Fingerprint),
+		})
+	}
+
+	result := out.(map[string]interface{})
+	result[metadataKey] = map[string]interface{}{
+		"pgp":             pgp,
+		"lastmodified":    lastModified,
+		"mac":             encMac,
+		"encrypted_regex": e.rawRegex,
+		"version":         Version,
+	}
+
+	return result, nil
+}
+
+func (e *Encrypter) matches(path []string) bool {
+	for _, p := range path {
+		if e.regex.MatchString(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Decrypter decrypts sops encrypted objects, using an OpenPGP private keyring
+type Decrypter struct {
+	keyring openpgp.EntityList
+}
+
+// NewDecrypter returns a Decrypter. Keys protected by a passphrase are
+// unlocked with the provided passphrase.
+func NewDecrypter(keyring openpgp.EntityList, passphrase []byte) (*Decrypter, error) {
+	for _, entity := range keyring {
+		if err := unlock(entity, passphrase); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Decrypter{keyring: keyring}, nil
+}
+
+func unlock(entity *openpgp.Entity, passphrase []byte) error {
+	if entity.PrivateKey != nil && entity.PrivateKey.Encrypted {
+		if err := entity.PrivateKey.Decrypt(passphrase); err != nil {
+			return fmt.Errorf("failed to unlock private key %X: %v", entity.PrimaryKey.Fingerprint, err)
+		}
+	}
+
+	for _, sub := range entity.Subkeys {
+		if sub.PrivateKey != nil && sub.PrivateKey.Encrypted {
+			if err := sub.PrivateKey.Decrypt(passphrase); err != nil {
+				return fmt.Errorf("failed to unlock private subkey %X: %v", sub.PublicKey.Fingerprint, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Decrypt decrypts a sops encrypted object in place, and verifies its
+// integrity. Objects not encrypted are left untouched.
+func (d *Decrypter) Decrypt(obj *unstructured.Unstructured) error {
+	if !IsEncrypted(obj.Object) {
+		return nil
+	}
+
+	meta, ok := obj.Object[metadataKey].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("invalid sops metadata")
+	}
+
+	dataKey, err := d.dataKey(meta)
+	if err != nil {
+		return err
+	}
+
+	tree := make(map[string]interface{}, len(obj.Object))
+	for k, v := range obj.Object {
+		if k != metadataKey {
+			tree[k] = v
+		}
+	}
+
+	mac := sha512.New()
+	out, err := walk(tree, nil, func(value interface{}, path []string) (interface{}, error) {
+		if IsEncryptedValue(value) {
+			var err error
+			value, err = decryptValue(value.(string), dataKey, strings.Join(path, ":")+":")
+			if err != nil {
+				return nil, fmt.Errorf("failed to decrypt %s: %v", strings.Join(path, "."), err)
+			}
+		}
+		mac.Write(toBytes(value))
+		return value, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	lastModified, _ := meta["lastmodified"].(string)
+	encMac, _ := meta["mac"].(string)
+	expected, err := decryptValue(encMac, dataKey, lastModified)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt the message authentication code: %v", err)
+	}
+
+	if expected != fmt.Sprintf("%X", mac.Sum(nil)) {
+		return fmt.Errorf("message authentication code mismatch: the file was altered")
+	}
+
+	obj.Object = out.(map[string]interface{})
+	return nil
+}
+
+func (d *Decrypter) dataKey(meta map[string]interface{}) ([]byte, error) {
+	entries, _ := meta["pgp"].([]interface{})
+	for _, entry := range entries {
+		e, ok := entry.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		enc, _ := e["enc"].(string)
+		block, err := armor.Decode(strings.NewReader(enc))
+		if err != nil {
+			continue
+		}
+
+		md, err := openpgp.ReadMessage(block.Body, d.keyring, nil, nil)
+		if err != nil {
+			continue
+		}
+
+		key, err := ioutil.ReadAll(md.UnverifiedBody)
+		if err == nil && len(key) == dataKeySize {
+			return key, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no private key available to decrypt the data key")
+}
+
+func encryptDataKey(dataKey []byte, recipient *openpgp.Entity) (string, error) {
+	var buf bytes.Buffer
+	armored, err := armor.Encode(&buf, "PGP MESSAGE", nil)
+	if err != nil {
+		return "", err
+	}
+
+	w, err := openpgp.Encrypt(armored, []*openpgp.Entity{recipient}, nil, nil, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt data key for %X: %v", recipient.PrimaryKey.Fingerprint, err)
+	}
+
+	if _, err = w.Write(dataKey); err != nil {
+		return "", err
+	}
+
+	if err = w.Close(); err != nil {
+		return "", err
+	}
+
+	if err = armored.Close(); err != nil {
+		return "", err
+	}
+
+	return buf.String() + "\n", nil
+}
+
+// encryptValue mimics sops' AES256_GCM cipher, with the value's path (or
+// the last modification time, for the mac) as additional authenticated data.
+func encryptValue(value interface{}, key []byte, additionalData string) (string, error) {
+	var typ string
+	switch value.(type) {
+	case string:
+		typ = "str"
+	case int64, int:
+		typ = "int"
+	case float64:
+		typ = "float"
+	case bool:
+		typ = "bool"
+	default:
+		return "", fmt.Errorf("can't encrypt values of type %T", value)
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	iv := make([]byte, nonceSize)
+	if _, err = rand.Read(iv); err != nil {
+		return "", fmt.Errorf("failed to generate an iv: %v", err)
+	}
+
+	out := gcm.Seal(nil, iv, toBytes(value), []byte(additionalData))
+	data, tag := out[:len(out)-aes.BlockSize], out[len(out)-aes.BlockSize:]
+
+	return fmt.Sprintf("ENC[AES256_GCM,data:%s,iv:%s,tag:%s,type:%s]",
+		base64.StdEncoding.EncodeToString(data),
+		base64.StdEncoding.EncodeToString(iv),
+		base64.StdEncoding.EncodeToString(tag),
+		typ), nil
+}
+
+func decryptValue(value string, key []byte, additionalData string) (interface{}, error) {
+	m := encryptedValue.FindStringSubmatch(value)
+	if m == nil {
+		return nil, fmt.Errorf("not an encrypted value")
+	}
+
+	var parts [3][]byte
+	for i := range parts {
+		var err error
+		if parts[i], err = base64.StdEncoding.DecodeString(m[i+1]); err != nil {
+			return nil, fmt.Errorf("invalid encoding: %v", err)
+		}
+	}
+	data, iv, tag := parts[0], parts[1], parts[2]
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(iv) != nonceSize {
+		return nil, fmt.Errorf("invalid iv size")
+	}
+
+	plain, err := gcm.Open(nil, iv, append(data, tag...), []byte(additionalData))
+	if err != nil {
+		return nil, err
+	}
+
+	switch m[4] {
+	case "str":
+		return string(plain), nil
+	case "int":
+		return strconv.ParseInt(string(plain), 10, 64)
+	case "float":
+		return strconv.ParseFloat(string(plain), 64)
+	case "bool":
+		return strings.ToLower(string(plain)) == "true", nil
+	default:
+		return nil, fmt.Errorf("unsupported value type %s", m[4])
+	}
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCMWithNonceSize(block, nonceSize)
+}
+
+// toBytes serializes leaves the way sops does when computing the mac
+func toBytes(value interface{}) []byte {
+	switch v := value.(type) {
+	case string:
+		return []byte(v)
+	case int64:
+		return []byte(strconv.FormatInt(v, 10))
+	case int:
+		return []byte(strconv.Itoa(v))
+	case float64:
+		return []byte(strconv.FormatFloat(v, 'f', -1, 64))
+	case bool:
+		return []byte(strings.Title(strconv.FormatBool(v)))
+	default:
+		return nil
+	}
+}
+
+// walk visits the tree leaves in the order they're serialized (maps keys are
+// sorted), which is also the order sops uses to compute the mac. The path
+// holds the maps keys leading to the leaf (lists indexes aren't included).
+func walk(node interface{}, path []string, leaf func(interface{}, []string) (interface{}, error)) (interface{}, error) {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(n))
+		for k := range n {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		out := make(map[string]interface{}, len(n))
+		for _, k := range keys {
+			v, err := walk(n[k], append(path[:len(path):len(path)], k), leaf)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = v
+		}
+		return out, nil
+
+	case []interface{}:
+		out := make([]interface{}, len(n))
+		for i, item := range n {
+			v, err := walk(item, path, leaf)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = v
+		}
+		return out, nil
+
+	default:
+		return leaf(n, path)
+	}
+}
+
+func deepCopy(obj map[string]interface{}) map[string]interface{} {
+	return (&unstructured.Unstructured{Object: obj}).DeepCopy().Object
+}
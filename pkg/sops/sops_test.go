@@ -0,0 +1,335 @@
+package sops
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ghodss/yaml"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func newEntity(t *testing.T) *openpgp.Entity {
+	entity, err := openpgp.NewEntity("test", "", "test@example.com", &packet.Config{RSABits: 1024})
+	if err != nil {
+		t.Fatalf("failed to generate a key: %v", err)
+	}
+	return entity
+}
+
+func newSecret() *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"type":       "Opaque",
+		"metadata": map[string]interface{}{
+			"name":      "creds",
+			"namespace": "ns1",
+			"labels":    map[string]interface{}{"app": "foo"},
+		},
+		"data":       map[string]interface{}{"password": "c2VjcmV0", "user": "Zm9v"},
+		"stringData": map[string]interface{}{"token": "s3cr3t"},
+	}}
+}
+
+// roundTrip serializes an object the way the controller does, and reads it
+// back the way the restore command does
+func roundTrip(t *testing.T, obj *unstructured.Unstructured) ([]byte, *unstructured.Unstructured) {
+	yml, err := yaml.Marshal(obj)
+	if err != nil {
+		t.Fatalf("failed to marshal: %v", err)
+	}
+
+	back := new(unstructured.Unstructured)
+	if err = yaml.Unmarshal(yml, &back.Object); err != nil {
+		t.Fatalf("failed to unmarshal: %v", err)
+	}
+
+	return yml, back
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	entity := newEntity(t)
+
+	enc, err := NewEncrypter(openpgp.EntityList{entity}, []string{"secret"}, "")
+	if err != nil {
+		t.Fatalf("failed to create an encrypter: %v", err)
+	}
+
+	obj := newSecret()
+	if err = enc.Transform(obj); err != nil {
+		t.Fatalf("failed to encrypt: %v", err)
+	}
+
+	yml, back := roundTrip(t, obj)
+	for _, clear := range []string{"c2VjcmV0", "Zm9v", "s3cr3t"} {
+		if strings.Contains(string(yml), clear) {
+			t.Errorf("secret value %s was stored in clear text:\n%s", clear, yml)
+		}
+	}
+
+	for _, expected := range []string{"app: foo", "name: creds", "password: ENC[AES256_GCM,", "encrypted_regex:",
+		fmt.Sprintf("fp: %X", entity.PrimaryKey.Fingerprint), "BEGIN PGP MESSAGE"} {
+		if !strings.Contains(string(yml), expected) {
+			t.Errorf("encrypted file should contain %q:\n%s", expected, yml)
+		}
+	}
+
+	// unchanged objects shouldn't be encrypted again
+	again := newSecret()
+	_ = enc.Transform(again)
+	if yml2, _ := roundTrip(t, again); string(yml2) != string(yml) {
+		t.Error("an unchanged object shouldn't yield a distinct file")
+	}
+
+	dec, err := NewDecrypter(openpgp.EntityList{entity}, nil)
+	if err != nil {
+		t.Fatalf("failed to create a decrypter: %v", err)
+	}
+
+	if err = dec.Decrypt(back); err != nil {
+		t.Fatalf("failed to decrypt: %v", err)
+	}
+
+	if !reflect.DeepEqual(back.Object, newSecret().Object) {
+		t.Errorf("decrypted object differs from the original:\n%v\n%v", back.Object, newSecret().Object)
+	}
+
+	// cleartext fields are authenticated too
+	_, tampered := roundTrip(t, obj)
+	tampered.SetLabels(map[string]string{"app": "bar"})
+	if err = dec.Decrypt(tampered); err == nil {
+		t.Error("decrypting an altered file should fail")
+	}
+
+	_, other := roundTrip(t, obj)
+	dec, _ = NewDecrypter(openpgp.EntityList{newEntity(t)}, nil)
+	if err = dec.Decrypt(other); err == nil {
+		t.Error("decrypting with the wrong key should fail")
+	}
+}
+
+func TestEncryptLastApplied(t *testing.T) {
+	entity := newEntity(t)
+	enc, err := NewEncrypter(openpgp.EntityList{entity}, []string{"secret"}, "")
+	if err != nil {
+		t.Fatalf("failed to create an encrypter: %v", err)
+	}
+
+	applied := newSecret()
+	applied.SetAnnotations(map[string]string{
+		"kubectl.kubernetes.io/last-applied-configuration": `{"kind":"Secret","stringData":{"token":"s3cr3t"}}`,
+		"example.com/owner": "foo",
+	})
+
+	obj := applied.DeepCopy()
+	if err = enc.Transform(obj); err != nil {
+		t.Fatalf("failed to encrypt: %v", err)
+	}
+
+	yml, back := roundTrip(t, obj)
+	if strings.Contains(string(yml), "s3cr3t") {
+		t.Errorf("the last-applied-configuration annotation was stored in clear text:\n%s", yml)
+	}
+	if !strings.Contains(string(yml), "example.com/owner: foo") {
+		t.Errorf("other annotations shouldn't be encrypted:\n%s", yml)
+	}
+
+	dec, _ := NewDecrypter(openpgp.EntityList{entity}, nil)
+	if err = dec.Decrypt(back); err != nil {
+		t.Fatalf("failed to decrypt: %v", err)
+	}
+	if !reflect.DeepEqual(back.Object, applied.Object) {
+		t.Errorf("decrypted object differs from the original:\n%v\n%v", back.Object, applied.Object)
+	}
+}
+
+// testdata/secret.sops.yaml was encrypted from testdata/secret.yaml by sops 3.8.1
+// (with the key.asc recipient, and the Encrypter's default regex)
+func TestDecryptSopsFile(t *testing.T) {
+	keys, err := ReadKeyRing("testdata/key.asc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dec, err := NewDecrypter(keys, nil)
+	if err != nil {
+		t.Fatalf("failed to create a decrypter: %v", err)
+	}
+
+	expected := readYAML(t, "testdata/secret.yaml")
+
+	obj := readYAML(t, "testdata/secret.sops.yaml")
+	if err = dec.Decrypt(obj); err != nil {
+		t.Fatalf("failed to decrypt a file encrypted by sops: %v", err)
+	}
+
+	if !reflect.DeepEqual(obj.Object, expected.Object) {
+		t.Errorf("decrypted object differs from the original:\n%v\n%v", obj.Object, expected.Object)
+	}
+
+	tampered := readYAML(t, "testdata/secret.sops.yaml")
+	tampered.SetResourceVersion("43")
+	if err = dec.Decrypt(tampered); err == nil || !strings.Contains(err.Error(), "authentication code mismatch") {
+		t.Errorf("decrypting an altered sops file should fail the mac check, got: %v", err)
+	}
+}
+
+// TestSopsDecrypt checks the files we write can be decrypted by sops itself
+func TestSopsDecrypt(t *testing.T) {
+	for _, bin := range []string{"sops", "gpg"} {
+		if _, err := exec.LookPath(bin); err != nil {
+			t.Skipf("%s isn't available", bin)
+		}
+	}
+
+	home, err := ioutil.TempDir("", "katafygio-gnupg-")
+	if err != nil {
+		t.Fatalf("failed to create a temp dir: %v", err)
+	}
+	defer os.RemoveAll(home)
+
+	gnupg := append(os.Environ(), "GNUPGHOME="+home)
+	cmd := exec.Command("gpg", "--batch", "--import", "testdata/key.asc")
+	cmd.Env = gnupg
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("failed to import the test key: %v: %s", err, out)
+	}
+
+	keys, err := ReadKeyRing("testdata/key.asc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enc, err := NewEncrypter(keys, []string{"secret"}, "")
+	if err != nil {
+		t.Fatalf("failed to create an encrypter: %v", err)
+	}
+
+	expected := readYAML(t, "testdata/secret.yaml")
+	obj := expected.DeepCopy()
+	obj.Object["stringData"] = map[string]interface{}{"token": "s3cr3t", "count": int64(3), "enabled": true}
+	expected.Object["stringData"] = obj.Object["stringData"]
+	if err = enc.Transform(obj); err != nil {
+		t.Fatalf("failed to encrypt: %v", err)
+	}
+
+	yml, _ := roundTrip(t, obj)
+	file := home + "/secret.yaml"
+	if err = ioutil.WriteFile(file, yml, 0600); err != nil {
+		t.Fatalf("failed to write %s: %v", file, err)
+	}
+
+	cmd = exec.Command("sops", "--decrypt", file)
+	cmd.Env = gnupg
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("sops failed to decrypt our file: %v\n%s", err, yml)
+	}
+
+	decrypted := new(unstructured.Unstructured)
+	if err = yaml.Unmarshal(out, &decrypted.Object); err != nil {
+		t.Fatalf("failed to unmarshal sops output: %v", err)
+	}
+
+	if _, want := roundTrip(t, expected); !reflect.DeepEqual(decrypted.Object, want.Object) {
+		t.Errorf("sops decrypted object differs from the original:\n%v\n%v", decrypted.Object, want.Object)
+	}
+}
+
+func readYAML(t *testing.T, path string) *unstructured.Unstructured {
+	yml, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", path, err)
+	}
+
+	obj := new(unstructured.Unstructured)
+	if err = yaml.Unmarshal(yml, &obj.Object); err != nil {
+		t.Fatalf("failed to unmarshal %s: %v", path, err)
+	}
+
+	return obj
+}
+
+func TestEncryptSelection(t *testing.T) {
+	enc, err := NewEncrypter(openpgp.EntityList{newEntity(t)}, []string{"configmap"}, `^password$`)
+	if err != nil {
+		t.Fatalf("failed to create an encrypter: %v", err)
+	}
+
+	obj := newSecret()
+	_ = enc.Transform(obj)
+	if !reflect.DeepEqual(obj.Object, newSecret().Object) {
+		t.Error("objects of other kinds shouldn't be encrypted")
+	}
+
+	obj.SetKind("ConfigMap")
+	_ = enc.Transform(obj)
+	data, _, _ := unstructured.NestedStringMap(obj.Object, "data")
+	if !IsEncryptedValue(data["password"]) || data["user"] != "Zm9v" {
+		t.Errorf("only fields matching the regex should be encrypted: %v", data)
+	}
+
+	if _, err = NewEncrypter(nil, []string{"secret"}, ""); err == nil {
+		t.Error("NewEncrypter should fail without recipients")
+	}
+
+	if _, err = NewEncrypter(openpgp.EntityList{newEntity(t)}, nil, "(("); err == nil {
+		t.Error("NewEncrypter should fail on invalid regexes")
+	}
+}
+
+func TestEncryptCacheEviction(t *testing.T) {
+	enc, err := NewEncrypter(openpgp.EntityList{newEntity(t)}, []string{"secret"}, "")
+	if err != nil {
+		t.Fatalf("failed to create an encrypter: %v", err)
+	}
+
+	first, second := newSecret(), newSecret()
+	_ = enc.Transform(first)
+	_ = enc.Transform(second)
+	if !reflect.DeepEqual(first.Object, second.Object) {
+		t.Error("unchanged objects should be encrypted once")
+	}
+
+	enc.Forget("secret", "ns1/creds")
+	if len(enc.cache) != 0 {
+		t.Errorf("deleted objects should be evicted from the cache: %v", enc.cache)
+	}
+
+	third := newSecret()
+	_ = enc.Transform(third)
+	if reflect.DeepEqual(first.Object, third.Object) {
+		t.Error("evicted objects should be encrypted anew")
+	}
+}
+
+func TestReadKeyRing(t *testing.T) {
+	f, err := ioutil.TempFile("", "katafygio-keyring-")
+	if err != nil {
+		t.Fatalf("failed to create a temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+
+	w, _ := armor.Encode(f, openpgp.PublicKeyType, nil)
+	_ = newEntity(t).Serialize(w)
+	_ = w.Close()
+	_ = f.Close()
+
+	keys, err := ReadKeyRing(f.Name())
+	if err != nil || len(keys) != 1 {
+		t.Errorf("failed to read a keyring: %v", err)
+	}
+
+	if _, err = ReadKeyRing("/does/not/exist"); err == nil {
+		t.Error("ReadKeyRing should fail on missing files")
+	}
+}
@@ -0,0 +1,117 @@
+package git
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// DefaultTokenUser is the https username sent along tokens, when the remote
+// url doesn't provide one (GitHub wants that one for app tokens, other
+// forges accept any username with a token).
+const DefaultTokenUser = "x-access-token"
+
+// tokenHelper is a git credential helper answering with the credentials
+// passed in its environment, so they never show on a command line.
+const tokenHelper = `!f() { test "$1" = get && ` +
+	`printf 'username=%s\npassword=%s\n' "$KATAFYGIO_GIT_USERNAME" "$KATAFYGIO_GIT_PASSWORD"; }; f`
+
+// redacted replaces credentials in logs and errors
+const redacted = "xxxxx"
+
+var urlCredentials = regexp.MustCompile(`(://[^/@\s:]+):[^/@\s]+@`)
+
+// Auth configures the authentication to the remote repository
+type Auth struct {
+	SSHKey           string // private key file, for ssh remotes
+	KnownHosts       string // known_hosts file used to verify ssh remotes
+	Username         string // https username (default: DefaultTokenUser)
+	Token            string // https token (or password)
+	CredentialHelper string // git credential helper, eg. "store --file=/etc/katafygio/git-credentials"
+}
+
+// splitCredentials removes the credentials from an https url, if any
+func splitCredentials(remote string) (string, string, string) {
+	u, err := url.Parse(remote)
+	if err != nil || u.User == nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return remote, "", ""
+	}
+
+	password, ok := u.User.Password()
+	if !ok {
+		return remote, "", ""
+	}
+
+	username := u.User.Username()
+	u.User = nil
+	return u.String(), username, password
+}
+
+// authEnv returns the environment passing the credentials to git
+func (s *Store) authEnv() []string {
+	// never wait for a password prompt
+	env := []string{"GIT_TERMINAL_PROMPT=0"}
+
+	if s.Auth.SSHKey != "" || s.Auth.KnownHosts != "" {
+		ssh := "ssh -o BatchMode=yes -o StrictHostKeyChecking=yes"
+		if s.Auth.SSHKey != "" {
+			ssh += " -o IdentitiesOnly=yes -i " + shellQuote(s.Auth.SSHKey)
+		}
+		if s.Auth.KnownHosts != "" {
+			ssh += " -o UserKnownHostsFile=" + shellQuote(s.Auth.KnownHosts)
+		}
+		env = append(env, "GIT_SSH_COMMAND="+ssh)
+	}
+
+	if s.Auth.Token != "" {
+		username := s.Auth.Username
+		if username == "" {
+			username = DefaultTokenUser
+		}
+		env = append(env, "KATAFYGIO_GIT_USERNAME="+username, "KATAFYGIO_GIT_PASSWORD="+s.Auth.Token)
+	}
+
+	return env
+}
+
+// authArgs returns the git options setting the credential helpers. Those
+// never hold the secrets, which tokenHelper reads from authEnv.
+func (s *Store) authArgs() []string {
+	var args []string
+	if s.Auth.CredentialHelper != "" {
+		args = append(args, "-c", "credential.helper="+s.Auth.CredentialHelper)
+	}
+
+	if s.Auth.Token != "" {
+		args = append(args, "-c", "credential.helper="+tokenHelper)
+	}
+
+	return args
+}
+
+// redact removes the credentials from a text (eg. a git command output)
+func (s *Store) redact(text string) string {
+	if s.Auth.Token != "" {
+		text = strings.Replace(text, s.Auth.Token, redacted, -1)
+	}
+	return urlCredentials.ReplaceAllString(text, "${1}:"+redacted+"@")
+}
+
+// redactingLogger removes the credentials from the store's log messages
+type redactingLogger struct {
+	logger logger
+	store  *Store
+}
+
+func (l *redactingLogger) Infof(format string, args ...interface{}) {
+	l.logger.Infof("%s", l.store.redact(fmt.Sprintf(format, args...)))
+}
+
+func (l *redactingLogger) Errorf(format string, args ...interface{}) {
+	l.logger.Errorf("%s", l.store.redact(fmt.Sprintf(format, args...)))
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -2,6 +2,11 @@
 // content committed when the directory content changes, and optionaly (if
 // a remote repos url is provided), keep it in sync with a remote repository.
 //
-// It requires the git command in $PATH, since the pure Go git implementations
-// aren't up to the task (see go-git issues #793 and #785 for instance).
+// Repository operations (init, clone, add, commit, pull and push, and the
+// history reads) use go-git, so the git command isn't required. The git
+// command is still used when the store is configured with CLI, and for
+// credential helpers; its failures are reported as CommandError, with the exit
+// code and output. go-git can't merge, so diverged branches are merged by our
+// own file level three-way merge, favoring our files on conflicts.
+// We avoid running git operations when nothing changed.
 package git
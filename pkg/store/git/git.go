@@ -1,14 +1,25 @@
 package git
 
 import (
+	"archive/tar"
+	"bytes"
 	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/spf13/afero"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+
+	"github.com/bpineau/katafygio/pkg/metrics"
+	"github.com/bpineau/katafygio/pkg/store/local"
 )
 
 var (
@@ -21,11 +32,30 @@ var (
 	// GitEmail is the email of the commiter
 	GitEmail = "katafygio@localhost"
 
-	// GitMsg is the commit message we'll use
+	// GitMsg is the commit message we'll use when the changes can't be listed
 	GitMsg = "Kubernetes cluster change"
 )
 
-var appFs = afero.NewOsFs()
+var (
+	appFs = afero.NewOsFs()
+
+	durationHistogram = metrics.NewHistogram("katafygio_git_operation_duration_seconds",
+		"Duration of git operations, by operation.", nil, "operation")
+	failuresCounter = metrics.NewCounter("katafygio_git_operation_failures_total",
+		"Number of failed git operations, by operation.", "operation")
+	lastPushGauge = metrics.NewGauge("katafygio_git_last_push_timestamp_seconds",
+		"Time of the last successful git push.")
+	lastSyncGauge = metrics.NewGauge("katafygio_git_last_sync_timestamp_seconds",
+		"Last time the repository (and its remote, if any) was found up to date with the cluster.")
+)
+
+// measure records an operation duration and outcome
+func measure(operation string, start time.Time, err error) {
+	durationHistogram.Observe(time.Since(start).Seconds(), operation)
+	if err != nil {
+		failuresCounter.Inc(operation)
+	}
+}
 
 type logger interface {
 	Infof(format string, args ...interface{})
@@ -42,14 +72,54 @@ type Store struct {
 	Email    string
 	Msg      string
 	DryRun   bool
-	stopch   chan struct{}
-	donech   chan struct{}
+	Managers bool // record the objects last managers as commit trailers
+
+	// PerObject commits each object change on its own, up to MaxCommits
+	// (0 for no limit) changes per CheckInterval: above that, they're
+	// committed at once.
+	PerObject  bool
+	MaxCommits int
+
+	// Branch is the branch to commit to, and push to (created when missing
+	// from the remote). Defaults to the remote's default branch.
+	Branch string
+
+	// Auth holds the remote repository credentials, which are redacted
+	// from logs and errors.
+	Auth Auth
+
+	// Ignore lists gitignore patterns of working copy paths that aren't
+	// committed (eg. other working copies, nested in this one).
+	Ignore []string
+
+	// CLI runs the git command rather than go-git for all the operations
+	// (the git command is otherwise only used for credential helpers).
+	CLI bool
+
+	stopch  chan struct{}
+	donech  chan struct{}
+	journal journal
+	dirty   int32 // set atomically when files were saved or removed
+
+	// filesLock is held by pulls updating the working copy, which saves
+	// and removals wait for
+	filesLock sync.RWMutex
+
+	// unpushed is set when we have local commits to push. Only used by
+	// commitAndPush, which never runs concurrently.
+	unpushed bool
+
+	syncLock sync.RWMutex // protect lastSync and lastErr
+	lastSync time.Time
+	lastErr  error
 }
 
 // New instantiate a new git Store. url is optional.
+// Credentials embedded in an https url are moved to Auth, to keep them
+// out of the git commands lines.
 func New(log logger, dryRun bool, dir, url string, timeout time.Duration) *Store {
-	return &Store{
-		Logger:   log,
+	url, username, token := splitCredentials(url)
+	s := &Store{
 		LocalDir: dir,
 		URL:      url,
 		Timeout:  timeout,
@@ -57,19 +127,27 @@ func New(log logger, dryRun bool, dir, url string, timeout time.Duration) *Store
 		Email:    GitEmail,
 		Msg:      GitMsg,
 		DryRun:   dryRun,
+		Auth:     Auth{Username: username, Token: token},
 	}
+	s.Logger = &redactingLogger{logger: log, store: s}
+	return s
 }
 
 // Start maintains a directory content committed
-func (s *Store) Start() (*Store, error) {
+func (s *Store) Start() error {
 	s.Logger.Infof("Starting git repository synchronizer")
 	s.stopch = make(chan struct{})
 	s.donech = make(chan struct{})
 
 	err := s.CloneOrInit()
 	if err != nil {
-		return nil, err
+		return err
 	}
+	s.setSynced(nil)
+
+	// commit and push what a previous run may have left behind
+	atomic.StoreInt32(&s.dirty, 1)
+	s.unpushed = s.URL != "" && !s.DryRun
 
 	go func() {
 		checkTick := time.NewTicker(CheckInterval)
@@ -86,59 +164,76 @@ func (s *Store) Start() (*Store, error) {
 		}
 	}()
 
-	return s, nil
+	return nil
 }
 
-// Stop stops the git goroutine
+// Stop stops the git goroutine, then commits (and pushes) the pending changes
 func (s *Store) Stop() {
 	s.Logger.Infof("Stopping git repository synchronizer")
 	close(s.stopch)
 	<-s.donech
+	s.commitAndPush()
 }
 
-// Git wraps the git command
-func (s *Store) Git(args ...string) error {
-	if s.DryRun {
-		return nil
+// Save writes an object to a file in the repository, to be committed later
+func (s *Store) Save(key string, data []byte) error {
+	s.filesLock.RLock()
+	defer s.filesLock.RUnlock()
+
+	if err := s.files().Save(key, data); err != nil {
+		return err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
-	defer cancel()
+	// flagged once written, so a concurrent commit can't miss the change
+	atomic.StoreInt32(&s.dirty, 1)
+	return nil
+}
 
-	cmd := exec.CommandContext(ctx, "git", args...) // #nosec
-	cmd.Dir = s.LocalDir
-	cmd.Env = append(os.Environ(), fmt.Sprintf("GIT_DIR=%s/.git", s.LocalDir))
+// Remove deletes an object's file from the repository, to be committed later
+func (s *Store) Remove(key string) error {
+	s.filesLock.RLock()
+	defer s.filesLock.RUnlock()
 
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		if ctx.Err() == context.DeadlineExceeded {
-			return fmt.Errorf("git %s timed out (%v, %s)", args[0], err, out)
-		}
-		return fmt.Errorf("git %s failed with code %v: %s", args[0], err, out)
+	if err := s.files().Remove(key); err != nil {
+		return err
 	}
 
+	atomic.StoreInt32(&s.dirty, 1)
 	return nil
 }
 
+// List returns the relative paths of the objects files in the working copy
+func (s *Store) List() ([]string, error) {
+	return s.files().List()
+}
+
+func (s *Store) files() *local.Store {
+	return local.New(s.Logger, s.DryRun, s.LocalDir)
+}
+
+// Git wraps the git command
+func (s *Store) Git(args ...string) error {
+	if s.DryRun {
+		return nil
+	}
+
+	_, err := s.run(args...)
+	return err
+}
+
 // Status tests the git status of a repository
 func (s *Store) Status() (changed bool, err error) {
 	if s.DryRun {
 		return false, nil
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
-	defer cancel()
-
-	cmd := exec.CommandContext(ctx, "git", "status", "--porcelain") // #nosec
-	cmd.Dir = s.LocalDir
-	cmd.Env = append(os.Environ(), fmt.Sprintf("GIT_DIR=%s/.git", s.LocalDir))
+	if s.native() {
+		return s.nativeStatus()
+	}
 
-	out, err := cmd.CombinedOutput()
+	out, err := s.run("status", "--porcelain")
 	if err != nil {
-		if ctx.Err() == context.DeadlineExceeded {
-			return false, fmt.Errorf("git status timed out (%v, %s)", err, out)
-		}
-		return false, fmt.Errorf("git status failed with code %v: %s", err, out)
+		return false, err
 	}
 
 	if len(out) != 0 {
@@ -148,6 +243,82 @@ func (s *Store) Status() (changed bool, err error) {
 	return false, nil
 }
 
+// run executes a git command, and returns its standard output
+func (s *Store) run(args ...string) ([]byte, error) {
+	return s.runEnv(nil, args...)
+}
+
+// CommandError is returned when a git command fails
+type CommandError struct {
+	Args     []string
+	ExitCode int  // -1 when git couldn't be run, or was killed
+	Timeout  bool // the command exceeded the store's Timeout
+	Output   []byte
+	Err      error
+}
+
+func (e *CommandError) Error() string {
+	if e.Timeout {
+		return fmt.Sprintf("git %s timed out (%v, %s)", e.subcommand(), e.Err, e.Output)
+	}
+	return fmt.Sprintf("git %s failed with code %v: %s", e.subcommand(), e.Err, e.Output)
+}
+
+// subcommand returns the git subcommand, skipping the global options
+func (e *CommandError) subcommand() string {
+	for i := 0; i < len(e.Args); i++ {
+		switch {
+		case e.Args[i] == "-c" || e.Args[i] == "-C":
+			i++
+		case !strings.HasPrefix(e.Args[i], "-"):
+			return e.Args[i]
+		}
+	}
+	return strings.Join(e.Args, " ")
+}
+
+// command returns a git command, set up with the credentials. Credential
+// helpers are set with options (rather than GIT_CONFIG_* variables, which
+// need git >= 2.31), while the secrets stay in the environment.
+func (s *Store) command(ctx context.Context, env []string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "git", append(s.authArgs(), args...)...) // #nosec
+	cmd.Dir = s.LocalDir
+	cmd.Env = append(os.Environ(), fmt.Sprintf("GIT_DIR=%s/.git", s.LocalDir))
+	cmd.Env = append(cmd.Env, s.authEnv()...)
+	cmd.Env = append(cmd.Env, env...)
+	return cmd
+}
+
+// runEnv executes a git command with additional environment variables
+func (s *Store) runEnv(env []string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := s.command(ctx, env, args...)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		cerr := &CommandError{
+			Args:     make([]string, len(args)),
+			ExitCode: -1,
+			Timeout:  ctx.Err() == context.DeadlineExceeded,
+			Output:   []byte(s.redact(string(out) + stderr.String())),
+			Err:      err,
+		}
+		for i, arg := range args {
+			cerr.Args[i] = s.redact(arg)
+		}
+		if exit, ok := err.(*exec.ExitError); ok {
+			cerr.ExitCode = exit.ExitCode()
+		}
+		return nil, cerr
+	}
+
+	return out, nil
+}
+
 // CloneOrInit create a new local repository, either with "git clone" (if a GitURL
 // to clone from is provided), or "git init" (in the absence of GitURL).
 func (s *Store) CloneOrInit() (err error) {
@@ -165,32 +336,49 @@ func (s *Store) CloneOrInit() (err error) {
 
 	// One may both sync with a remote repos and keep a persistent local clone
 	if _, err := os.Stat(fmt.Sprintf("%s/.git/index", s.LocalDir)); err == nil {
-		return nil
+		if err = s.checkBranch(); err != nil || s.DryRun {
+			return err
+		}
+		return s.writeExcludes()
 	}
 
-	if s.URL == "" {
-		err = s.Git("init", s.LocalDir)
+	if s.native() {
+		err = s.nativeCloneOrInit()
 	} else {
-		err = s.Git("clone", "--depth=1", s.URL, s.LocalDir)
+		err = s.cloneOrInit()
 	}
-
 	if err != nil {
 		return fmt.Errorf("failed to init or clone in %s: %v", s.LocalDir, err)
 	}
 
-	err = s.Git("config", "user.name", s.Author)
-	if err != nil {
-		return fmt.Errorf("failed to config git user.name %s in %s: %v",
-			s.Author, s.LocalDir, err)
+	if !s.native() {
+		err = s.Git("config", "user.name", s.Author)
+		if err != nil {
+			return fmt.Errorf("failed to config git user.name %s in %s: %v",
+				s.Author, s.LocalDir, err)
+		}
+
+		err = s.Git("config", "user.email", s.Email)
+		if err != nil {
+			return fmt.Errorf("failed to config git user.email %s in %s: %v",
+				s.Email, s.LocalDir, err)
+		}
 	}
 
-	err = s.Git("config", "user.email", s.Email)
+	return s.writeExcludes()
+}
+
+// writeExcludes keeps our temporary files, and the Ignore patterns, out of
+// the commits made by the git command
+func (s *Store) writeExcludes() error {
+	// go-git doesn't create .git/info
+	err := appFs.MkdirAll(s.LocalDir+"/.git/info", 0700)
 	if err != nil {
-		return fmt.Errorf("failed to config git user.email %s in %s: %v",
-			s.Email, s.LocalDir, err)
+		return fmt.Errorf("failed to create a git exclusion: %v", err)
 	}
 
-	err = afero.WriteFile(appFs, s.LocalDir+"/.git/info/exclude", []byte(".temp-katafygio-*"), 0644)
+	patterns := append([]string{".temp-katafygio-*"}, s.Ignore...)
+	err = afero.WriteFile(appFs, s.LocalDir+"/.git/info/exclude", []byte(strings.Join(patterns, "\n")+"\n"), 0644)
 	if err != nil {
 		return fmt.Errorf("failed to create a git exclusion: %v", err)
 	}
@@ -198,8 +386,103 @@ func (s *Store) CloneOrInit() (err error) {
 	return nil
 }
 
+// cloneOrInit clones the remote repository at Branch. When the remote
+// doesn't have that branch yet (eg. a brand new remote without commits),
+// it's started as an orphan branch, that the first push will create.
+func (s *Store) cloneOrInit() error {
+	if s.URL == "" {
+		if err := s.Git("init", s.LocalDir); err != nil {
+			return err
+		}
+		return s.orphan()
+	}
+
+	exists := s.Branch == ""
+	if !exists {
+		heads, err := s.run("ls-remote", "--heads", s.URL, "refs/heads/"+s.Branch)
+		if err != nil {
+			return err
+		}
+		exists = len(bytes.TrimSpace(heads)) > 0
+	}
+
+	if exists {
+		args := []string{"clone", "--depth=1"}
+		if s.Branch != "" {
+			args = append(args, "--branch", s.Branch)
+		}
+		return s.Git(append(args, s.URL, s.LocalDir)...)
+	}
+
+	s.Logger.Infof("branch %s not found in %s, starting it as an orphan branch", s.Branch, s.URL)
+
+	if err := s.Git("init", s.LocalDir); err != nil {
+		return err
+	}
+
+	if err := s.Git("remote", "add", "origin", s.URL); err != nil {
+		return err
+	}
+
+	return s.orphan()
+}
+
+// orphan points an empty repository's HEAD to Branch
+func (s *Store) orphan() error {
+	if s.Branch == "" {
+		return nil
+	}
+	return s.Git("symbolic-ref", "HEAD", "refs/heads/"+s.Branch)
+}
+
+// checkBranch ensures an existing local clone is on Branch
+func (s *Store) checkBranch() error {
+	if s.Branch == "" {
+		return nil
+	}
+
+	current, err := s.checkedOut()
+	if err != nil {
+		return err
+	}
+
+	if current != s.Branch {
+		return fmt.Errorf("%s is on branch %s rather than %s", s.LocalDir, current, s.Branch)
+	}
+
+	return nil
+}
+
+// branch returns the branch we commit to
+func (s *Store) branch() (string, error) {
+	if s.Branch != "" {
+		return s.Branch, nil
+	}
+	return s.checkedOut()
+}
+
+// checkedOut returns the checked out branch (possibly not born yet)
+func (s *Store) checkedOut() (string, error) {
+	if s.native() {
+		return s.nativeCheckedOut()
+	}
+
+	out, err := s.run("symbolic-ref", "--short", "HEAD")
+	if err != nil {
+		return "", fmt.Errorf("failed to find the current git branch: %v", err)
+	}
+
+	return string(bytes.TrimSpace(out)), nil
+}
+
 // Commit git commit all the directory's changes
 func (s *Store) Commit() (changed bool, err error) {
+	defer func(start time.Time) { measure("commit", start, err) }(time.Now())
+
+	if s.native() {
+		return s.nativeCommit()
+	}
+
 	changed, err = s.Status()
 	if err != nil {
 		return changed, err
@@ -214,7 +497,15 @@ func (s *Store) Commit() (changed bool, err error) {
 		return false, fmt.Errorf("failed to git add -A: %v", err)
 	}
 
-	err = s.Git("commit", "-m", s.Msg)
+	msg := s.Msg
+	changes, err := s.staged()
+	if err != nil {
+		s.Logger.Errorf("%v", err)
+	} else {
+		msg = s.commitMessage(changes)
+	}
+
+	err = s.Git("commit", "-m", msg)
 	if err != nil {
 		return false, fmt.Errorf("failed to git commit: %v", err)
 	}
@@ -223,32 +514,257 @@ func (s *Store) Commit() (changed bool, err error) {
 }
 
 // Push git push to the origin
-func (s *Store) Push() error {
-	err := s.Git("push")
+func (s *Store) Push() (err error) {
+	defer func(start time.Time) { measure("push", start, err) }(time.Now())
+
+	branch, err := s.branch()
+	if err != nil {
+		return err
+	}
+
+	// explicit, so the first push creates orphan branches
+	if s.native() {
+		err = s.nativePush(branch)
+	} else {
+		err = s.Git("push", "origin", "HEAD:refs/heads/"+branch)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to git push: %v", err)
 	}
 
+	lastPushGauge.Set(float64(time.Now().Unix()))
 	return nil
 }
 
-func (s *Store) commitAndPush() {
-	changed, err := s.Commit()
+// Pull git pull from the origin, favoring our local changes on conflicts
+func (s *Store) Pull() (err error) {
+	defer func(start time.Time) { measure("pull", start, err) }(time.Now())
+
+	branch, err := s.branch()
 	if err != nil {
-		s.Logger.Errorf("%v", err)
+		return err
+	}
+
+	if s.native() {
+		if err = s.nativePull(branch); err != nil {
+			return fmt.Errorf("failed to git pull: %v", err)
+		}
+		return nil
+	}
+
+	// nothing to pull from a branch we didn't push yet
+	if s.Git("rev-parse", "--verify", "-q", "refs/remotes/origin/"+branch) != nil {
+		return nil
 	}
 
-	if !changed || s.URL == "" {
+	err = s.Git("pull", "--no-rebase", "-s", "recursive", "-X", "ours", "--no-edit", "origin", branch)
+	if err != nil {
+		return fmt.Errorf("failed to git pull: %v", err)
+	}
+
+	return nil
+}
+
+func (s *Store) commitAndPush() {
+	// spare git commands when we didn't change anything since last push
+	dirty := atomic.SwapInt32(&s.dirty, 0) != 0
+	if !dirty && !s.unpushed {
+		s.setSynced(nil)
 		return
 	}
 
-	err = s.Git("pull", "-s", "recursive", "-X", "ours", "--no-edit")
+	if dirty {
+		changed, err := s.commitObjects()
+		if err == nil {
+			var batched bool
+			batched, err = s.Commit()
+			changed = changed || batched
+		}
+
+		if err != nil {
+			s.Logger.Errorf("%v", err)
+			atomic.StoreInt32(&s.dirty, 1)
+			s.setSynced(err)
+			return
+		}
+
+		s.unpushed = s.unpushed || (changed && s.URL != "")
+	}
+
+	if !s.unpushed {
+		s.setSynced(nil)
+		return
+	}
+
+	err := s.Pull()
 	if err != nil {
-		s.Logger.Errorf("failed to git pull -s recursive -X ours --no-edit: %v", err)
+		s.Logger.Errorf("%v", err)
 	}
 
+	// retried on next ticks, even without new commits, until it succeeds
 	err = s.Push()
 	if err != nil {
 		s.Logger.Errorf("%v", err)
+		s.setSynced(err)
+		return
+	}
+
+	s.unpushed = false
+	s.setSynced(nil)
+}
+
+// setSynced records a synchronization attempt outcome
+func (s *Store) setSynced(err error) {
+	s.syncLock.Lock()
+	defer s.syncLock.Unlock()
+
+	s.lastErr = err
+	if err == nil {
+		s.lastSync = time.Now()
+		lastSyncGauge.Set(float64(s.lastSync.Unix()))
+	}
+}
+
+// Healthy returns an error when the repository wasn't successfully committed
+// (and pushed, when we have a remote) for more than maxAge.
+func (s *Store) Healthy(maxAge time.Duration) error {
+	s.syncLock.RLock()
+	defer s.syncLock.RUnlock()
+
+	if s.lastSync.IsZero() {
+		return fmt.Errorf("repository not synchronized yet")
+	}
+
+	if time.Since(s.lastSync) <= maxAge {
+		return nil
+	}
+
+	if s.lastErr != nil {
+		return fmt.Errorf("no successful sync since %s: %v", s.lastSync.Format(time.RFC3339), s.lastErr)
+	}
+
+	return fmt.Errorf("no successful sync since %s", s.lastSync.Format(time.RFC3339))
+}
+
+// revisionTimeLayouts are the accepted formats for time based revisions
+var revisionTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// ResolveRevision returns the commit id matching a revision, which can be
+// anything git understands (a commit id, a tag, a branch...), or a time
+// (eg. "2026-10-01T12:00Z"), in which case we return the last commit
+// before that time.
+func (s *Store) ResolveRevision(rev string) (string, error) {
+	for _, layout := range revisionTimeLayouts {
+		t, err := time.Parse(layout, rev)
+		if err != nil {
+			continue
+		}
+
+		if s.native() {
+			commit, err := s.nativeResolveRevision(rev, t)
+			if err == plumbing.ErrReferenceNotFound {
+				return "", fmt.Errorf("no commit found before %s%s", rev, s.shallowHint())
+			}
+			if err != nil {
+				return "", fmt.Errorf("failed to find a commit before %s: %v", rev, err)
+			}
+			return commit, nil
+		}
+
+		out, err := s.run("rev-list", "-1", fmt.Sprintf("--before=%d", t.Unix()), "HEAD")
+		if err != nil {
+			return "", fmt.Errorf("failed to find a commit before %s: %v", rev, err)
+		}
+
+		commit := strings.TrimSpace(string(out))
+		if commit == "" {
+			return "", fmt.Errorf("no commit found before %s%s", rev, s.shallowHint())
+		}
+
+		return commit, nil
 	}
+
+	if strings.HasPrefix(rev, "-") {
+		return "", fmt.Errorf("invalid revision %s", rev)
+	}
+
+	if s.native() {
+		commit, err := s.nativeResolveRevision(rev, time.Time{})
+		if err != nil {
+			return "", fmt.Errorf("unknown revision %s%s: %v", rev, s.shallowHint(), err)
+		}
+		return commit, nil
+	}
+
+	out, err := s.run("rev-parse", "--verify", rev+"^{commit}")
+	if err != nil {
+		return "", fmt.Errorf("unknown revision %s%s: %v", rev, s.shallowHint(), err)
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// shallowHint explains revision lookup failures in shallow clones (as made
+// by CloneOrInit), where the commits older than the clone are missing.
+func (s *Store) shallowHint() string {
+	if _, err := os.Stat(filepath.Join(s.LocalDir, ".git", "shallow")); err != nil {
+		return ""
+	}
+	return fmt.Sprintf(" (%s is a shallow clone, without the history before it was cloned:"+
+		" run \"git fetch --unshallow\" there to get it)", s.LocalDir)
+}
+
+// ReadTree returns the content of the yaml files committed at a given
+// revision, indexed by path. The working copy isn't involved.
+func (s *Store) ReadTree(rev string) (map[string][]byte, error) {
+	commit, err := s.ResolveRevision(rev)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.native() {
+		files, err := s.nativeReadTree(commit)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s tree: %v", rev, err)
+		}
+		return files, nil
+	}
+
+	out, err := s.run("archive", "--format=tar", commit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s tree: %v", rev, err)
+	}
+
+	files := make(map[string][]byte)
+	tr := tar.NewReader(bytes.NewReader(out))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s tree: %v", rev, err)
+		}
+
+		if hdr.Typeflag != tar.TypeReg || !strings.HasSuffix(hdr.Name, ".yaml") {
+			continue
+		}
+
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s at %s: %v", hdr.Name, rev, err)
+		}
+
+		files[hdr.Name] = data
+	}
+
+	return files, nil
 }
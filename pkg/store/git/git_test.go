@@ -1,13 +1,22 @@
 package git
 
 import (
+	"bytes"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/spf13/afero"
+
+	"github.com/bpineau/katafygio/pkg/event"
+	"github.com/bpineau/katafygio/pkg/metrics"
+	"github.com/bpineau/katafygio/pkg/store"
 )
 
 var (
@@ -24,6 +33,17 @@ func init() {
 
 type mockLog struct{}
 
+// forEachMode runs a test with go-git, then with the git command
+func forEachMode(t *testing.T, test func(t *testing.T, cli bool)) {
+	for _, cli := range []bool{false, true} {
+		name := "go-git"
+		if cli {
+			name = "cli"
+		}
+		t.Run(name, func(t *testing.T) { test(t, cli) })
+	}
+}
+
 func (m *mockLog) Infof(format string, args ...interface{})  {}
 func (m *mockLog) Errorf(format string, args ...interface{}) {}
 
@@ -35,7 +55,8 @@ func TestGitDryRun(t *testing.T) {
 
 	appFs = afero.NewMemMapFs()
 
-	repo, err := New(new(mockLog), true, "/tmp/ktest", "", timeout).Start()
+	repo := New(new(mockLog), true, "/tmp/ktest", "", timeout)
+	err := repo.Start()
 	if err != nil {
 		t.Errorf("failed to start git: %v", err)
 	}
@@ -46,6 +67,17 @@ func TestGitDryRun(t *testing.T) {
 	}
 
 	repo.Stop()
+
+	// dry runs never push
+	repo = New(new(mockLog), true, "/tmp/ktest", "https://example.com/repo.git", timeout)
+	if err = repo.Start(); err != nil {
+		t.Errorf("failed to start git: %v", err)
+	}
+
+	repo.Stop()
+	if repo.lastErr != nil {
+		t.Errorf("dry runs shouldn't push: %v", repo.lastErr)
+	}
 }
 
 // testing with real git repositories and commands
@@ -62,7 +94,8 @@ func TestGit(t *testing.T) {
 
 	defer os.RemoveAll(dir)
 
-	repo, err := New(new(mockLog), false, dir, "", timeout).Start()
+	repo := New(new(mockLog), false, dir, "", timeout)
+	err = repo.Start()
 	if err != nil {
 		t.Errorf("failed to start git: %v", err)
 	}
@@ -94,6 +127,11 @@ func TestGit(t *testing.T) {
 		t.Errorf("Commit shouldn't notify changes on unchanged repos (%v)", err)
 	}
 
+	repo.commitAndPush()
+	if atomic.LoadInt32(&repo.dirty) != 0 {
+		t.Error("git shouldn't run again until new changes are saved")
+	}
+
 	// re-use the previous repos for clone tests
 
 	newdir, err := ioutil.TempDir("", "katafygio-tests")
@@ -111,7 +149,7 @@ func TestGit(t *testing.T) {
 		t.Errorf("clone failed: %v", err)
 	}
 
-	_ = ioutil.WriteFile(newdir+"/t2.yaml", []byte{42}, 0600)
+	_ = repo.Save("t2.yaml", []byte{42})
 	repo.commitAndPush()
 
 	changed, err = repo.Status()
@@ -119,20 +157,34 @@ func TestGit(t *testing.T) {
 		t.Errorf("Status should return false after a add+commit+push (%v)", err)
 	}
 
+	var buf bytes.Buffer
+	_ = metrics.Write(&buf)
+	for _, metric := range []string{`katafygio_git_operation_duration_seconds_count{operation="commit"}`,
+		`katafygio_git_operation_duration_seconds_count{operation="push"} 1`} {
+		if !strings.Contains(buf.String(), metric) {
+			t.Errorf("git metrics should contain %s: %s", metric, buf.String())
+		}
+	}
+
 	repo.Stop()
 
 	// test various failure modes
 
-	_, err = repo.Start()
+	err = repo.Start()
 	if err != nil {
 		t.Error("Start/Clone on an existing repository should not fail")
 	}
 
-	err = repo.Git("fortzob", "42")
+	err = repo.Git("-c", "core.quotepath=off", "fortzob", "42")
 	if err == nil {
 		t.Error("Git should fail with unknown subcommands")
 	}
 
+	cerr, ok := err.(*CommandError)
+	if !ok || cerr.ExitCode <= 0 || cerr.Timeout || !strings.HasPrefix(cerr.Error(), "git fortzob failed") {
+		t.Errorf("Git should return a CommandError with the exit code: %#v", err)
+	}
+
 	if err == nil {
 		t.Error("clone should fail on existing repos")
 	}
@@ -149,9 +201,495 @@ func TestGit(t *testing.T) {
 	if err == nil {
 		t.Error("Status should fail on a non-repos")
 	}
+
 	repo.commitAndPush()
+	if atomic.LoadInt32(&repo.dirty) == 0 {
+		t.Error("failed commits should be retried")
+	}
 	_, err = repo.Commit()
 	if err == nil {
 		t.Error("Commit should fail on a non-repos")
 	}
+
+	if err = repo.Healthy(time.Hour); err != nil {
+		t.Errorf("a recent successful sync should be healthy: %v", err)
+	}
+
+	err = repo.Healthy(0)
+	if err == nil || !strings.Contains(err.Error(), "no successful sync since") {
+		t.Errorf("failing syncs should be reported as unhealthy past max age: %v", err)
+	}
+}
+
+func TestGitRevisions(t *testing.T) {
+	forEachMode(t, testGitRevisions)
+}
+
+func testGitRevisions(t *testing.T, cli bool) {
+	if !testHasGit {
+		t.Log("git not found, skipping")
+		t.Skip()
+	}
+
+	dir, err := ioutil.TempDir("", "katafygio-tests")
+	if err != nil {
+		t.Fatal("failed to create a temp dir for tests")
+	}
+
+	defer os.RemoveAll(dir)
+
+	repo := New(new(mockLog), false, dir, "", timeout)
+	repo.CLI = cli
+	repo.PerObject = true
+	err = repo.CloneOrInit()
+	if err != nil {
+		t.Fatalf("failed to init git: %v", err)
+	}
+
+	// per object commits are dated with the changes time
+	commit := func(at string, files map[string]string) {
+		date, _ := time.Parse(time.RFC3339, at)
+		for file, content := range files {
+			_ = repo.Save(file, []byte(content))
+			repo.Record(file, &event.Notification{Action: event.Upsert, Key: file, Kind: "file", Time: date})
+		}
+		repo.commitAndPush()
+	}
+
+	commit("2026-10-01T10:00:00Z", map[string]string{"t1.yaml": "v1", "README.md": "not an object"})
+	first, err := repo.ResolveRevision("HEAD")
+	if err != nil {
+		t.Errorf("failed to resolve HEAD: %v", err)
+	}
+
+	commit("2026-10-01T14:00:00Z", map[string]string{"t1.yaml": "v2", "t2.yaml": "v1"})
+
+	// the working copy shouldn't be involved
+	_ = ioutil.WriteFile(dir+"/t1.yaml", []byte("v3"), 0600)
+
+	rev, err := repo.ResolveRevision("2026-10-01T12:00Z")
+	if err != nil || rev != first {
+		t.Errorf("time based revision should resolve to %s, got %s (%v)", first, rev, err)
+	}
+
+	if rev, err = repo.ResolveRevision(first[:8]); err != nil || rev != first {
+		t.Errorf("abbreviated commit ids should resolve to %s, got %s (%v)", first, rev, err)
+	}
+
+	files, err := repo.ReadTree(first)
+	expected := map[string][]byte{"t1.yaml": []byte("v1")}
+	if err != nil || !reflect.DeepEqual(files, expected) {
+		t.Errorf("ReadTree failed: expected %v actual %v (%v)", expected, files, err)
+	}
+
+	files, err = repo.ReadTree("HEAD")
+	expected = map[string][]byte{"t1.yaml": []byte("v2"), "t2.yaml": []byte("v1")}
+	if err != nil || !reflect.DeepEqual(files, expected) {
+		t.Errorf("ReadTree failed: expected %v actual %v (%v)", expected, files, err)
+	}
+
+	for _, rev := range []string{"2026-09-01", "nonexistent", "--all"} {
+		if _, err = repo.ReadTree(rev); err == nil {
+			t.Errorf("ReadTree should fail on %s revision", rev)
+		}
+	}
+
+	// shallow clones miss the history before the clone
+	defer os.RemoveAll(dir + "-clone")
+	_ = os.Mkdir(dir+"-clone", 0700)
+	clone := New(new(mockLog), false, dir+"-clone", "file://"+dir, timeout)
+	clone.CLI = cli
+	if err = clone.CloneOrInit(); err != nil {
+		t.Fatalf("failed to clone: %v", err)
+	}
+
+	for _, rev := range []string{"2026-10-01T12:00Z", first[:8]} {
+		if _, err = clone.ResolveRevision(rev); err == nil || !strings.Contains(err.Error(), "shallow clone") {
+			t.Errorf("revisions older than a shallow clone should be reported as such, got: %v", err)
+		}
+	}
+}
+
+func TestGitStoreInterface(t *testing.T) {
+	if !testHasGit {
+		t.Log("git not found, skipping")
+		t.Skip()
+	}
+
+	dir, err := ioutil.TempDir("", "katafygio-tests")
+	if err != nil {
+		t.Fatal("failed to create a temp dir for tests")
+	}
+
+	defer os.RemoveAll(dir)
+
+	var repo store.Interface = New(new(mockLog), false, dir, "", timeout)
+	if err = repo.Start(); err != nil {
+		t.Fatalf("failed to start git: %v", err)
+	}
+
+	_ = repo.Save("ns1/foo-bar.yaml", []byte("spam"))
+	_ = repo.Save("foo-baz.yaml", []byte("egg"))
+	_ = repo.Remove("foo-baz.yaml")
+
+	keys, err := repo.List()
+	if err != nil || !reflect.DeepEqual(keys, []string{"ns1/foo-bar.yaml"}) {
+		t.Errorf("List should only return saved objects: %v (%v)", keys, err)
+	}
+
+	changed, err := repo.Commit()
+	if !changed || err != nil {
+		t.Errorf("saved objects should be committed (%v)", err)
+	}
+
+	repo.Stop()
+}
+
+func TestGitBranch(t *testing.T) {
+	forEachMode(t, testGitBranch)
+}
+
+func testGitBranch(t *testing.T, cli bool) {
+	if !testHasGit {
+		t.Log("git not found, skipping")
+		t.Skip()
+	}
+
+	tmp, err := ioutil.TempDir("", "katafygio-tests")
+	if err != nil {
+		t.Fatal("failed to create a temp dir for tests")
+	}
+
+	defer os.RemoveAll(tmp)
+
+	remote := tmp + "/remote.git"
+	if out, err := exec.Command("git", "init", "-q", "--bare", remote).CombinedOutput(); err != nil {
+		t.Fatalf("failed to init a bare repository: %v %s", err, out)
+	}
+
+	files := func(branch string) string {
+		out, err := exec.Command("git", "--git-dir", remote, "ls-tree", "-r", "--name-only", branch).CombinedOutput()
+		if err != nil {
+			t.Fatalf("failed to list %s files: %v %s", branch, err, out)
+		}
+		return strings.Join(strings.Fields(string(out)), ",")
+	}
+
+	backup := func(dir, branch, file string) *Store {
+		_ = os.Mkdir(tmp+"/"+dir, 0700)
+		repo := New(new(mockLog), false, tmp+"/"+dir, remote, timeout)
+		repo.CLI = cli
+		repo.Branch = branch
+		if err := repo.CloneOrInit(); err != nil {
+			t.Fatalf("clone of %s failed: %v", branch, err)
+		}
+		_ = repo.Save(file, []byte{42})
+		repo.commitAndPush()
+		return repo
+	}
+
+	// an empty remote is bootstrapped on its default branch
+	backup("default", "", "default.yaml")
+	if files("HEAD") != "default.yaml" {
+		t.Errorf("the first push should create the default branch, got %q", files("HEAD"))
+	}
+
+	// a missing branch is created as an orphan
+	prod := backup("prod1", "prod", "prod1.yaml")
+	if files("prod") != "prod1.yaml" {
+		t.Errorf("the prod branch should only hold the prod files, got %q", files("prod"))
+	}
+
+	// an existing branch is cloned, pulled and pushed
+	backup("prod2", "prod", "prod2.yaml")
+	if files("prod") != "prod1.yaml,prod2.yaml" {
+		t.Errorf("the prod branch should be cloned then pushed to, got %q", files("prod"))
+	}
+
+	_ = prod.Save("prod3.yaml", []byte{42})
+	prod.commitAndPush()
+	if files("prod") != "prod1.yaml,prod2.yaml,prod3.yaml" || files("HEAD") != "default.yaml" {
+		t.Errorf("pushes should only update their branch, got %q and %q", files("prod"), files("HEAD"))
+	}
+
+	// a local clone can't be re-used for another branch
+	prod.Branch = "staging"
+	if err = prod.CloneOrInit(); err == nil {
+		t.Error("a local clone on another branch should be rejected")
+	}
+}
+
+func TestGitStopFlushes(t *testing.T) {
+	if !testHasGit {
+		t.Log("git not found, skipping")
+		t.Skip()
+	}
+
+	dir, err := ioutil.TempDir("", "katafygio-tests")
+	if err != nil {
+		t.Fatal("failed to create a temp dir for tests")
+	}
+
+	defer os.RemoveAll(dir)
+
+	repo := New(new(mockLog), false, dir, "", timeout)
+	if err = repo.Start(); err != nil {
+		t.Fatalf("failed to start git: %v", err)
+	}
+
+	_ = repo.Save("t.yaml", []byte{42})
+	repo.Stop()
+
+	changed, err := repo.Status()
+	if changed || err != nil {
+		t.Errorf("Stop should commit the pending changes (%v)", err)
+	}
+}
+
+func TestGitPushRetry(t *testing.T) {
+	forEachMode(t, testGitPushRetry)
+}
+
+func testGitPushRetry(t *testing.T, cli bool) {
+	if !testHasGit {
+		t.Log("git not found, skipping")
+		t.Skip()
+	}
+
+	tmp, err := ioutil.TempDir("", "katafygio-tests")
+	if err != nil {
+		t.Fatal("failed to create a temp dir for tests")
+	}
+
+	defer os.RemoveAll(tmp)
+
+	remote := tmp + "/remote.git"
+	if out, err := exec.Command("git", "init", "-q", "--bare", remote).CombinedOutput(); err != nil {
+		t.Fatalf("failed to init a bare repository: %v %s", err, out)
+	}
+
+	_ = os.Mkdir(tmp+"/local", 0700)
+	repo := New(new(mockLog), false, tmp+"/local", remote, timeout)
+	repo.CLI = cli
+	if err = repo.CloneOrInit(); err != nil {
+		t.Fatalf("clone failed: %v", err)
+	}
+
+	// the remote goes away: the commit can't be pushed
+	if err = os.Rename(remote, remote+".away"); err != nil {
+		t.Fatalf("failed to move the remote: %v", err)
+	}
+
+	_ = repo.Save("t.yaml", []byte{42})
+	repo.commitAndPush()
+	if repo.lastErr == nil {
+		t.Error("a failed push should be reported")
+	}
+
+	// the remote is back: the push is retried without new changes
+	if err = os.Rename(remote+".away", remote); err != nil {
+		t.Fatalf("failed to restore the remote: %v", err)
+	}
+
+	repo.commitAndPush()
+	if repo.lastErr != nil {
+		t.Errorf("the push should be retried and succeed: %v", repo.lastErr)
+	}
+
+	out, err := exec.Command("git", "--git-dir", remote, "ls-tree", "-r", "--name-only", "HEAD").CombinedOutput()
+	if err != nil || strings.TrimSpace(string(out)) != "t.yaml" {
+		t.Errorf("the commit should be pushed once the remote is back: %v %s", err, out)
+	}
+}
+
+func TestGitDirtyOrdering(t *testing.T) {
+	if !testHasGit {
+		t.Log("git not found, skipping")
+		t.Skip()
+	}
+
+	dir, err := ioutil.TempDir("", "katafygio-tests")
+	if err != nil {
+		t.Fatal("failed to create a temp dir for tests")
+	}
+
+	defer os.RemoveAll(dir)
+
+	repo := New(new(mockLog), false, dir, "", timeout)
+	if err = repo.CloneOrInit(); err != nil {
+		t.Fatalf("failed to init git: %v", err)
+	}
+
+	// failed writes don't flag the repository as changed
+	_ = repo.Save("f", []byte{42})
+	repo.commitAndPush()
+	if err = repo.Save("f/t.yaml", []byte{42}); err == nil || atomic.LoadInt32(&repo.dirty) != 0 {
+		t.Errorf("failed saves shouldn't flag the repository as changed (%v)", err)
+	}
+
+	// changes saved while committing are committed on next tick
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			_ = repo.Save(fmt.Sprintf("t%d.yaml", i), []byte{42})
+		}
+	}()
+
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+			repo.commitAndPush()
+		}
+	}
+	repo.commitAndPush()
+
+	changed, err := repo.Status()
+	if changed || err != nil {
+		t.Errorf("changes saved during a commit shouldn't be missed (%v)", err)
+	}
+}
+
+func TestGitWithoutCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "katafygio-tests")
+	if err != nil {
+		t.Fatal("failed to create a temp dir for tests")
+	}
+
+	defer os.RemoveAll(dir)
+
+	// go-git doesn't need the git command (but for file:// remotes)
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	_ = os.Setenv("PATH", "")
+
+	repo := New(new(mockLog), false, dir, "", timeout)
+	if err = repo.CloneOrInit(); err != nil {
+		t.Fatalf("failed to init git: %v", err)
+	}
+
+	_ = repo.Save("t.yaml", []byte("v1"))
+	repo.commitAndPush()
+	if repo.lastErr != nil {
+		t.Errorf("commit failed: %v", repo.lastErr)
+	}
+
+	files, err := repo.ReadTree("HEAD")
+	if err != nil || string(files["t.yaml"]) != "v1" {
+		t.Errorf("ReadTree failed: %v (%v)", files, err)
+	}
+
+	// credential helpers are only supported by the git command
+	repo.Auth.CredentialHelper = "store"
+	if _, err = repo.Status(); err == nil {
+		t.Error("credential helpers should fall back to the git command")
+	}
+}
+
+func TestGitDiverged(t *testing.T) {
+	forEachMode(t, testGitDiverged)
+}
+
+func testGitDiverged(t *testing.T, cli bool) {
+	if !testHasGit {
+		t.Log("git not found, skipping")
+		t.Skip()
+	}
+
+	tmp, err := ioutil.TempDir("", "katafygio-tests")
+	if err != nil {
+		t.Fatal("failed to create a temp dir for tests")
+	}
+
+	defer os.RemoveAll(tmp)
+
+	remote := tmp + "/remote.git"
+	if out, err := exec.Command("git", "init", "-q", "--bare", remote).CombinedOutput(); err != nil {
+		t.Fatalf("failed to init a bare repository: %v %s", err, out)
+	}
+
+	clone := func(dir string) *Store {
+		_ = os.Mkdir(tmp+"/"+dir, 0700)
+		repo := New(new(mockLog), false, tmp+"/"+dir, remote, timeout)
+		repo.CLI = cli
+		repo.Branch = "main"
+		if err := repo.CloneOrInit(); err != nil {
+			t.Fatalf("clone failed: %v", err)
+		}
+		return repo
+	}
+
+	save := func(repo *Store, version string, files ...string) {
+		for _, f := range files {
+			_ = repo.Save(f, []byte(strings.TrimPrefix(repo.LocalDir, tmp)+f+version))
+		}
+		repo.commitAndPush()
+		if repo.lastErr != nil {
+			t.Fatalf("commit and push failed: %v", repo.lastErr)
+		}
+	}
+
+	// a branch pushed from an orphan is pulled again later
+	first := clone("first")
+	save(first, "v1", "a.yaml", "b.yaml", "c.yaml", "d.yaml")
+	second := clone("second")
+
+	save(second, "v2", "a.yaml", "c.yaml")
+	_ = first.Remove("d.yaml")
+	save(first, "v2", "b.yaml", "c.yaml")
+
+	// saved after the commit: left alone by the pull
+	_ = first.files().Save("e.yaml", []byte("pending"))
+	if err = first.Pull(); err != nil {
+		t.Fatalf("failed to pull: %v", err)
+	}
+
+	got := make(map[string]string)
+	for _, f := range []string{"a.yaml", "b.yaml", "c.yaml", "d.yaml", "e.yaml"} {
+		data, err := ioutil.ReadFile(first.LocalDir + "/" + f)
+		if err == nil {
+			got[f] = string(data)
+		}
+	}
+
+	expected := map[string]string{
+		"a.yaml": "/seconda.yamlv2", // changed on their side
+		"b.yaml": "/firstb.yamlv2",  // changed on our side
+		"c.yaml": "/firstc.yamlv2",  // changed on both sides: ours wins
+		"e.yaml": "pending",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("diverged branches should be merged favoring ours: expected %v, got %v", expected, got)
+	}
+
+	first.commitAndPush()
+	if first.lastErr != nil {
+		t.Errorf("the merge should be pushed: %v", first.lastErr)
+	}
+
+	if cli {
+		return
+	}
+
+	// go-git also merges a branch created remotely before our first push
+	_ = os.Mkdir(tmp+"/third", 0700)
+	third := New(new(mockLog), false, tmp+"/third", remote, timeout)
+	third.Branch = "other"
+	if err = third.CloneOrInit(); err != nil {
+		t.Fatalf("clone failed: %v", err)
+	}
+
+	fourth := clone("fourth")
+	fourth.Branch = "other"
+	if err = fourth.Git("checkout", "-q", "-b", "other"); err != nil {
+		t.Fatalf("failed to checkout: %v", err)
+	}
+	save(fourth, "v1", "f.yaml")
+	save(third, "v1", "g.yaml")
+
+	out, err := exec.Command("git", "--git-dir", remote, "ls-tree", "-r", "--name-only", "other").CombinedOutput()
+	if err != nil || strings.Join(strings.Fields(string(out)), ",") != "a.yaml,b.yaml,c.yaml,f.yaml,g.yaml" {
+		t.Errorf("unrelated histories should be merged: %v %s", err, out)
+	}
 }
@@ -0,0 +1,173 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/bpineau/katafygio/pkg/event"
+)
+
+// objectChange is an object change waiting to be committed on its own
+type objectChange struct {
+	path   string
+	kind   string
+	key    string
+	action event.Action
+	time   time.Time
+}
+
+// journal holds the objects changes reported since the last commit, in order
+type journal struct {
+	sync.Mutex
+	changes []*objectChange
+	byPath  map[string]*objectChange
+}
+
+// Record implements store.Journal: in PerObject mode, an object change will
+// be committed on its own, dated with the notification time.
+func (s *Store) Record(key string, ev *event.Notification) {
+	if !s.PerObject || s.DryRun {
+		return
+	}
+
+	change := &objectChange{
+		path:   key,
+		kind:   ev.Kind,
+		key:    path.Join(ev.Cluster, ev.Key),
+		action: ev.Action,
+		time:   ev.Time,
+	}
+
+	s.journal.Lock()
+	defer s.journal.Unlock()
+
+	// a file changed several times is committed once, in its latest state
+	if prev, ok := s.journal.byPath[key]; ok {
+		*prev = *change
+		return
+	}
+
+	if s.journal.byPath == nil {
+		s.journal.byPath = make(map[string]*objectChange)
+	}
+	s.journal.byPath[key] = change
+	s.journal.changes = append(s.journal.changes, change)
+}
+
+// requeue puts back changes that couldn't be committed, ahead of the
+// changes recorded since (which supersede them for a same file).
+func (j *journal) requeue(changes []*objectChange) {
+	j.Lock()
+	defer j.Unlock()
+
+	if j.byPath == nil {
+		j.byPath = make(map[string]*objectChange)
+	}
+
+	var kept []*objectChange
+	for _, change := range changes {
+		if _, ok := j.byPath[change.path]; ok {
+			continue
+		}
+		j.byPath[change.path] = change
+		kept = append(kept, change)
+	}
+
+	j.changes = append(kept, j.changes...)
+}
+
+// commitObjects commits the recorded objects changes one by one, unless
+// there are more than MaxCommits of them (eg. on resync storms): those are
+// left to the next global commit.
+func (s *Store) commitObjects() (changed bool, err error) {
+	s.journal.Lock()
+	changes := s.journal.changes
+	s.journal.changes, s.journal.byPath = nil, nil
+	s.journal.Unlock()
+
+	if len(changes) == 0 {
+		return false, nil
+	}
+
+	if s.MaxCommits > 0 && len(changes) > s.MaxCommits {
+		s.Logger.Infof("%d objects changed since last check, committing them at once", len(changes))
+		return false, nil
+	}
+
+	defer func(start time.Time) { measure("commit", start, err) }(time.Now())
+
+	for i, change := range changes {
+		committed, err := s.commitObject(change)
+		if err != nil {
+			s.journal.requeue(changes[i:])
+			return changed, err
+		}
+		changed = changed || committed
+	}
+
+	return changed, nil
+}
+
+// commitObject commits an object's file, if it changed
+func (s *Store) commitObject(change *objectChange) (bool, error) {
+	if s.native() {
+		return s.nativeCommitObject(change, func(verb string) string {
+			return s.objectMessage(change, verb)
+		})
+	}
+
+	out, err := s.run("status", "--porcelain", "--", change.path)
+	if err != nil {
+		return false, err
+	}
+
+	if len(bytes.TrimSpace(out)) == 0 {
+		// eg. created then deleted, or already committed
+		return false, nil
+	}
+
+	verb := "update"
+	switch {
+	case bytes.HasPrefix(out, []byte("??")) || out[0] == 'A':
+		verb = "create"
+	case change.action == event.Delete:
+		verb = "delete"
+	}
+
+	err = s.Git("add", "-A", "--", change.path)
+	if err != nil {
+		return false, fmt.Errorf("failed to git add %s: %v", change.path, err)
+	}
+
+	msg := s.objectMessage(change, verb)
+
+	date := change.time
+	if date.IsZero() {
+		date = time.Now()
+	}
+	env := []string{
+		"GIT_AUTHOR_DATE=" + date.Format(time.RFC3339),
+		"GIT_COMMITTER_DATE=" + date.Format(time.RFC3339),
+	}
+
+	_, err = s.runEnv(env, "commit", "-m", msg, "--", change.path)
+	if err != nil {
+		return false, fmt.Errorf("failed to git commit %s: %v", change.path, err)
+	}
+
+	return true, nil
+}
+
+// objectMessage returns an object's commit message
+func (s *Store) objectMessage(change *objectChange, verb string) string {
+	msg := fmt.Sprintf("%s %s %s", verb, change.kind, change.key)
+	if s.Managers && change.action != event.Delete {
+		if managers := s.managers([]stagedChange{{status: "M", path: change.path}}); len(managers) > 0 {
+			msg += "\n\n" + ManagerTrailer + ": " + managers[0]
+		}
+	}
+	return msg
+}
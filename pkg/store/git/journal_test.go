@@ -0,0 +1,139 @@
+package git
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bpineau/katafygio/pkg/event"
+)
+
+func TestPerObjectCommits(t *testing.T) {
+	forEachMode(t, testPerObjectCommits)
+}
+
+func testPerObjectCommits(t *testing.T, cli bool) {
+	if !testHasGit {
+		t.Log("git not found, skipping")
+		t.Skip()
+	}
+
+	dir, err := ioutil.TempDir("", "katafygio-tests")
+	if err != nil {
+		t.Fatal("failed to create a temp dir for tests")
+	}
+
+	defer os.RemoveAll(dir)
+
+	repo := New(new(mockLog), false, dir, "", timeout)
+	repo.CLI = cli
+	repo.PerObject = true
+	repo.MaxCommits = 2
+	if err = repo.CloneOrInit(); err != nil {
+		t.Fatalf("failed to init git: %v", err)
+	}
+
+	at := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	record := func(action event.Action, key, content string) {
+		file := "ns/pod-" + key + ".yaml"
+		if action == event.Delete {
+			_ = repo.Remove(file)
+		} else {
+			_ = repo.Save(file, []byte(content))
+		}
+		at = at.Add(time.Minute)
+		repo.Record(file, &event.Notification{Action: action, Key: "ns/" + key, Kind: "pod", Time: at})
+	}
+
+	record(event.Upsert, "foo", "v1")
+	record(event.Upsert, "bar", "v1")
+	repo.commitAndPush()
+
+	record(event.Upsert, "foo", "v2")
+	record(event.Upsert, "foo", "v3")
+	record(event.Delete, "bar", "")
+	repo.commitAndPush()
+
+	// above MaxCommits, changes are committed at once
+	record(event.Upsert, "foo", "v4")
+	record(event.Upsert, "baz", "v1")
+	record(event.Upsert, "qux", "v1")
+	repo.commitAndPush()
+
+	out, err := repo.run("log", "--format=%cI %s")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"create pod ns/baz, update pod ns/foo, create pod ns/qux",
+		"2026-10-01T12:05:00+00:00 delete pod ns/bar",
+		"2026-10-01T12:04:00+00:00 update pod ns/foo",
+		"2026-10-01T12:02:00+00:00 create pod ns/bar",
+		"2026-10-01T12:01:00+00:00 create pod ns/foo",
+	}
+
+	commits := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(commits) != len(expected) {
+		t.Fatalf("expected %d commits, got %v", len(expected), commits)
+	}
+	if !strings.HasSuffix(commits[0], expected[0]) {
+		t.Errorf("expected a batched commit, got %q", commits[0])
+	}
+	for i := 1; i < len(expected); i++ {
+		if commits[i] != expected[i] {
+			t.Errorf("expected commit %q, got %q", expected[i], commits[i])
+		}
+	}
+}
+
+func TestPerObjectCommitsRetry(t *testing.T) {
+	if !testHasGit {
+		t.Log("git not found, skipping")
+		t.Skip()
+	}
+
+	dir, err := ioutil.TempDir("", "katafygio-tests")
+	if err != nil {
+		t.Fatal("failed to create a temp dir for tests")
+	}
+
+	defer os.RemoveAll(dir)
+
+	repo := New(new(mockLog), false, dir, "", timeout)
+	repo.CLI = true // go-git ignores index locks
+	repo.PerObject = true
+	if err = repo.CloneOrInit(); err != nil {
+		t.Fatalf("failed to init git: %v", err)
+	}
+
+	at := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	for _, key := range []string{"foo", "bar"} {
+		file := "ns/pod-" + key + ".yaml"
+		_ = repo.Save(file, []byte("v1"))
+		at = at.Add(time.Minute)
+		repo.Record(file, &event.Notification{Action: event.Upsert, Key: "ns/" + key, Kind: "pod", Time: at})
+	}
+
+	// a stale lock makes git commands fail
+	lock := dir + "/.git/index.lock"
+	if err = ioutil.WriteFile(lock, nil, 0600); err != nil {
+		t.Fatalf("failed to lock the index: %v", err)
+	}
+	repo.commitAndPush()
+
+	_ = os.Remove(lock)
+	repo.commitAndPush()
+
+	out, err := repo.run("log", "--format=%cI %s")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "2026-10-01T12:02:00+00:00 create pod ns/bar\n2026-10-01T12:01:00+00:00 create pod ns/foo"
+	if strings.TrimSpace(string(out)) != expected {
+		t.Errorf("failed changes should be committed on their own on retry, got %q", out)
+	}
+}
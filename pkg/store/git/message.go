@@ -0,0 +1,183 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+)
+
+// MaxSubject is the maximum length of generated commit subjects; the
+// complete list of changes then goes in the commit body.
+var MaxSubject = 72
+
+// ManagerTrailer is the git trailer recording the objects last managers
+const ManagerTrailer = "Managed-by"
+
+var verbs = map[string]string{
+	"A": "create",
+	"M": "update",
+	"T": "update",
+	"D": "delete",
+}
+
+// stagedChange is a file change, as listed by git diff --name-status
+type stagedChange struct {
+	status string
+	path   string
+}
+
+// staged returns the changes staged for commit
+func (s *Store) staged() ([]stagedChange, error) {
+	out, err := s.run("-c", "core.quotepath=off", "diff", "--cached", "--name-status", "--no-renames", "-z")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list staged changes: %v", err)
+	}
+
+	var changes []stagedChange
+	fields := bytes.Split(bytes.TrimRight(out, "\x00"), []byte{0})
+	for i := 0; i+1 < len(fields); i += 2 {
+		changes = append(changes, stagedChange{status: string(fields[i]), path: string(fields[i+1])})
+	}
+
+	return changes, nil
+}
+
+// describe returns a change description, like "update deployment prod/api",
+// from the path of a dumped object ([cluster/][namespace/]kind-name.yaml).
+func (c stagedChange) describe() string {
+	verb, ok := verbs[c.status]
+	if !ok {
+		verb = "change"
+	}
+
+	dir, file := path.Split(filepath.ToSlash(c.path))
+	if !strings.HasSuffix(file, ".yaml") {
+		return verb + " " + c.path
+	}
+
+	file = strings.TrimSuffix(file, ".yaml")
+	i := strings.Index(file, "-")
+	if i <= 0 {
+		return verb + " " + c.path
+	}
+
+	return verb + " " + file[:i] + " " + dir + file[i+1:]
+}
+
+// commitMessage generates a commit message from the staged changes: a
+// subject listing them (truncated to MaxSubject), the full list in the body
+// when truncated, and the objects last managers as trailers.
+func (s *Store) commitMessage(changes []stagedChange) string {
+	if len(changes) == 0 {
+		return s.Msg
+	}
+
+	descs := make([]string, 0, len(changes))
+	for _, c := range changes {
+		descs = append(descs, c.describe())
+	}
+
+	subject, truncated := summarize(descs, MaxSubject)
+
+	var msg strings.Builder
+	msg.WriteString(subject)
+
+	if truncated {
+		msg.WriteString("\n\n")
+		msg.WriteString(strings.Join(descs, "\n"))
+	}
+
+	if s.Managers {
+		managers := s.managers(changes)
+		if len(managers) > 0 {
+			msg.WriteString("\n")
+		}
+		for _, manager := range managers {
+			msg.WriteString("\n" + ManagerTrailer + ": " + manager)
+		}
+	}
+
+	return msg.String()
+}
+
+// summarize joins as many descriptions as fit in max characters, then
+// counts the others.
+func summarize(descs []string, max int) (string, bool) {
+	all := strings.Join(descs, ", ")
+	if len(all) <= max || len(descs) == 1 {
+		return all, false
+	}
+
+	subject := descs[0]
+	n := 1
+	for ; n < len(descs); n++ {
+		more := fmt.Sprintf(" and %d more", len(descs)-n-1)
+		if len(subject)+len(", ")+len(descs[n])+len(more) > max {
+			break
+		}
+		subject += ", " + descs[n]
+	}
+
+	return fmt.Sprintf("%s and %d more", subject, len(descs)-n), true
+}
+
+// managers returns the last managers of the created or updated objects, as
+// found in their metadata.managedFields (when those aren't stripped).
+func (s *Store) managers(changes []stagedChange) []string {
+	seen := make(map[string]bool)
+	var managers []string
+
+	for _, c := range changes {
+		if c.status == "D" || !strings.HasSuffix(c.path, ".yaml") {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(s.LocalDir, c.path))
+		if err != nil {
+			continue
+		}
+
+		manager := lastManager(data)
+		if manager != "" && !seen[manager] {
+			seen[manager] = true
+			managers = append(managers, manager)
+		}
+	}
+
+	sort.Strings(managers)
+	return managers
+}
+
+// lastManager returns the manager of the most recent managedFields entry
+func lastManager(data []byte) string {
+	var obj struct {
+		Metadata struct {
+			ManagedFields []struct {
+				Manager string `json:"manager"`
+				Time    string `json:"time"`
+			} `json:"managedFields"`
+		} `json:"metadata"`
+	}
+
+	if err := yaml.Unmarshal(data, &obj); err != nil {
+		return ""
+	}
+
+	var last string
+	var lastTime time.Time
+	for _, entry := range obj.Metadata.ManagedFields {
+		t, _ := time.Parse(time.RFC3339, entry.Time)
+		if entry.Manager != "" && !t.Before(lastTime) {
+			last, lastTime = entry.Manager, t
+		}
+	}
+
+	return last
+}
@@ -0,0 +1,116 @@
+package git
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDescribe(t *testing.T) {
+	for change, expected := range map[stagedChange]string{
+		{"M", "prod/deployment-api.yaml"}:            "update deployment prod/api",
+		{"D", "dev/configmap-foo-bar.yaml"}:          "delete configmap dev/foo-bar",
+		{"A", "namespace-prod.yaml"}:                 "create namespace prod",
+		{"A", "cluster-eu/prod/deployment-api.yaml"}: "create deployment cluster-eu/prod/api",
+		{"M", "README.md"}:                           "update README.md",
+		{"X", "prod/deployment-api.yaml"}:            "change deployment prod/api",
+	} {
+		if desc := change.describe(); desc != expected {
+			t.Errorf("%v should be described as %q, got %q", change, expected, desc)
+		}
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	descs := []string{"update deployment prod/api", "delete configmap dev/foo"}
+	subject, truncated := summarize(descs, 72)
+	if subject != "update deployment prod/api, delete configmap dev/foo" || truncated {
+		t.Errorf("short lists should fit in the subject: %q", subject)
+	}
+
+	descs = append(descs, "create secret prod/bar", "update service prod/api")
+	subject, truncated = summarize(descs, 72)
+	if subject != "update deployment prod/api, delete configmap dev/foo and 2 more" || !truncated {
+		t.Errorf("long lists should be truncated: %q", subject)
+	}
+
+	subject, truncated = summarize(descs, 10)
+	if subject != "update deployment prod/api and 3 more" || !truncated {
+		t.Errorf("at least one change should be listed: %q", subject)
+	}
+}
+
+func TestLastManager(t *testing.T) {
+	obj := []byte(`
+metadata:
+  name: foo
+  managedFields:
+  - manager: kubectl
+    operation: Update
+    time: "2026-10-01T12:00:00Z"
+  - manager: kube-controller-manager
+    operation: Update
+    time: "2026-10-01T14:00:00Z"
+  - manager: helm
+    operation: Update
+    time: "2026-10-01T10:00:00Z"
+`)
+
+	if manager := lastManager(obj); manager != "kube-controller-manager" {
+		t.Errorf("lastManager should return the most recent manager, got %q", manager)
+	}
+
+	if manager := lastManager([]byte("metadata:\n  name: foo\n")); manager != "" {
+		t.Errorf("lastManager should be empty without managedFields, got %q", manager)
+	}
+}
+
+func TestCommitMessage(t *testing.T) {
+	if !testHasGit {
+		t.Log("git not found, skipping")
+		t.Skip()
+	}
+
+	dir, err := ioutil.TempDir("", "katafygio-tests")
+	if err != nil {
+		t.Fatal("failed to create a temp dir for tests")
+	}
+
+	defer os.RemoveAll(dir)
+
+	repo := New(new(mockLog), false, dir, "", timeout)
+	repo.Managers = true
+	if err = repo.CloneOrInit(); err != nil {
+		t.Fatalf("failed to init git: %v", err)
+	}
+
+	_ = os.Mkdir(dir+"/prod", 0700)
+	_ = ioutil.WriteFile(dir+"/prod/deployment-api.yaml",
+		[]byte("metadata:\n  managedFields:\n  - manager: kubectl\n    time: \"2026-10-01T12:00:00Z\"\n"), 0600)
+	_ = ioutil.WriteFile(dir+"/prod/configmap-foo.yaml", []byte("v1"), 0600)
+	if _, err = repo.Commit(); err != nil {
+		t.Fatalf("commit failed: %v", err)
+	}
+
+	_ = os.Remove(dir + "/prod/configmap-foo.yaml")
+	if _, err = repo.Commit(); err != nil {
+		t.Fatalf("commit failed: %v", err)
+	}
+
+	out, err := repo.run("log", "--format=%B%x00")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := strings.Split(string(out), "\x00")
+	expected := []string{
+		"delete configmap prod/foo",
+		"create configmap prod/foo, create deployment prod/api\n\nManaged-by: kubectl",
+	}
+	for i, msg := range expected {
+		if strings.TrimSpace(msgs[i]) != msg {
+			t.Errorf("commit message should be %q, got %q", msg, strings.TrimSpace(msgs[i]))
+		}
+	}
+}
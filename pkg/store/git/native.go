@@ -0,0 +1,945 @@
+package git
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	gogit "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/gitignore"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/index"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+// native tells if the repository operations go through go-git, rather than
+// the git command. Credential helpers are only supported by the latter, and
+// dry runs stick to the Git and Status no-ops.
+func (s *Store) native() bool {
+	return !s.CLI && !s.DryRun && s.Auth.CredentialHelper == ""
+}
+
+func (s *Store) open() (*gogit.Repository, *gogit.Worktree, error) {
+	repo, err := gogit.PlainOpen(s.LocalDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open the %s repository: %v", s.LocalDir, err)
+	}
+
+	wt, err := repo.Worktree()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open the %s worktree: %v", s.LocalDir, err)
+	}
+
+	// go-git doesn't read .git/info/exclude
+	wt.Excludes = append(wt.Excludes, gitignore.ParsePattern(".temp-katafygio-*", nil))
+	for _, pattern := range s.Ignore {
+		wt.Excludes = append(wt.Excludes, gitignore.ParsePattern(pattern, nil))
+	}
+
+	return repo, wt, nil
+}
+
+// transportAuth returns the go-git authentication matching Auth, or nil
+// to use go-git's defaults (eg. ssh agent and ~/.ssh/known_hosts).
+func (s *Store) transportAuth() (transport.AuthMethod, error) {
+	if s.Auth.Token != "" {
+		username := s.Auth.Username
+		if username == "" {
+			username = DefaultTokenUser
+		}
+		return &http.BasicAuth{Username: username, Password: s.Auth.Token}, nil
+	}
+
+	if s.Auth.SSHKey == "" && s.Auth.KnownHosts == "" {
+		return nil, nil
+	}
+
+	ep, err := transport.NewEndpoint(s.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid git url: %v", err)
+	}
+
+	user := ep.User
+	if user == "" {
+		user = "git"
+	}
+
+	var auth interface {
+		transport.AuthMethod
+		setHostKeys(files ...string) error
+	}
+
+	if s.Auth.SSHKey != "" {
+		keys, err := ssh.NewPublicKeysFromFile(user, s.Auth.SSHKey, "")
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the ssh key %s: %v", s.Auth.SSHKey, err)
+		}
+		auth = &publicKeys{keys}
+	} else {
+		agent, err := ssh.NewSSHAgentAuth(user)
+		if err != nil {
+			return nil, fmt.Errorf("failed to reach the ssh agent: %v", err)
+		}
+		auth = &agentKeys{agent}
+	}
+
+	if s.Auth.KnownHosts != "" {
+		if err := auth.setHostKeys(s.Auth.KnownHosts); err != nil {
+			return nil, fmt.Errorf("failed to load the known hosts %s: %v", s.Auth.KnownHosts, err)
+		}
+	}
+
+	return auth, nil
+}
+
+type publicKeys struct{ *ssh.PublicKeys }
+
+func (k *publicKeys) setHostKeys(files ...string) (err error) {
+	k.HostKeyCallback, err = ssh.NewKnownHostsCallback(files...)
+	return err
+}
+
+type agentKeys struct{ *ssh.PublicKeysCallback }
+
+func (k *agentKeys) setHostKeys(files ...string) (err error) {
+	k.HostKeyCallback, err = ssh.NewKnownHostsCallback(files...)
+	return err
+}
+
+func (s *Store) nativeStatus() (bool, error) {
+	_, wt, err := s.open()
+	if err != nil {
+		return false, err
+	}
+
+	status, err := wt.Status()
+	if err != nil {
+		return false, fmt.Errorf("failed to get the git status: %v", err)
+	}
+
+	return !status.IsClean(), nil
+}
+
+// nativeCloneOrInit is the go-git counterpart of cloneOrInit
+func (s *Store) nativeCloneOrInit() error {
+	if s.URL == "" {
+		repo, err := gogit.PlainInit(s.LocalDir, false)
+		if err != nil {
+			return err
+		}
+		return s.nativeSetup(repo)
+	}
+
+	auth, err := s.transportAuth()
+	if err != nil {
+		return err
+	}
+
+	exists, err := s.nativeRemoteHasBranch(auth, s.Branch)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		opts := &gogit.CloneOptions{URL: s.URL, Auth: auth, Depth: 1, SingleBranch: true}
+		if s.Branch != "" {
+			opts.ReferenceName = plumbing.NewBranchReferenceName(s.Branch)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+		defer cancel()
+
+		repo, err := gogit.PlainCloneContext(ctx, s.LocalDir, false, opts)
+		if err != nil {
+			return err
+		}
+		return s.nativeSetup(repo)
+	}
+
+	if s.Branch != "" {
+		s.Logger.Infof("branch %s not found in %s, starting it as an orphan branch", s.Branch, s.URL)
+	}
+
+	repo, err := gogit.PlainInit(s.LocalDir, false)
+	if err != nil {
+		return err
+	}
+
+	_, err = repo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{s.URL}})
+	if err != nil {
+		return err
+	}
+
+	return s.nativeSetup(repo)
+}
+
+// nativeRemoteHasBranch tells if the remote has a branch (or any branch,
+// when branch is empty)
+func (s *Store) nativeRemoteHasBranch(auth transport.AuthMethod, branch string) (bool, error) {
+	remote := gogit.NewRemote(memory.NewStorage(), &config.RemoteConfig{Name: "origin", URLs: []string{s.URL}})
+
+	refs, err := remote.List(&gogit.ListOptions{Auth: auth})
+	if err == transport.ErrEmptyRemoteRepository {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	for _, ref := range refs {
+		if !ref.Name().IsBranch() {
+			continue
+		}
+		if branch == "" || ref.Name().Short() == branch {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// nativeSetup points an orphan HEAD to Branch, and configures the commits
+// author, for the commands run by the git command fallbacks.
+func (s *Store) nativeSetup(repo *gogit.Repository) error {
+	if _, err := repo.Head(); err == plumbing.ErrReferenceNotFound && s.Branch != "" {
+		head := plumbing.NewSymbolicReference(plumbing.HEAD, plumbing.NewBranchReferenceName(s.Branch))
+		if err = repo.Storer.SetReference(head); err != nil {
+			return err
+		}
+	}
+
+	cfg, err := repo.Config()
+	if err != nil {
+		return err
+	}
+
+	cfg.Raw.Section("user").SetOption("name", s.Author)
+	cfg.Raw.Section("user").SetOption("email", s.Email)
+
+	return repo.Storer.SetConfig(cfg)
+}
+
+// nativeCheckedOut returns the checked out branch (possibly not born yet)
+func (s *Store) nativeCheckedOut() (string, error) {
+	repo, err := gogit.PlainOpen(s.LocalDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to find the current git branch: %v", err)
+	}
+
+	head, err := repo.Storer.Reference(plumbing.HEAD)
+	if err != nil || head.Type() != plumbing.SymbolicReference {
+		return "", fmt.Errorf("failed to find the current git branch: HEAD is detached")
+	}
+
+	return head.Target().Short(), nil
+}
+
+// nativeCommit stages and commits all the changes, like "git add -A" and
+// "git commit" would.
+func (s *Store) nativeCommit() (bool, error) {
+	repo, wt, err := s.open()
+	if err != nil {
+		return false, err
+	}
+
+	status, err := wt.Status()
+	if err != nil {
+		return false, fmt.Errorf("failed to get the git status: %v", err)
+	}
+
+	if status.IsClean() {
+		return false, nil
+	}
+
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		return false, fmt.Errorf("failed to read the git index: %v", err)
+	}
+
+	head, err := headTree(repo)
+	if err != nil {
+		return false, err
+	}
+
+	var changes []stagedChange
+	for path, st := range status {
+		if st.Worktree == gogit.Unmodified && st.Staging == gogit.Unmodified {
+			continue
+		}
+
+		change, err := s.stage(repo, idx, head, path)
+		if err != nil {
+			return false, fmt.Errorf("failed to git add %s: %v", path, err)
+		}
+		if change != nil {
+			changes = append(changes, *change)
+		}
+	}
+
+	if err = repo.Storer.SetIndex(idx); err != nil {
+		return false, fmt.Errorf("failed to write the git index: %v", err)
+	}
+
+	if len(changes) == 0 {
+		return false, nil
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].path < changes[j].path })
+	msg := s.commitMessage(changes)
+
+	if _, err = wt.Commit(msg, &gogit.CommitOptions{Author: s.signature(time.Now())}); err != nil {
+		return false, fmt.Errorf("failed to git commit: %v", err)
+	}
+
+	return true, nil
+}
+
+// nativeCommitObject commits an object's file on its own, dated with the
+// change time. It returns the commit verb ("" when the file didn't change).
+func (s *Store) nativeCommitObject(change *objectChange, msg func(verb string) string) (bool, error) {
+	repo, wt, err := s.open()
+	if err != nil {
+		return false, err
+	}
+
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		return false, fmt.Errorf("failed to read the git index: %v", err)
+	}
+
+	head, err := headTree(repo)
+	if err != nil {
+		return false, err
+	}
+
+	staged, err := s.stage(repo, idx, head, filepath.ToSlash(change.path))
+	if err != nil {
+		return false, fmt.Errorf("failed to git add %s: %v", change.path, err)
+	}
+
+	if staged == nil {
+		// eg. created then deleted, or already committed
+		return false, nil
+	}
+
+	if err = repo.Storer.SetIndex(idx); err != nil {
+		return false, fmt.Errorf("failed to write the git index: %v", err)
+	}
+
+	_, err = wt.Commit(msg(verbs[staged.status]), &gogit.CommitOptions{Author: s.signature(change.time)})
+	if err != nil {
+		return false, fmt.Errorf("failed to git commit %s: %v", change.path, err)
+	}
+
+	return true, nil
+}
+
+// stage updates a file's index entry from the working copy, and returns
+// the file change relative to HEAD (nil when it didn't change).
+func (s *Store) stage(repo *gogit.Repository, idx *index.Index, head *object.Tree, path string) (*stagedChange, error) {
+	var committed *object.File
+	if head != nil {
+		committed, _ = head.File(path)
+	}
+
+	info, err := os.Lstat(filepath.Join(s.LocalDir, filepath.FromSlash(path)))
+	if os.IsNotExist(err) {
+		if _, err = idx.Remove(path); err != nil && err != index.ErrEntryNotFound {
+			return nil, err
+		}
+		if committed == nil {
+			return nil, nil
+		}
+		return &stagedChange{status: "D", path: path}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(s.LocalDir, filepath.FromSlash(path)))
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := writeBlob(repo, data)
+	if err != nil {
+		return nil, err
+	}
+
+	mode, err := filemode.NewFromOSFileMode(info.Mode())
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := idx.Entry(path)
+	if err == index.ErrEntryNotFound {
+		entry = idx.Add(path)
+	} else if err != nil {
+		return nil, err
+	}
+
+	entry.Hash = hash
+	entry.Mode = mode
+	entry.ModifiedAt = info.ModTime()
+	entry.Size = uint32(info.Size())
+
+	switch {
+	case committed == nil:
+		return &stagedChange{status: "A", path: path}, nil
+	case committed.Hash != hash || committed.Mode != mode:
+		return &stagedChange{status: "M", path: path}, nil
+	}
+
+	return nil, nil
+}
+
+func writeBlob(repo *gogit.Repository, data []byte) (plumbing.Hash, error) {
+	obj := repo.Storer.NewEncodedObject()
+	obj.SetType(plumbing.BlobObject)
+	obj.SetSize(int64(len(data)))
+
+	w, err := obj.Writer()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	if _, err = w.Write(data); err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	if err = w.Close(); err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	return repo.Storer.SetEncodedObject(obj)
+}
+
+// headTree returns HEAD's tree, or nil on unborn branches
+func headTree(repo *gogit.Repository) (*object.Tree, error) {
+	head, err := repo.Head()
+	if err == plumbing.ErrReferenceNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve HEAD: %v", err)
+	}
+
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read HEAD: %v", err)
+	}
+
+	return commit.Tree()
+}
+
+func (s *Store) signature(when time.Time) *object.Signature {
+	if when.IsZero() {
+		when = time.Now()
+	}
+	return &object.Signature{Name: s.Author, Email: s.Email, When: when}
+}
+
+// nativePush pushes HEAD to the remote branch, creating it when needed
+func (s *Store) nativePush(branch string) error {
+	repo, err := gogit.PlainOpen(s.LocalDir)
+	if err != nil {
+		return err
+	}
+
+	auth, err := s.transportAuth()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+	defer cancel()
+
+	local := plumbing.NewBranchReferenceName(branch)
+	err = repo.PushContext(ctx, &gogit.PushOptions{
+		RemoteName: "origin",
+		RefSpecs:   []config.RefSpec{config.RefSpec(local.String() + ":" + local.String())},
+		Auth:       auth,
+	})
+	if err != nil && err != gogit.NoErrAlreadyUpToDate {
+		return err
+	}
+
+	// go-git doesn't update the remote-tracking branch on push, as git does
+	head, err := repo.Reference(local, true)
+	if err != nil {
+		return err
+	}
+
+	remoteRef := plumbing.NewRemoteReferenceName("origin", branch)
+	return repo.Storer.SetReference(plumbing.NewHashReference(remoteRef, head.Hash()))
+}
+
+// nativePull fetches the remote branch, and fast-forwards to it, or merges
+// it when the branches diverged.
+func (s *Store) nativePull(branch string) error {
+	repo, wt, err := s.open()
+	if err != nil {
+		return err
+	}
+
+	auth, err := s.transportAuth()
+	if err != nil {
+		return err
+	}
+
+	// nothing to pull from a branch we didn't push yet, unless it was
+	// created meanwhile
+	remoteRef := plumbing.NewRemoteReferenceName("origin", branch)
+	if _, err = repo.Reference(remoteRef, true); err != nil {
+		exists, err := s.nativeRemoteHasBranch(auth, branch)
+		if err != nil || !exists {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+	defer cancel()
+
+	err = repo.FetchContext(ctx, &gogit.FetchOptions{
+		RemoteName: "origin",
+		RefSpecs:   []config.RefSpec{config.RefSpec("+refs/heads/" + branch + ":" + remoteRef.String())},
+		Auth:       auth,
+	})
+	if err != nil && err != gogit.NoErrAlreadyUpToDate {
+		return err
+	}
+
+	remote, err := repo.Reference(remoteRef, true)
+	if err != nil {
+		return err
+	}
+
+	theirs, err := repo.CommitObject(remote.Hash())
+	if err != nil {
+		return err
+	}
+
+	head, err := repo.Head()
+	if err == plumbing.ErrReferenceNotFound {
+		// an orphan branch without commits yet
+		return s.nativeCheckout(repo, wt, nil, theirs)
+	}
+	if err != nil {
+		return err
+	}
+
+	ours, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return err
+	}
+
+	base, err := mergeBase(repo, ours.Hash, theirs.Hash)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case base != nil && base.Hash == theirs.Hash:
+		return nil // up to date, or ahead
+	case base != nil && base.Hash == ours.Hash:
+		return s.nativeCheckout(repo, wt, ours, theirs)
+	}
+
+	merge, err := s.nativeMerge(repo, branch, base, ours, theirs)
+	if err != nil {
+		return fmt.Errorf("failed to merge the diverged branches: %v", err)
+	}
+
+	return s.nativeCheckout(repo, wt, ours, merge)
+}
+
+// nativeMerge commits a merge of the remote branch into ours, favoring our
+// files on conflicts (like the git command's "-X ours" strategy option does):
+// the files changed on one side only take that side's version, and those
+// changed on both sides keep ours. Without a merge base (eg. when it's beyond
+// a shallow clone's history), files from both sides are kept, favoring ours.
+func (s *Store) nativeMerge(repo *gogit.Repository, branch string, base, ours, theirs *object.Commit) (*object.Commit, error) {
+	baseFiles, err := commitFiles(base)
+	if err != nil {
+		return nil, err
+	}
+
+	ourFiles, err := commitFiles(ours)
+	if err != nil {
+		return nil, err
+	}
+
+	theirFiles, err := commitFiles(theirs)
+	if err != nil {
+		return nil, err
+	}
+
+	merged := make(map[string]object.TreeEntry)
+	for path, entry := range ourFiles {
+		merged[path] = entry
+	}
+
+	for path, entry := range theirFiles {
+		if sameEntry(baseFiles, ourFiles, path) {
+			merged[path] = entry
+		}
+	}
+
+	for path := range baseFiles {
+		// deleted on their side only
+		if _, ok := theirFiles[path]; !ok && sameEntry(baseFiles, ourFiles, path) {
+			delete(merged, path)
+		}
+	}
+
+	tree, err := writeTree(repo, merged)
+	if err != nil {
+		return nil, err
+	}
+
+	sig := s.signature(time.Now())
+	commit := &object.Commit{
+		Author:       *sig,
+		Committer:    *sig,
+		Message:      fmt.Sprintf("Merge branch '%s' of %s\n", branch, s.URL),
+		TreeHash:     tree,
+		ParentHashes: []plumbing.Hash{ours.Hash, theirs.Hash},
+	}
+
+	obj := repo.Storer.NewEncodedObject()
+	if err = commit.Encode(obj); err != nil {
+		return nil, err
+	}
+
+	hash, err := repo.Storer.SetEncodedObject(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	return repo.CommitObject(hash)
+}
+
+// nativeCheckout moves the current branch and the index from a commit (nil
+// on unborn branches) to another, and updates the files that differ between
+// them. Unlike go-git's merge reset, which would delete them, files saved
+// but not committed yet are left alone: they'll be committed on top.
+func (s *Store) nativeCheckout(repo *gogit.Repository, wt *gogit.Worktree, from, to *object.Commit) error {
+	before, err := commitFiles(from)
+	if err != nil {
+		return err
+	}
+
+	after, err := commitFiles(to)
+	if err != nil {
+		return err
+	}
+
+	s.filesLock.Lock()
+	defer s.filesLock.Unlock()
+
+	for path, entry := range after {
+		if prev, ok := before[path]; ok && prev.Hash == entry.Hash && prev.Mode == entry.Mode {
+			continue
+		}
+		if err = s.checkoutFile(repo, path, before, &entry); err != nil {
+			return err
+		}
+	}
+
+	for path := range before {
+		if _, ok := after[path]; !ok {
+			if err = s.checkoutFile(repo, path, before, nil); err != nil {
+				return err
+			}
+		}
+	}
+
+	if from == nil {
+		// the reset moves the branch, which must exist
+		head, err := repo.Storer.Reference(plumbing.HEAD)
+		if err != nil {
+			return err
+		}
+		if err = repo.Storer.SetReference(plumbing.NewHashReference(head.Target(), to.Hash)); err != nil {
+			return err
+		}
+	}
+
+	return wt.Reset(&gogit.ResetOptions{Mode: gogit.MixedReset, Commit: to.Hash})
+}
+
+// checkoutFile writes a file from a commit (or removes it, when entry is
+// nil), unless its working copy was changed since the previous commit.
+func (s *Store) checkoutFile(repo *gogit.Repository, path string, before map[string]object.TreeEntry, entry *object.TreeEntry) error {
+	local := filepath.Join(s.LocalDir, filepath.FromSlash(path))
+	data, err := ioutil.ReadFile(local)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	prev, committed := before[path]
+	switch {
+	case os.IsNotExist(err) && committed:
+		return nil // removed since
+	case err == nil && (!committed || prev.Hash != plumbing.ComputeHash(plumbing.BlobObject, data)):
+		return nil // saved since
+	}
+
+	if entry == nil {
+		if err = os.Remove(local); os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	blob, err := repo.BlobObject(entry.Hash)
+	if err != nil {
+		return err
+	}
+
+	r, err := blob.Reader()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if data, err = ioutil.ReadAll(r); err != nil {
+		return err
+	}
+
+	return s.files().Save(path, data)
+}
+
+// commitFiles returns a commit's files, by path (none for a nil commit)
+func commitFiles(commit *object.Commit) (map[string]object.TreeEntry, error) {
+	files := make(map[string]object.TreeEntry)
+	if commit == nil {
+		return files, nil
+	}
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+
+	err = tree.Files().ForEach(func(f *object.File) error {
+		files[f.Name] = object.TreeEntry{Name: f.Name, Mode: f.Mode, Hash: f.Hash}
+		return nil
+	})
+
+	return files, err
+}
+
+// sameEntry tells if a file is the same (or equally missing) in two commits
+func sameEntry(a, b map[string]object.TreeEntry, path string) bool {
+	ea, inA := a[path]
+	eb, inB := b[path]
+	return inA == inB && ea.Hash == eb.Hash && ea.Mode == eb.Mode
+}
+
+// writeTree stores the tree objects for a set of files, by path
+func writeTree(repo *gogit.Repository, files map[string]object.TreeEntry) (plumbing.Hash, error) {
+	var entries []object.TreeEntry
+	dirs := make(map[string]map[string]object.TreeEntry)
+
+	for path, entry := range files {
+		if i := strings.Index(path, "/"); i >= 0 {
+			dir := path[:i]
+			if dirs[dir] == nil {
+				dirs[dir] = make(map[string]object.TreeEntry)
+			}
+			dirs[dir][path[i+1:]] = entry
+			continue
+		}
+		entry.Name = path
+		entries = append(entries, entry)
+	}
+
+	for dir, sub := range dirs {
+		hash, err := writeTree(repo, sub)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		entries = append(entries, object.TreeEntry{Name: dir, Mode: filemode.Dir, Hash: hash})
+	}
+
+	// git sorts the entries by name, directories as if their name ended with "/"
+	sortName := func(e object.TreeEntry) string {
+		if e.Mode == filemode.Dir {
+			return e.Name + "/"
+		}
+		return e.Name
+	}
+	sort.Slice(entries, func(i, j int) bool { return sortName(entries[i]) < sortName(entries[j]) })
+
+	obj := repo.Storer.NewEncodedObject()
+	if err := (&object.Tree{Entries: entries}).Encode(obj); err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	return repo.Storer.SetEncodedObject(obj)
+}
+
+// mergeBase returns the nearest common ancestor of two commits, or nil when
+// there's none in the (possibly shallow) history.
+func mergeBase(repo *gogit.Repository, a, b plumbing.Hash) (*object.Commit, error) {
+	ancestors := make(map[plumbing.Hash]bool)
+	err := walkAncestors(repo, a, func(c *object.Commit) bool {
+		ancestors[c.Hash] = true
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var base *object.Commit
+	err = walkAncestors(repo, b, func(c *object.Commit) bool {
+		if ancestors[c.Hash] {
+			base = c
+			return true
+		}
+		return false
+	})
+
+	return base, err
+}
+
+// walkAncestors visits a commit and its ancestors, breadth first, until
+// visit returns true. Commits missing from shallow clones are skipped.
+func walkAncestors(repo *gogit.Repository, from plumbing.Hash, visit func(*object.Commit) bool) error {
+	seen := map[plumbing.Hash]bool{from: true}
+	queue := []plumbing.Hash{from}
+
+	for len(queue) > 0 {
+		commit, err := repo.CommitObject(queue[0])
+		queue = queue[1:]
+		if err == plumbing.ErrObjectNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if visit(commit) {
+			return nil
+		}
+
+		for _, parent := range commit.ParentHashes {
+			if !seen[parent] {
+				seen[parent] = true
+				queue = append(queue, parent)
+			}
+		}
+	}
+
+	return nil
+}
+
+// nativeResolveRevision resolves a commit id, a tag or a branch, or the
+// last commit before a given time when before isn't zero.
+func (s *Store) nativeResolveRevision(rev string, before time.Time) (string, error) {
+	repo, err := gogit.PlainOpen(s.LocalDir)
+	if err != nil {
+		return "", err
+	}
+
+	if before.IsZero() {
+		hash, err := repo.ResolveRevision(plumbing.Revision(rev))
+		if err == nil {
+			return hash.String(), nil
+		}
+		if !isHexPrefix(rev) {
+			return "", err
+		}
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		return "", err
+	}
+
+	iter, err := repo.Log(&gogit.LogOptions{From: head.Hash(), Order: gogit.LogOrderCommitterTime})
+	if err != nil {
+		return "", err
+	}
+
+	var found string
+	err = iter.ForEach(func(c *object.Commit) error {
+		if (before.IsZero() && strings.HasPrefix(c.Hash.String(), rev)) ||
+			(!before.IsZero() && !c.Committer.When.After(before)) {
+			found = c.Hash.String()
+			return storer.ErrStop
+		}
+		return nil
+	})
+
+	if err != nil && err != plumbing.ErrObjectNotFound {
+		return "", err
+	}
+
+	if found == "" {
+		return "", plumbing.ErrReferenceNotFound
+	}
+
+	return found, nil
+}
+
+func isHexPrefix(rev string) bool {
+	if len(rev) < 4 || len(rev) > 40 {
+		return false
+	}
+	return strings.Trim(strings.ToLower(rev), "0123456789abcdef") == ""
+}
+
+// nativeReadTree returns the yaml files committed in a commit
+func (s *Store) nativeReadTree(commit string) (map[string][]byte, error) {
+	repo, err := gogit.PlainOpen(s.LocalDir)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := repo.CommitObject(plumbing.NewHash(commit))
+	if err != nil {
+		return nil, err
+	}
+
+	tree, err := c.Tree()
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string][]byte)
+	err = tree.Files().ForEach(func(f *object.File) error {
+		if !f.Mode.IsFile() || f.Mode == filemode.Symlink || !strings.HasSuffix(f.Name, ".yaml") {
+			return nil
+		}
+
+		r, err := f.Reader()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", f.Name, err)
+		}
+
+		files[f.Name] = data
+		return nil
+	})
+
+	return files, err
+}
@@ -0,0 +1,134 @@
+// Package local persists dumped objects as yaml files in a local directory.
+package local
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+var appFs = afero.NewOsFs()
+
+type logger interface {
+	Infof(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// Store maintains objects as files in a local directory
+type Store struct {
+	Logger   logger
+	LocalDir string
+	DryRun   bool
+}
+
+// New instantiate a new local Store
+func New(log logger, dryRun bool, dir string) *Store {
+	return &Store{
+		Logger:   log,
+		LocalDir: dir,
+		DryRun:   dryRun,
+	}
+}
+
+// Start creates the local directory
+func (s *Store) Start() error {
+	if s.DryRun {
+		return nil
+	}
+
+	err := appFs.MkdirAll(filepath.Clean(s.LocalDir), 0700)
+	if err != nil {
+		return fmt.Errorf("can't create directory %s: %v", s.LocalDir, err)
+	}
+
+	return nil
+}
+
+// Stop is a noop: files are written synchronously
+func (s *Store) Stop() {}
+
+// Commit is a noop: local files aren't versioned
+func (s *Store) Commit() (changed bool, err error) {
+	return false, nil
+}
+
+// Save atomically writes an object to a file
+func (s *Store) Save(key string, data []byte) error {
+	if s.DryRun {
+		return nil
+	}
+
+	file := filepath.Join(s.LocalDir, key)
+	dir := filepath.Clean(filepath.Dir(file))
+
+	err := appFs.MkdirAll(dir, 0700)
+	if err != nil {
+		return fmt.Errorf("can't create local directory %s: %v", dir, err)
+	}
+
+	tmpf, err := afero.TempFile(appFs, dir, ".temp-katafygio-")
+	if err != nil {
+		return fmt.Errorf("failed to create a temporary file: %v", err)
+	}
+
+	_, err = tmpf.Write(data)
+	if err != nil {
+		return fmt.Errorf("failed to write to %s on disk: %v", tmpf.Name(), err)
+	}
+
+	if err := tmpf.Close(); err != nil {
+		return fmt.Errorf("failed to close a temporary file: %v", err)
+	}
+
+	if err := appFs.Rename(tmpf.Name(), file); err != nil {
+		return fmt.Errorf("failed to rename %s to %s: %v", tmpf.Name(), file, err)
+	}
+
+	return nil
+}
+
+// Remove deletes an object's file
+func (s *Store) Remove(key string) error {
+	if s.DryRun {
+		return nil
+	}
+
+	return appFs.Remove(filepath.Join(s.LocalDir, key))
+}
+
+// List returns the relative paths of all yaml files found in the local
+// directory. Hidden directories (eg. .git) are skipped.
+func (s *Store) List() ([]string, error) {
+	root := filepath.Clean(s.LocalDir)
+	var keys []string
+
+	err := afero.Walk(appFs, root, func(path string, info os.FileInfo, err error) error {
+		if info == nil {
+			return fmt.Errorf("can't stat %s", path)
+		}
+
+		if info.IsDir() {
+			if path != root && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !strings.HasSuffix(path, ".yaml") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		keys = append(keys, rel)
+		return nil
+	})
+
+	return keys, err
+}
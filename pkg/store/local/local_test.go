@@ -0,0 +1,95 @@
+package local
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+type mockLog struct{}
+
+func (m *mockLog) Infof(format string, args ...interface{})  {}
+func (m *mockLog) Errorf(format string, args ...interface{}) {}
+
+var fakedir = "/tmp/ktest"
+
+func TestLocal(t *testing.T) {
+	appFs = afero.NewMemMapFs()
+
+	st := New(new(mockLog), false, fakedir)
+	if err := st.Start(); err != nil {
+		t.Errorf("failed to start: %v", err)
+	}
+
+	for _, key := range []string{"ns1/foo-bar.yaml", "foo-baz.yaml", "ns2/foo-spam.yaml"} {
+		if err := st.Save(key, []byte("egg")); err != nil {
+			t.Errorf("failed to save %s: %v", key, err)
+		}
+	}
+
+	data, err := afero.ReadFile(appFs, fakedir+"/ns1/foo-bar.yaml")
+	if err != nil || string(data) != "egg" {
+		t.Errorf("saved file content mismatch: %s (%v)", data, err)
+	}
+
+	if err := st.Remove("ns2/foo-spam.yaml"); err != nil {
+		t.Errorf("failed to remove a file: %v", err)
+	}
+
+	_ = afero.WriteFile(appFs, fakedir+"/roguefile.txt", []byte{42}, 0600)
+	_ = afero.WriteFile(appFs, fakedir+"/.git/foo.yaml", []byte{42}, 0600)
+	_ = afero.WriteFile(appFs, fakedir+"/.branches/prod/foo-qux.yaml", []byte{42}, 0600)
+
+	keys, err := st.List()
+	sort.Strings(keys)
+	expected := []string{"foo-baz.yaml", "ns1/foo-bar.yaml"}
+	if err != nil || !reflect.DeepEqual(keys, expected) {
+		t.Errorf("List failed: expected %v actual %v (%v)", expected, keys, err)
+	}
+
+	if changed, err := st.Commit(); changed || err != nil {
+		t.Error("Commit should be a noop")
+	}
+
+	st.Stop()
+}
+
+func TestDryRunLocal(t *testing.T) {
+	appFs = afero.NewMemMapFs()
+
+	st := New(new(mockLog), true, fakedir)
+	_ = st.Start()
+	_ = st.Save("foo.yaml", []byte("bar"))
+
+	exist, _ := afero.Exists(appFs, fakedir+"/foo.yaml")
+	if exist {
+		t.Error("foo.yaml was created but we're in dry-run mode")
+	}
+
+	_ = afero.WriteFile(appFs, fakedir+"/bar.yaml", []byte{42}, 0600)
+	_ = st.Remove("bar.yaml")
+
+	exist, _ = afero.Exists(appFs, fakedir+"/bar.yaml")
+	if !exist {
+		t.Error("bar.yaml was removed but we're in dry-run mode")
+	}
+}
+
+func TestFailingFSLocal(t *testing.T) {
+	appFs = afero.NewReadOnlyFs(afero.NewMemMapFs())
+
+	st := New(new(mockLog), false, fakedir)
+	if err := st.Start(); err == nil {
+		t.Error("Start should fail on a read-only filesystem")
+	}
+
+	if err := st.Save("foo.yaml", []byte("bar")); err == nil {
+		t.Error("Save should return an error in case of failure")
+	}
+
+	if _, err := st.List(); err == nil {
+		t.Error("List should fail on a missing directory")
+	}
+}
@@ -0,0 +1,230 @@
+// Package s3 persists dumped objects in an S3 compatible object storage
+// bucket (AWS S3, MinIO, Ceph RGW...), using the same keys layout as the
+// local and git stores. History is provided by the bucket versioning, and
+// each object is uploaded with some metadata (save time and checksum).
+package s3
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+var (
+	// DefaultRegion is used when no region is provided
+	DefaultRegion = "us-east-1"
+
+	// ContentType is the uploaded objects content type
+	ContentType = "application/yaml"
+)
+
+type logger interface {
+	Infof(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// Store maintains objects in an S3 bucket
+type Store struct {
+	Logger    logger
+	URL       *url.URL
+	Bucket    string
+	Prefix    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	Timeout   time.Duration
+	DryRun    bool
+	client    *http.Client
+}
+
+// New instantiate a new S3 Store. The rawurl is a path-style bucket url,
+// with an optional keys prefix, eg. "https://minio.example.com:9000/bucket/prefix".
+// Requests are anonymous when accessKey is empty.
+func New(log logger, dryRun bool, rawurl, region, accessKey, secretKey string, timeout time.Duration) (*Store, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 url %s: %v", rawurl, err)
+	}
+
+	parts := strings.SplitN(strings.Trim(u.Path, "/"), "/", 2)
+	if u.Host == "" || parts[0] == "" {
+		return nil, fmt.Errorf("invalid s3 url %s: expecting scheme://host/bucket[/prefix]", rawurl)
+	}
+
+	if region == "" {
+		region = DefaultRegion
+	}
+
+	s := &Store{
+		Logger:    log,
+		URL:       &url.URL{Scheme: u.Scheme, Host: u.Host},
+		Bucket:    parts[0],
+		Region:    region,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		Timeout:   timeout,
+		DryRun:    dryRun,
+		client:    &http.Client{Timeout: timeout},
+	}
+
+	if len(parts) > 1 {
+		s.Prefix = strings.Trim(parts[1], "/")
+	}
+
+	return s, nil
+}
+
+// Start checks that the bucket is reachable
+func (s *Store) Start() error {
+	s.Logger.Infof("Starting s3 store")
+
+	resp, err := s.do("HEAD", "", nil, nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to reach bucket %s: %v", s.Bucket, err)
+	}
+
+	return resp.Body.Close()
+}
+
+// Stop is a noop: objects are uploaded synchronously
+func (s *Store) Stop() {
+	s.Logger.Infof("Stopping s3 store")
+}
+
+// Commit is a noop: each upload is a new version
+func (s *Store) Commit() (changed bool, err error) {
+	return false, nil
+}
+
+// Save uploads an object
+func (s *Store) Save(key string, data []byte) error {
+	if s.DryRun {
+		return nil
+	}
+
+	sum := sha256.Sum256(data)
+	headers := map[string]string{
+		"Content-Type":                 ContentType,
+		"X-Amz-Meta-Katafygio-Saved":   time.Now().UTC().Format(time.RFC3339),
+		"X-Amz-Meta-Katafygio-Sha256":  hex.EncodeToString(sum[:]),
+		"X-Amz-Meta-Katafygio-Version": "1",
+	}
+
+	resp, err := s.do("PUT", s.objectKey(key), nil, headers, data)
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %v", key, err)
+	}
+
+	return resp.Body.Close()
+}
+
+// Remove deletes an object
+func (s *Store) Remove(key string) error {
+	if s.DryRun {
+		return nil
+	}
+
+	resp, err := s.do("DELETE", s.objectKey(key), nil, nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to delete %s: %v", key, err)
+	}
+
+	return resp.Body.Close()
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List returns the keys of all the objects stored under our prefix
+func (s *Store) List() ([]string, error) {
+	var keys []string
+	prefix := s.objectKey("")
+
+	query := url.Values{}
+	query.Set("list-type", "2")
+	query.Set("prefix", prefix)
+
+	for {
+		resp, err := s.do("GET", "", query, nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list bucket %s: %v", s.Bucket, err)
+		}
+
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode bucket %s list: %v", s.Bucket, err)
+		}
+
+		for _, obj := range result.Contents {
+			if strings.HasSuffix(obj.Key, ".yaml") {
+				keys = append(keys, strings.TrimPrefix(obj.Key, prefix))
+			}
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return keys, nil
+		}
+
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+func (s *Store) objectKey(key string) string {
+	if s.Prefix == "" {
+		return key
+	}
+
+	return s.Prefix + "/" + key
+}
+
+// do sends a signed request to the bucket, and returns the response on success
+func (s *Store) do(method, key string, query url.Values, headers map[string]string, body []byte) (*http.Response, error) {
+	u := *s.URL
+	u.Path = "/" + path.Join(s.Bucket, key)
+	u.RawPath = escapePath(u.Path)
+	if query != nil {
+		u.RawQuery = query.Encode()
+	}
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	if s.AccessKey != "" {
+		sign(req, body, s.AccessKey, s.SecretKey, s.Region, time.Now())
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("%s %s returned %s: %s", method, u.Path, resp.Status, msg)
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,35 @@
+// Package store defines the interface implemented by the storage backends,
+// which persist the dumped objects (see the local, git and s3 subpackages).
+package store
+
+import "github.com/bpineau/katafygio/pkg/event"
+
+// Interface is a storage backend. Objects are identified by keys, which
+// are relative file paths like "namespace/kind-name.yaml".
+type Interface interface {
+	// Start prepares the backend (eg. clone a repository, check a bucket)
+	Start() error
+
+	// Stop flushes pending changes and halts the backend
+	Stop()
+
+	// Save creates or updates an object
+	Save(key string, data []byte) error
+
+	// Remove deletes an object
+	Remove(key string) error
+
+	// List returns the keys of all the stored objects
+	List() ([]string, error)
+
+	// Commit records a new version of the stored objects, for backends
+	// that don't version every single change
+	Commit() (changed bool, err error)
+}
+
+// Journal is implemented by backends able to record each object change on
+// its own (eg. as a git commit). The recorder reports the changes it saved
+// or removed, with the notification that caused them.
+type Journal interface {
+	Record(key string, ev *event.Notification)
+}